@@ -22,5 +22,7 @@ require (
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/vishvananda/netlink v1.1.1-0.20210330154013-f5de75959ad5
 	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/sys v0.0.0-20210809222454-d867a43fc93e
+	gopkg.in/yaml.v2 v2.4.0
 )
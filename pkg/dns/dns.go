@@ -0,0 +1,258 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dns parses, validates and merges the DNS settings of results.
+//
+// Each plugin keeps its own way of picking between the DNS settings of the
+// IPAM plugin and those of its network configuration. The "dns" capability
+// arg the runtime sets in runtimeConfig then takes precedence over them: each
+// field it sets replaces the one of the plugin. Only the capability arg is
+// validated, the other settings are returned as configured, like they
+// always were.
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// RuntimeConfig is the "dns" capability arg
+type RuntimeConfig struct {
+	Servers  []string `json:"servers,omitempty"`
+	Searches []string `json:"searches,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// DNS returns the capability arg as DNS settings
+func (r *RuntimeConfig) DNS() types.DNS {
+	if r == nil {
+		return types.DNS{}
+	}
+	return types.DNS{
+		Nameservers: r.Servers,
+		Search:      r.Searches,
+		Options:     r.Options,
+	}
+}
+
+// ParseResolvConf parses an existing resolv.conf in to a DNS struct. Like
+// the resolver, it skips the lines it can't make sense of, logging a warning.
+func ParseResolvConf(filename string) (*types.DNS, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	dns := types.DNS{}
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		line = strings.TrimSpace(line)
+
+		// Skip comments, empty lines
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if err := validateLine(fields); err != nil {
+			log.Printf("%s:%d: skipping line: %v", filename, lineno, err)
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			dns.Nameservers = append(dns.Nameservers, fields[1])
+		case "domain":
+			dns.Domain = fields[1]
+		case "search":
+			dns.Search = append(dns.Search, fields[1:]...)
+		case "options":
+			dns.Options = append(dns.Options, fields[1:]...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &dns, nil
+}
+
+// validateLine checks the values of the resolv.conf line split in fields
+func validateLine(fields []string) error {
+	switch fields[0] {
+	case "nameserver":
+		return validateNameserver(fields[1])
+	case "domain":
+		return validateDomain("domain", fields[1])
+	case "search":
+		for _, s := range fields[1:] {
+			if err := validateDomain("search domain", s); err != nil {
+				return err
+			}
+		}
+	case "options":
+		for _, o := range fields[1:] {
+			if err := validateOption(o); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that the nameservers are IPs and that the domains and
+// options are well formed
+func Validate(dns types.DNS) error {
+	for _, ns := range dns.Nameservers {
+		if err := validateNameserver(ns); err != nil {
+			return err
+		}
+	}
+	if dns.Domain != "" {
+		if err := validateDomain("domain", dns.Domain); err != nil {
+			return err
+		}
+	}
+	for _, s := range dns.Search {
+		if err := validateDomain("search domain", s); err != nil {
+			return err
+		}
+	}
+	for _, o := range dns.Options {
+		if err := validateOption(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsSet returns true if any field of dns is set. Empty lists count, so a
+// source can clear the settings of the sources below it.
+func IsSet(dns types.DNS) bool {
+	return dns.Nameservers != nil ||
+		dns.Search != nil ||
+		dns.Options != nil ||
+		dns.Domain != ""
+}
+
+// Merge returns the settings of the last source that sets any, the sources
+// being given from the lowest to the highest precedence
+func Merge(sources ...types.DNS) types.DNS {
+	for i := len(sources) - 1; i >= 0; i-- {
+		if IsSet(sources[i]) {
+			return sources[i]
+		}
+	}
+	return types.DNS{}
+}
+
+// FromRuntimeConfig returns the "dns" capability arg of the network
+// configuration stdinData, if any
+func FromRuntimeConfig(stdinData []byte) (types.DNS, error) {
+	conf := struct {
+		RuntimeConfig struct {
+			DNS *RuntimeConfig `json:"dns"`
+		} `json:"runtimeConfig"`
+	}{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return types.DNS{}, fmt.Errorf("failed to parse runtimeConfig: %v", err)
+	}
+	return conf.RuntimeConfig.DNS.DNS(), nil
+}
+
+// Override returns dns with the fields the runtime sets replaced by those
+// of runtime
+func Override(dns types.DNS, runtime types.DNS) types.DNS {
+	if len(runtime.Nameservers) > 0 {
+		dns.Nameservers = runtime.Nameservers
+	}
+	if runtime.Domain != "" {
+		dns.Domain = runtime.Domain
+	}
+	if len(runtime.Search) > 0 {
+		dns.Search = runtime.Search
+	}
+	if len(runtime.Options) > 0 {
+		dns.Options = runtime.Options
+	}
+	return dns
+}
+
+// ForResult returns the DNS settings a main plugin returns, given those it
+// picked and the runtimeConfig in stdinData
+func ForResult(stdinData []byte, dns types.DNS) (types.DNS, error) {
+	runtimeDNS, err := FromRuntimeConfig(stdinData)
+	if err != nil {
+		return types.DNS{}, err
+	}
+	if err := Validate(runtimeDNS); err != nil {
+		return types.DNS{}, err
+	}
+	return Override(dns, runtimeDNS), nil
+}
+
+func validateNameserver(ns string) error {
+	// IPv6 link-local nameservers may carry a zone
+	addr := ns
+	if i := strings.IndexByte(addr, '%'); i > 0 && strings.Contains(addr, ":") {
+		addr = addr[:i]
+	}
+	if net.ParseIP(addr) == nil {
+		return fmt.Errorf("invalid nameserver %q", ns)
+	}
+	return nil
+}
+
+var domainLabel = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?$`)
+
+func validateDomain(what string, domain string) error {
+	// The root domain, as in "search ." to only look names up as given
+	if domain == "." {
+		return nil
+	}
+	name := strings.TrimSuffix(domain, ".")
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid %s %q", what, domain)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !domainLabel.MatchString(label) {
+			return fmt.Errorf("invalid %s %q", what, domain)
+		}
+	}
+	return nil
+}
+
+// Options are a name, optionally followed by a colon and a value, like
+// "rotate" or "ndots:5"
+var option = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*(:[^\s:]+)?$`)
+
+func validateOption(o string) error {
+	if !option.MatchString(o) {
+		return fmt.Errorf("invalid option %q", o)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/dns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("parsing resolv.conf", func() {
+	It("parses a simple resolv.conf file", func() {
+		contents := `
+		nameserver 192.0.2.0
+		nameserver 192.0.2.1
+		`
+		d, err := parse(contents)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*d).Should(Equal(types.DNS{Nameservers: []string{"192.0.2.0", "192.0.2.1"}}))
+	})
+	It("ignores comments", func() {
+		d, err := parse(`
+nameserver 192.0.2.0
+;nameserver 192.0.2.1
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*d).Should(Equal(types.DNS{Nameservers: []string{"192.0.2.0"}}))
+	})
+	It("parses all fields", func() {
+		d, err := parse(`
+nameserver 192.0.2.0
+nameserver 192.0.2.2
+domain example.com
+;nameserver comment
+#nameserver comment
+search example.net example.org
+search example.gov
+options one two three
+options four
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*d).Should(Equal(types.DNS{
+			Nameservers: []string{"192.0.2.0", "192.0.2.2"},
+			Domain:      "example.com",
+			Search:      []string{"example.net", "example.org", "example.gov"},
+			Options:     []string{"one", "two", "three", "four"},
+		}))
+	})
+	It("accepts scoped IPv6 nameservers and options with values", func() {
+		d, err := parse(`
+nameserver fe80::1%eth0
+options ndots:5 timeout:2 rotate
+search svc.cluster.local.
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.Nameservers).To(Equal([]string{"fe80::1%eth0"}))
+		Expect(d.Options).To(Equal([]string{"ndots:5", "timeout:2", "rotate"}))
+	})
+	It("accepts the root domain", func() {
+		d, err := parse(`
+search .
+domain .
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.Search).To(Equal([]string{"."}))
+		Expect(d.Domain).To(Equal("."))
+	})
+	It("skips invalid lines with a warning", func() {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		d, err := parse(`nameserver 192.0.2.0
+nameserver dns.example.com
+domain -example.com
+search example.com exa..mple.com
+search example.net
+options ndots:
+options ndots:5
+`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*d).Should(Equal(types.DNS{
+			Nameservers: []string{"192.0.2.0"},
+			Search:      []string{"example.net"},
+			Options:     []string{"ndots:5"},
+		}))
+		for _, warning := range []string{
+			`:2: skipping line: invalid nameserver "dns.example.com"`,
+			`:3: skipping line: invalid domain "-example.com"`,
+			`:4: skipping line: invalid search domain "exa..mple.com"`,
+			`:6: skipping line: invalid option "ndots:"`,
+		} {
+			Expect(logs.String()).To(ContainSubstring(warning))
+		}
+	})
+})
+
+var _ = Describe("DNS settings", func() {
+	ipamDNS := types.DNS{Nameservers: []string{"192.0.2.1"}, Domain: "ipam.example.com"}
+	confDNS := types.DNS{Search: []string{"conf.example.com"}}
+
+	It("takes the settings of the source with the highest precedence as a whole", func() {
+		Expect(dns.Merge(ipamDNS, confDNS)).To(Equal(confDNS))
+		Expect(dns.Merge(ipamDNS, types.DNS{})).To(Equal(ipamDNS))
+		Expect(dns.Merge()).To(Equal(types.DNS{}))
+
+		// Empty lists clear the settings below
+		cleared := types.DNS{Nameservers: []string{}}
+		Expect(dns.IsSet(cleared)).To(BeTrue())
+		Expect(dns.Merge(ipamDNS, cleared)).To(Equal(cleared))
+	})
+
+	It("lets the runtime override the fields it sets", func() {
+		stdin := []byte(`{"runtimeConfig": {"dns": {"servers": ["192.0.2.53"], "options": ["ndots:5"]}}}`)
+		d, err := dns.ForResult(stdin, ipamDNS)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(Equal(types.DNS{
+			Nameservers: []string{"192.0.2.53"},
+			Domain:      "ipam.example.com",
+			Options:     []string{"ndots:5"},
+		}))
+
+		Expect(dns.Override(confDNS, types.DNS{Search: []string{}})).To(Equal(confDNS))
+	})
+
+	It("returns the settings of the plugin as they are without runtime settings", func() {
+		d, err := dns.ForResult([]byte(`{}`), confDNS)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(Equal(confDNS))
+
+		d, err = dns.ForResult([]byte(`{}`), types.DNS{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(Equal(types.DNS{}))
+
+		// Only the capability arg is validated
+		invalid := types.DNS{Nameservers: []string{"nowhere"}, Search: []string{"exa mple.com"}}
+		d, err = dns.ForResult([]byte(`{}`), invalid)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d).To(Equal(invalid))
+	})
+
+	It("rejects invalid runtime settings", func() {
+		stdin := []byte(`{"runtimeConfig": {"dns": {"servers": ["nowhere"]}}}`)
+		_, err := dns.ForResult(stdin, confDNS)
+		Expect(err).To(MatchError(`invalid nameserver "nowhere"`))
+	})
+
+	It("validates the settings", func() {
+		Expect(dns.Validate(types.DNS{
+			Nameservers: []string{"192.0.2.1", "2001:db8::1"},
+			Domain:      "example.com",
+			Search:      []string{"a.example.com", "_tcp.example.com", "."},
+			Options:     []string{"edns0", "ndots:2"},
+		})).To(Succeed())
+		Expect(dns.Validate(types.DNS{Search: []string{"exa mple.com"}})).To(MatchError(`invalid search domain "exa mple.com"`))
+		Expect(dns.Validate(types.DNS{Options: []string{"ndots 2"}})).To(MatchError(`invalid option "ndots 2"`))
+	})
+})
+
+func parse(contents string) (*types.DNS, error) {
+	f, err := ioutil.TempFile("", "dns_resolv")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(contents); err != nil {
+		return nil, err
+	}
+
+	return dns.ParseResolvConf(f.Name())
+}
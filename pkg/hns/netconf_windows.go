@@ -26,6 +26,7 @@ import (
 	"github.com/Microsoft/hcsshim/hcn"
 	"github.com/buger/jsonparser"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/dns"
 )
 
 // NetConf is the CNI spec
@@ -43,10 +44,8 @@ type NetConf struct {
 	LoopbackDSR bool `json:"loopbackDSR,omitempty"`
 }
 
-type RuntimeDNS struct {
-	Nameservers []string `json:"servers,omitempty"`
-	Search      []string `json:"searches,omitempty"`
-}
+// RuntimeDNS is the "dns" capability arg
+type RuntimeDNS = dns.RuntimeConfig
 
 type PortMapEntry struct {
 	HostPort      int    `json:"hostPort"`
@@ -117,14 +116,7 @@ func (n *NetConf) GetHostComputeEndpointPolicies() []hcn.EndpointPolicy {
 
 // GetDNS returns the DNS values if they are there use that else use netconf supplied DNS.
 func (n *NetConf) GetDNS() types.DNS {
-	dnsResult := n.DNS
-	if len(n.RuntimeConfig.DNS.Nameservers) > 0 {
-		dnsResult.Nameservers = n.RuntimeConfig.DNS.Nameservers
-	}
-	if len(n.RuntimeConfig.DNS.Search) > 0 {
-		dnsResult.Search = n.RuntimeConfig.DNS.Search
-	}
-	return dnsResult
+	return dns.Override(n.DNS, n.RuntimeConfig.DNS.DNS())
 }
 
 // ApplyLoopbackDSRPolicy configures the given IP to support loopback DSR.
@@ -18,6 +18,7 @@ import (
 	"net"
 
 	"github.com/Microsoft/hcsshim/hcn"
+	"github.com/containernetworking/cni/pkg/types"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -597,4 +598,25 @@ var _ = Describe("NetConf", func() {
 			})
 		})
 	})
+
+	Describe("GetDNS", func() {
+		It("overrides the netconf DNS field by field with the runtime DNS", func() {
+			n := NetConf{}
+			n.DNS = types.DNS{
+				Nameservers: []string{"192.0.2.1"},
+				Domain:      "example.com",
+				Search:      []string{"example.com"},
+				Options:     []string{"ndots:2"},
+			}
+			Expect(n.GetDNS()).To(Equal(n.DNS))
+
+			n.RuntimeConfig.DNS = RuntimeDNS{Servers: []string{"192.0.2.53"}}
+			Expect(n.GetDNS()).To(Equal(types.DNS{
+				Nameservers: []string{"192.0.2.53"},
+				Domain:      "example.com",
+				Search:      []string{"example.com"},
+				Options:     []string{"ndots:2"},
+			}))
+		})
+	})
 })
@@ -12,7 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package disk
+// Package filelock provides locks on files shared between processes, such
+// as the plugins handling concurrent requests on a node.
+package filelock
 
 import (
 	"github.com/alexflint/go-filemutex"
@@ -57,3 +59,14 @@ func (l *FileLock) Lock() error {
 func (l *FileLock) Unlock() error {
 	return l.f.Unlock()
 }
+
+// RLock acquires a shared lock, held along with the other shared locks
+// but never with an exclusive one
+func (l *FileLock) RLock() error {
+	return l.f.RLock()
+}
+
+// RUnlock releases the shared lock
+func (l *FileLock) RUnlock() error {
+	return l.f.RUnlock()
+}
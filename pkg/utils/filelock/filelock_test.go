@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package disk
+package filelock
 
 import (
 	"io/ioutil"
@@ -60,4 +60,33 @@ var _ = Describe("Lock Operations", func() {
 		err = m.Unlock()
 		Expect(err).ToNot(HaveOccurred())
 	})
+
+	It("shares a read lock", func() {
+		dir, err := ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		m1, err := NewFileLock(dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer m1.Close()
+		m2, err := NewFileLock(dir)
+		Expect(err).ToNot(HaveOccurred())
+		defer m2.Close()
+
+		err = m1.RLock()
+		Expect(err).ToNot(HaveOccurred())
+		err = m2.RLock()
+		Expect(err).ToNot(HaveOccurred())
+
+		// but not with a write lock
+		err = m2.RUnlock()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m2.f.TryLock()).To(HaveOccurred())
+
+		err = m1.RUnlock()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m2.f.TryLock()).To(Succeed())
+		err = m2.Unlock()
+		Expect(err).ToNot(HaveOccurred())
+	})
 })
@@ -0,0 +1,126 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// dhcp6Client exchanges DHCPv6 messages with the servers on a link. It
+// must be used in the network namespace of the link.
+type dhcp6Client struct {
+	conn    *net.UDPConn
+	ifName  string
+	timeout time.Duration
+}
+
+// newDHCP6Client binds the DHCPv6 client port on the link-local address of
+// link, waiting up to timeout for duplicate address detection to complete
+func newDHCP6Client(link netlink.Link, timeout time.Duration) (*dhcp6Client, error) {
+	ll, err := waitLinkLocal(link, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ifName := link.Attrs().Name
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: ll, Port: dhcp6ClientPort, Zone: ifName})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dhcp6Client{
+		conn:    conn,
+		ifName:  ifName,
+		timeout: timeout,
+	}, nil
+}
+
+func (c *dhcp6Client) Close() error {
+	return c.conn.Close()
+}
+
+// send multicasts m to the DHCPv6 servers of the link
+func (c *dhcp6Client) send(m *dhcp6Message) error {
+	dst := &net.UDPAddr{IP: dhcp6ServersAddr, Port: dhcp6ServerPort, Zone: c.ifName}
+	_, err := c.conn.WriteToUDP(m.marshal(), dst)
+	return err
+}
+
+// exchange sends m and returns the first reply of type replyType to it
+func (c *dhcp6Client) exchange(m *dhcp6Message, replyType dhcp6MessageType) (*dhcp6Message, error) {
+	if err := c.send(m); err != nil {
+		return nil, err
+	}
+
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, fmt.Errorf("no DHCPv6 %s received in response to %s", replyType, m.msgType)
+			}
+			return nil, err
+		}
+
+		reply, err := parseDHCP6Message(buf[:n])
+		if err != nil || reply.msgType != replyType || reply.xid != m.xid {
+			continue
+		}
+		// Replies must be for this client
+		if !bytes.Equal(reply.option(dhcp6OptionClientID), m.option(dhcp6OptionClientID)) {
+			continue
+		}
+		if reply.option(dhcp6OptionServerID) == nil {
+			continue
+		}
+		return reply, nil
+	}
+}
+
+// waitLinkLocal returns the link-local address of link once it is usable
+func waitLinkLocal(link netlink.Link, timeout time.Duration) (net.IP, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if !a.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if a.Flags&unix.IFA_F_DADFAILED != 0 {
+				return nil, fmt.Errorf("duplicate address detection failed for %s on %q", a.IP, link.Attrs().Name)
+			}
+			if a.Flags&unix.IFA_F_TENTATIVE == 0 {
+				return a.IP, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no usable IPv6 link-local address on %q", link.Attrs().Name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/rpc"
@@ -31,16 +32,78 @@ import (
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/dns"
+	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/vishvananda/netlink"
 )
 
 const listenFdsStart = 3
 
 var errNoMoreTries = errors.New("no more tries")
 
+// The IP families the daemon leases addresses of, "family" in the IPAM
+// configuration
+const (
+	familyV4   = "v4"
+	familyV6   = "v6"
+	familyBoth = "both"
+)
+
+// IPAMConfig is the IPAM configuration of a network using the daemon
+type IPAMConfig struct {
+	types.IPAM
+	DaemonSocketPath string `json:"daemonSocketPath,omitempty"`
+	// Family selects DHCPv4 ("v4", the default), DHCPv6 ("v6") or both
+	Family string `json:"family,omitempty"`
+	// PrefixDelegation requests a delegated prefix (IA_PD) along with the
+	// DHCPv6 address
+	PrefixDelegation bool `json:"prefixDelegation,omitempty"`
+	// Request lists the DHCPv4 options to ask the server for, in addition
+	// to the router and subnet mask
+	Request []RequestOption `json:"request,omitempty"`
+	// Provide lists the DHCPv4 options to send to the server, like the
+	// host name or the vendor class identifier
+	Provide []ProvideOption `json:"provide,omitempty"`
+	// ApplyMTU sets the MTU of the interface to the one the DHCPv4
+	// server gives
+	ApplyMTU bool `json:"applyMTU,omitempty"`
+}
+
+// IPAMEnvArgs are the CNI_ARGS the values of provided options can use
+type IPAMEnvArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE types.UnmarshallableString `json:"k8sPodNamespace,omitempty"`
+	K8S_POD_NAME      types.UnmarshallableString `json:"k8sPodName,omitempty"`
+}
+
+type NetConf struct {
+	types.NetConf
+	IPAM *IPAMConfig `json:"ipam"`
+}
+
+func loadNetConf(stdinData []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(stdinData, conf); err != nil {
+		return nil, fmt.Errorf("error parsing netconf: %v", err)
+	}
+	if conf.IPAM == nil {
+		conf.IPAM = &IPAMConfig{}
+	}
+	switch conf.IPAM.Family {
+	case "":
+		conf.IPAM.Family = familyV4
+	case familyV4, familyV6, familyBoth:
+	default:
+		return nil, fmt.Errorf("invalid family %q, must be %q, %q or %q", conf.IPAM.Family, familyV4, familyV6, familyBoth)
+	}
+	return conf, nil
+}
+
 type DHCP struct {
 	mux             sync.Mutex
 	leases          map[string]*DHCPLease
+	leases6         map[string]*DHCP6Lease
 	hostNetnsPrefix string
 	clientTimeout   time.Duration
 	clientResendMax time.Duration
@@ -50,6 +113,7 @@ type DHCP struct {
 func newDHCP(clientTimeout, clientResendMax time.Duration) *DHCP {
 	return &DHCP{
 		leases:          make(map[string]*DHCPLease),
+		leases6:         make(map[string]*DHCP6Lease),
 		clientTimeout:   clientTimeout,
 		clientResendMax: clientResendMax,
 	}
@@ -59,40 +123,104 @@ func generateClientID(containerID string, netName string, ifName string) string
 	return containerID + "/" + netName + "/" + ifName
 }
 
-// Allocate acquires an IP from a DHCP server for a specified container.
-// The acquired lease will be maintained until Release() is called.
+// Allocate acquires an IP from a DHCP server for a specified container,
+// and, depending on the configured family, an IPv6 address from a DHCPv6
+// server. The acquired leases will be maintained until Release() is called.
 func (d *DHCP) Allocate(args *skel.CmdArgs, result *current.Result) error {
-	conf := types.NetConf{}
-	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
-		return fmt.Errorf("error parsing netconf: %v", err)
+	conf, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
 	}
 
 	clientID := generateClientID(args.ContainerID, conf.Name, args.IfName)
 	hostNetns := d.hostNetnsPrefix + args.Netns
-	l, err := AcquireLease(clientID, hostNetns, args.IfName, d.clientTimeout, d.clientResendMax, d.broadcast)
-	if err != nil {
-		return err
-	}
 
-	ipn, err := l.IPNet()
-	if err != nil {
-		l.Stop()
-		return err
+	var l *DHCPLease
+	if conf.IPAM.Family != familyV6 {
+		// The daemon didn't use CNI_ARGS before, so unknown ones are
+		// ignored unless they say otherwise
+		e := IPAMEnvArgs{}
+		e.IgnoreUnknown = true
+		if err := types.LoadArgs(args.Args, &e); err != nil {
+			return err
+		}
+		request := conf.IPAM.Request
+		if conf.IPAM.ApplyMTU {
+			request = append(request, RequestOption{Option: "interface-mtu"})
+		}
+		opts, err := prepareOptions(clientID, request, conf.IPAM.Provide, optionValueArgs{
+			ContainerID:  args.ContainerID,
+			IfName:       args.IfName,
+			NetworkName:  conf.Name,
+			PodName:      string(e.K8S_POD_NAME),
+			PodNamespace: string(e.K8S_POD_NAMESPACE),
+		})
+		if err != nil {
+			return err
+		}
+
+		l, err = AcquireLease(clientID, hostNetns, args.IfName, opts, d.clientTimeout, d.clientResendMax, d.broadcast)
+		if err != nil {
+			return err
+		}
+
+		ipn, err := l.IPNet()
+		if err != nil {
+			l.Stop()
+			return err
+		}
+
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Address: *ipn,
+			Gateway: l.Gateway(),
+		})
+		result.Routes = l.Routes()
+
+		result.DNS = l.DNS()
+		if err := dns.Validate(result.DNS); err != nil {
+			log.Printf("%v: ignoring the DNS settings of the lease: %v", clientID, err)
+			result.DNS = types.DNS{}
+		}
+
+		if mtu := l.MTU(); conf.IPAM.ApplyMTU && mtu != 0 {
+			if err := setLinkMTU(hostNetns, args.IfName, mtu); err != nil {
+				l.Stop()
+				return err
+			}
+		}
 	}
 
-	d.setLease(clientID, l)
+	if conf.IPAM.Family != familyV4 {
+		l6, err := AcquireLease6(clientID, hostNetns, args.IfName, d.clientTimeout, d.clientResendMax, conf.IPAM.PrefixDelegation)
+		if err != nil {
+			if l != nil {
+				l.Stop()
+			}
+			return err
+		}
 
-	result.IPs = []*current.IPConfig{{
-		Address: *ipn,
-		Gateway: l.Gateway(),
-	}}
-	result.Routes = l.Routes()
+		// Routes, and so the gateway, come from router advertisements
+		result.IPs = append(result.IPs, &current.IPConfig{
+			Address: *l6.IPNet(),
+		})
+		// The delegated prefixes are routed through the interface, so the
+		// container can hand them out further
+		for _, p := range l6.Prefixes() {
+			result.Routes = append(result.Routes, &types.Route{Dst: p})
+		}
+
+		d.setLease6(clientID, l6)
+	}
+
+	if l != nil {
+		d.setLease(clientID, l)
+	}
 
 	return nil
 }
 
-// Release stops maintenance of the lease acquired in Allocate()
-// and sends a release msg to the DHCP server.
+// Release stops maintenance of the leases acquired in Allocate()
+// and sends a release msg to the DHCP servers.
 func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
 	conf := types.NetConf{}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
@@ -102,12 +230,32 @@ func (d *DHCP) Release(args *skel.CmdArgs, reply *struct{}) error {
 	clientID := generateClientID(args.ContainerID, conf.Name, args.IfName)
 	if l := d.getLease(clientID); l != nil {
 		l.Stop()
-		d.clearLease(clientID)
 	}
+	if l := d.getLease6(clientID); l != nil {
+		l.Stop()
+	}
+	d.clearLease(clientID)
 
 	return nil
 }
 
+// setLinkMTU sets the MTU of the link ifName of netns
+func setLinkMTU(netns string, ifName string, mtu int) error {
+	return ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("error looking up %q: %v", ifName, err)
+		}
+		if link.Attrs().MTU == mtu {
+			return nil
+		}
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("failed to set the MTU of %q to %d: %v", ifName, mtu, err)
+		}
+		return nil
+	})
+}
+
 func (d *DHCP) getLease(clientID string) *DHCPLease {
 	d.mux.Lock()
 	defer d.mux.Unlock()
@@ -128,6 +276,20 @@ func (d *DHCP) setLease(clientID string, l *DHCPLease) {
 	d.leases[clientID] = l
 }
 
+func (d *DHCP) getLease6(clientID string) *DHCP6Lease {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return d.leases6[clientID]
+}
+
+func (d *DHCP) setLease6(clientID string, l *DHCP6Lease) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.leases6[clientID] = l
+}
+
 //func (d *DHCP) clearLease(contID, netName, ifName string) {
 func (d *DHCP) clearLease(clientID string) {
 	d.mux.Lock()
@@ -135,6 +297,7 @@ func (d *DHCP) clearLease(clientID string) {
 
 	// TODO(eyakubovich): hash it to avoid collisions
 	delete(d.leases, clientID)
+	delete(d.leases6, clientID)
 }
 
 func getListener(socketPath string) (net.Listener, error) {
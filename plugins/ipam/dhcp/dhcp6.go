@@ -0,0 +1,357 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The parts of DHCPv6 (RFC 8415) the daemon uses to lease addresses and
+// delegated prefixes
+
+type dhcp6MessageType uint8
+
+const (
+	dhcp6Solicit   dhcp6MessageType = 1
+	dhcp6Advertise dhcp6MessageType = 2
+	dhcp6Request   dhcp6MessageType = 3
+	dhcp6Renew     dhcp6MessageType = 5
+	dhcp6Rebind    dhcp6MessageType = 6
+	dhcp6Reply     dhcp6MessageType = 7
+	dhcp6Release   dhcp6MessageType = 8
+)
+
+func (t dhcp6MessageType) String() string {
+	switch t {
+	case dhcp6Solicit:
+		return "SOLICIT"
+	case dhcp6Advertise:
+		return "ADVERTISE"
+	case dhcp6Request:
+		return "REQUEST"
+	case dhcp6Renew:
+		return "RENEW"
+	case dhcp6Rebind:
+		return "REBIND"
+	case dhcp6Reply:
+		return "REPLY"
+	case dhcp6Release:
+		return "RELEASE"
+	}
+	return fmt.Sprintf("message type %d", uint8(t))
+}
+
+const (
+	dhcp6OptionClientID    uint16 = 1
+	dhcp6OptionServerID    uint16 = 2
+	dhcp6OptionIANA        uint16 = 3
+	dhcp6OptionIAAddr      uint16 = 5
+	dhcp6OptionORO         uint16 = 6
+	dhcp6OptionElapsedTime uint16 = 8
+	dhcp6OptionStatusCode  uint16 = 13
+	dhcp6OptionIAPD        uint16 = 25
+	dhcp6OptionIAPrefix    uint16 = 26
+)
+
+const dhcp6StatusSuccess uint16 = 0
+
+const (
+	dhcp6ClientPort = 546
+	dhcp6ServerPort = 547
+)
+
+// All_DHCP_Relay_Agents_and_Servers
+var dhcp6ServersAddr = net.ParseIP("ff02::1:2")
+
+// infinity is the lifetime 0xffffffff
+const dhcp6Infinity = 0xffffffff
+
+type dhcp6Option struct {
+	code uint16
+	data []byte
+}
+
+type dhcp6Message struct {
+	msgType dhcp6MessageType
+	xid     [3]byte
+	options []dhcp6Option
+}
+
+func newDHCP6Message(msgType dhcp6MessageType) (*dhcp6Message, error) {
+	m := &dhcp6Message{msgType: msgType}
+	if _, err := rand.Read(m.xid[:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *dhcp6Message) addOption(code uint16, data []byte) {
+	m.options = append(m.options, dhcp6Option{code: code, data: data})
+}
+
+// option returns the data of the first option code, or nil
+func (m *dhcp6Message) option(code uint16) []byte {
+	return findDHCP6Option(m.options, code)
+}
+
+func (m *dhcp6Message) marshal() []byte {
+	b := []byte{byte(m.msgType), m.xid[0], m.xid[1], m.xid[2]}
+	return append(b, marshalDHCP6Options(m.options)...)
+}
+
+func parseDHCP6Message(b []byte) (*dhcp6Message, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("DHCPv6 message too short")
+	}
+	m := &dhcp6Message{msgType: dhcp6MessageType(b[0])}
+	copy(m.xid[:], b[1:4])
+	opts, err := parseDHCP6Options(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	m.options = opts
+	return m, nil
+}
+
+func marshalDHCP6Options(opts []dhcp6Option) []byte {
+	var b []byte
+	for _, o := range opts {
+		b = append(b, byte(o.code>>8), byte(o.code), byte(len(o.data)>>8), byte(len(o.data)))
+		b = append(b, o.data...)
+	}
+	return b
+}
+
+func parseDHCP6Options(b []byte) ([]dhcp6Option, error) {
+	var opts []dhcp6Option
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated DHCPv6 option")
+		}
+		code := binary.BigEndian.Uint16(b[0:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+length {
+			return nil, fmt.Errorf("truncated DHCPv6 option %d", code)
+		}
+		opts = append(opts, dhcp6Option{code: code, data: b[4 : 4+length]})
+		b = b[4+length:]
+	}
+	return opts, nil
+}
+
+func findDHCP6Option(opts []dhcp6Option, code uint16) []byte {
+	for _, o := range opts {
+		if o.code == code {
+			return o.data
+		}
+	}
+	return nil
+}
+
+// dhcp6Status is a Status Code option
+type dhcp6Status struct {
+	code    uint16
+	message string
+}
+
+func parseDHCP6Status(opts []dhcp6Option) (*dhcp6Status, error) {
+	data := findDHCP6Option(opts, dhcp6OptionStatusCode)
+	if data == nil {
+		return nil, nil
+	}
+	if len(data) < 2 {
+		return nil, fmt.Errorf("invalid DHCPv6 status code option")
+	}
+	return &dhcp6Status{code: binary.BigEndian.Uint16(data), message: string(data[2:])}, nil
+}
+
+func (s *dhcp6Status) err() error {
+	if s == nil || s.code == dhcp6StatusSuccess {
+		return nil
+	}
+	return fmt.Errorf("DHCPv6 server returned status %d: %s", s.code, s.message)
+}
+
+// dhcp6IAAddr is an address of an IA_NA
+type dhcp6IAAddr struct {
+	ip        net.IP
+	preferred time.Duration
+	valid     time.Duration
+}
+
+// dhcp6IAPrefix is a prefix of an IA_PD
+type dhcp6IAPrefix struct {
+	prefix    net.IPNet
+	preferred time.Duration
+	valid     time.Duration
+}
+
+// dhcp6IA is an IA_NA, holding addresses, or an IA_PD, holding prefixes
+type dhcp6IA struct {
+	code     uint16
+	iaid     uint32
+	t1       time.Duration
+	t2       time.Duration
+	addrs    []dhcp6IAAddr
+	prefixes []dhcp6IAPrefix
+}
+
+func (ia *dhcp6IA) marshal() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:4], ia.iaid)
+	binary.BigEndian.PutUint32(b[4:8], toDHCP6Seconds(ia.t1))
+	binary.BigEndian.PutUint32(b[8:12], toDHCP6Seconds(ia.t2))
+
+	var opts []dhcp6Option
+	for _, a := range ia.addrs {
+		data := make([]byte, 24)
+		copy(data[0:16], a.ip.To16())
+		binary.BigEndian.PutUint32(data[16:20], toDHCP6Seconds(a.preferred))
+		binary.BigEndian.PutUint32(data[20:24], toDHCP6Seconds(a.valid))
+		opts = append(opts, dhcp6Option{code: dhcp6OptionIAAddr, data: data})
+	}
+	for _, p := range ia.prefixes {
+		data := make([]byte, 25)
+		binary.BigEndian.PutUint32(data[0:4], toDHCP6Seconds(p.preferred))
+		binary.BigEndian.PutUint32(data[4:8], toDHCP6Seconds(p.valid))
+		ones, _ := p.prefix.Mask.Size()
+		data[8] = byte(ones)
+		copy(data[9:25], p.prefix.IP.To16())
+		opts = append(opts, dhcp6Option{code: dhcp6OptionIAPrefix, data: data})
+	}
+	return append(b, marshalDHCP6Options(opts)...)
+}
+
+// parseDHCP6IA parses the IA_NA or IA_PD iaid of opts. It returns nil if
+// there is none, and an error if the server gave a status other than
+// success for it.
+func parseDHCP6IA(opts []dhcp6Option, code uint16, iaid uint32) (*dhcp6IA, error) {
+	for _, o := range opts {
+		if o.code != code || len(o.data) < 12 || binary.BigEndian.Uint32(o.data[0:4]) != iaid {
+			continue
+		}
+
+		ia := &dhcp6IA{
+			code: code,
+			iaid: iaid,
+			t1:   fromDHCP6Seconds(binary.BigEndian.Uint32(o.data[4:8])),
+			t2:   fromDHCP6Seconds(binary.BigEndian.Uint32(o.data[8:12])),
+		}
+		iaOpts, err := parseDHCP6Options(o.data[12:])
+		if err != nil {
+			return nil, err
+		}
+		status, err := parseDHCP6Status(iaOpts)
+		if err != nil {
+			return nil, err
+		}
+		if err := status.err(); err != nil {
+			return nil, err
+		}
+
+		for _, io := range iaOpts {
+			switch {
+			case io.code == dhcp6OptionIAAddr && code == dhcp6OptionIANA && len(io.data) >= 24:
+				a := dhcp6IAAddr{
+					ip:        net.IP(append([]byte(nil), io.data[0:16]...)),
+					preferred: fromDHCP6Seconds(binary.BigEndian.Uint32(io.data[16:20])),
+					valid:     fromDHCP6Seconds(binary.BigEndian.Uint32(io.data[20:24])),
+				}
+				if a.valid > 0 {
+					ia.addrs = append(ia.addrs, a)
+				}
+			case io.code == dhcp6OptionIAPrefix && code == dhcp6OptionIAPD && len(io.data) >= 25:
+				if io.data[8] > 128 {
+					continue
+				}
+				mask := net.CIDRMask(int(io.data[8]), 128)
+				p := dhcp6IAPrefix{
+					prefix: net.IPNet{
+						IP:   net.IP(append([]byte(nil), io.data[9:25]...)).Mask(mask),
+						Mask: mask,
+					},
+					preferred: fromDHCP6Seconds(binary.BigEndian.Uint32(io.data[0:4])),
+					valid:     fromDHCP6Seconds(binary.BigEndian.Uint32(io.data[4:8])),
+				}
+				if p.valid > 0 {
+					ia.prefixes = append(ia.prefixes, p)
+				}
+			}
+		}
+		return ia, nil
+	}
+	return nil, nil
+}
+
+// minLifetimes returns the shortest preferred and valid lifetimes of the
+// addresses and prefixes of ia
+func (ia *dhcp6IA) minLifetimes() (preferred time.Duration, valid time.Duration) {
+	preferred, valid = -1, -1
+	update := func(p, v time.Duration) {
+		if preferred < 0 || p < preferred {
+			preferred = p
+		}
+		if valid < 0 || v < valid {
+			valid = v
+		}
+	}
+	for _, a := range ia.addrs {
+		update(a.preferred, a.valid)
+	}
+	for _, p := range ia.prefixes {
+		update(p.preferred, p.valid)
+	}
+	return preferred, valid
+}
+
+// The lifetimes of the protocol are seconds, 0xffffffff being infinite
+func fromDHCP6Seconds(secs uint32) time.Duration {
+	if secs == dhcp6Infinity {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func toDHCP6Seconds(d time.Duration) uint32 {
+	if d >= time.Duration(dhcp6Infinity)*time.Second {
+		return dhcp6Infinity
+	}
+	return uint32(d / time.Second)
+}
+
+// elapsedTime is the Elapsed Time option, in hundredths of a second since
+// start
+func elapsedTime(start time.Time) []byte {
+	elapsed := time.Since(start) / (10 * time.Millisecond)
+	if elapsed > 0xffff {
+		elapsed = 0xffff
+	}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(elapsed))
+	return b
+}
+
+// generateDUID returns a DUID-UUID (RFC 6355) derived from clientID, so the
+// container keeps its identity, and leases, across restarts of the daemon
+func generateDUID(clientID string) []byte {
+	sum := sha256.Sum256([]byte(clientID))
+	duid := []byte{0x00, 0x04}
+	return append(duid, sum[:16]...)
+}
@@ -0,0 +1,447 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// dhcp6Server is a stub DHCPv6 server leasing the same address and prefix
+// to every client
+type dhcp6Server struct {
+	conn   *net.UDPConn
+	duid   []byte
+	addr   net.IP
+	prefix net.IPNet
+	t1     time.Duration
+	t2     time.Duration
+	valid  time.Duration
+
+	mux      sync.Mutex
+	received []dhcp6MessageType
+	pd       bool
+}
+
+// dhcp6ServerStart serves DHCPv6 on the link ifName of netns until the
+// returned server is closed
+func dhcp6ServerStart(netns ns.NetNS, ifName string, t1, t2, valid time.Duration) (*dhcp6Server, error) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/56")
+	s := &dhcp6Server{
+		duid:   []byte{0x00, 0x04, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		addr:   net.ParseIP("2001:db8::5"),
+		prefix: *prefix,
+		t1:     t1,
+		t2:     t2,
+		valid:  valid,
+	}
+
+	err := netns.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		// Wait for the link-local address replies are sent from
+		if _, err := waitLinkLocal(link, 10*time.Second); err != nil {
+			return err
+		}
+		iface, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+		s.conn, err = net.ListenMulticastUDP("udp6", iface, &net.UDPAddr{IP: dhcp6ServersAddr, Port: dhcp6ServerPort})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go s.serve()
+	return s, nil
+}
+
+func (s *dhcp6Server) Close() {
+	s.conn.Close()
+}
+
+func (s *dhcp6Server) Received() []dhcp6MessageType {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]dhcp6MessageType(nil), s.received...)
+}
+
+func (s *dhcp6Server) DelegatedPrefix() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.pd
+}
+
+func (s *dhcp6Server) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m, err := parseDHCP6Message(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		s.mux.Lock()
+		s.received = append(s.received, m.msgType)
+		s.mux.Unlock()
+
+		reply := &dhcp6Message{msgType: dhcp6Reply, xid: m.xid}
+		switch m.msgType {
+		case dhcp6Solicit:
+			reply.msgType = dhcp6Advertise
+		case dhcp6Request, dhcp6Renew, dhcp6Rebind, dhcp6Release:
+		default:
+			continue
+		}
+		reply.addOption(dhcp6OptionServerID, s.duid)
+		reply.addOption(dhcp6OptionClientID, m.option(dhcp6OptionClientID))
+
+		if m.msgType != dhcp6Release {
+			ia := &dhcp6IA{code: dhcp6OptionIANA, iaid: dhcp6IAID, t1: s.t1, t2: s.t2}
+			ia.addrs = []dhcp6IAAddr{{ip: s.addr, preferred: s.valid, valid: s.valid}}
+			reply.addOption(dhcp6OptionIANA, ia.marshal())
+
+			if m.option(dhcp6OptionIAPD) != nil {
+				s.mux.Lock()
+				s.pd = true
+				s.mux.Unlock()
+
+				pd := &dhcp6IA{code: dhcp6OptionIAPD, iaid: dhcp6IAID, t1: s.t1, t2: s.t2}
+				pd.prefixes = []dhcp6IAPrefix{{prefix: s.prefix, preferred: s.valid, valid: s.valid}}
+				reply.addOption(dhcp6OptionIAPD, pd.marshal())
+			}
+		}
+
+		s.conn.WriteToUDP(reply.marshal(), src)
+	}
+}
+
+var _ = Describe("DHCPv6 messages", func() {
+	It("marshals and parses messages", func() {
+		m, err := newDHCP6Message(dhcp6Request)
+		Expect(err).NotTo(HaveOccurred())
+		m.addOption(dhcp6OptionClientID, generateDUID("dummy/mynet/eth0"))
+
+		_, prefix, _ := net.ParseCIDR("2001:db8:1::/56")
+		ia := &dhcp6IA{code: dhcp6OptionIANA, iaid: dhcp6IAID, t1: time.Minute, t2: 2 * time.Minute}
+		ia.addrs = []dhcp6IAAddr{{ip: net.ParseIP("2001:db8::5"), preferred: 3 * time.Minute, valid: 4 * time.Minute}}
+		pd := &dhcp6IA{code: dhcp6OptionIAPD, iaid: dhcp6IAID}
+		pd.prefixes = []dhcp6IAPrefix{{prefix: *prefix, preferred: fromDHCP6Seconds(dhcp6Infinity), valid: fromDHCP6Seconds(dhcp6Infinity)}}
+		m.addOption(dhcp6OptionIANA, ia.marshal())
+		m.addOption(dhcp6OptionIAPD, pd.marshal())
+
+		parsed, err := parseDHCP6Message(m.marshal())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.msgType).To(Equal(dhcp6Request))
+		Expect(parsed.xid).To(Equal(m.xid))
+		Expect(parsed.option(dhcp6OptionClientID)).To(Equal(generateDUID("dummy/mynet/eth0")))
+
+		parsedIA, err := parseDHCP6IA(parsed.options, dhcp6OptionIANA, dhcp6IAID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsedIA).To(Equal(ia))
+
+		parsedPD, err := parseDHCP6IA(parsed.options, dhcp6OptionIAPD, dhcp6IAID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsedPD.prefixes).To(HaveLen(1))
+		Expect(parsedPD.prefixes[0].prefix.String()).To(Equal("2001:db8:1::/56"))
+		Expect(toDHCP6Seconds(parsedPD.prefixes[0].valid)).To(Equal(uint32(dhcp6Infinity)))
+	})
+
+	It("returns the status of an IA", func() {
+		status := []byte{0, 2}
+		status = append(status, "no addresses"...)
+		ia := []byte{0, 0, 0, dhcp6IAID, 0, 0, 0, 0, 0, 0, 0, 0}
+		ia = append(ia, marshalDHCP6Options([]dhcp6Option{{code: dhcp6OptionStatusCode, data: status}})...)
+
+		_, err := parseDHCP6IA([]dhcp6Option{{code: dhcp6OptionIANA, data: ia}}, dhcp6OptionIANA, dhcp6IAID)
+		Expect(err).To(MatchError("DHCPv6 server returned status 2: no addresses"))
+	})
+
+	It("rejects truncated options", func() {
+		_, err := parseDHCP6Message([]byte{byte(dhcp6Reply), 1, 2, 3, 0, 1, 0, 4, 1})
+		Expect(err).To(MatchError("truncated DHCPv6 option 1"))
+	})
+
+	It("derives a stable DUID from the client ID", func() {
+		Expect(generateDUID("a/b/c")).To(Equal(generateDUID("a/b/c")))
+		Expect(generateDUID("a/b/c")).NotTo(Equal(generateDUID("a/b/d")))
+		Expect(generateDUID("a/b/c")).To(HaveLen(18))
+	})
+})
+
+var _ = Describe("DHCPv6 Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var dhcpServerStopCh chan bool
+	var dhcpServerDone *sync.WaitGroup
+	var dhcp6Srv *dhcp6Server
+	var clientCmd *exec.Cmd
+	var socketPath string
+	var tmpDir string
+	var err error
+
+	startDHCP6Server := func(t1, t2, valid time.Duration) {
+		dhcp6Srv, err = dhcp6ServerStart(originalNS, hostVethName, t1, t2, valid)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		dhcpServerStopCh = make(chan bool)
+
+		tmpDir, err = getTmpDir()
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(tmpDir, "dhcp.sock")
+
+		// Create a new NetNS so we don't modify the host
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		serverIP := net.IPNet{
+			IP:   net.IPv4(192, 168, 1, 1),
+			Mask: net.IPv4Mask(255, 255, 255, 0),
+		}
+
+		// Create a veth pair in the "host" (original) NS
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err = netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: hostVethName,
+				},
+				PeerName: contVethName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			host, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.LinkSetUp(host)
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.AddrAdd(host, &netlink.Addr{IPNet: &serverIP})
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: host.Attrs().Index,
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Dst: &net.IPNet{
+					IP:   net.IPv4(0, 0, 0, 0),
+					Mask: net.IPv4Mask(0, 0, 0, 0),
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			cont, err := netlink.LinkByName(contVethName)
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.LinkSetNsFd(cont, int(targetNS.Fd()))
+			Expect(err).NotTo(HaveOccurred())
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Bring the container side up, so the host side gets a link-local
+		// address
+		err = targetNS.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(contVethName)
+			if err != nil {
+				return err
+			}
+			return netlink.LinkSetUp(link)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Start the DHCP server
+		dhcpServerDone, err = dhcpServerStart(originalNS, net.IPv4(192, 168, 1, 5), serverIP.IP, 1, dhcpServerStopCh)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Start the DHCP client daemon
+		dhcpPluginPath, err := exec.LookPath("dhcp")
+		Expect(err).NotTo(HaveOccurred())
+		clientCmd = exec.Command(dhcpPluginPath, "daemon", "-socketpath", socketPath)
+
+		// copy dhcp client's stdout/stderr to test stdout
+		clientCmd.Stdout = os.Stdout
+		clientCmd.Stderr = os.Stderr
+
+		err = clientCmd.Start()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clientCmd.Process).NotTo(BeNil())
+
+		// Wait up to 15 seconds for the client socket
+		Eventually(func() bool {
+			_, err := os.Stat(socketPath)
+			return err == nil
+		}, time.Second*15, time.Second/4).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		if dhcp6Srv != nil {
+			dhcp6Srv.Close()
+			dhcp6Srv = nil
+		}
+		dhcpServerStopCh <- true
+		dhcpServerDone.Wait()
+		clientCmd.Process.Kill()
+		clientCmd.Wait()
+
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	netConf := func(ver string, ipam string) []byte {
+		return []byte(fmt.Sprintf(`{
+		    "cniVersion": "%s",
+		    "name": "mynet",
+		    "type": "ipvlan",
+		    "ipam": {
+			"type": "dhcp",
+			"daemonSocketPath": "%s",
+			%s
+		    }
+		}`, ver, socketPath, ipam))
+	}
+
+	add := func(args *skel.CmdArgs) (*types100.Result, error) {
+		var result *types100.Result
+		err := originalNS.Do(func(ns.NetNS) error {
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			if err != nil {
+				return err
+			}
+			result, err = types100.GetResult(r)
+			return err
+		})
+		return result, err
+	}
+
+	del := func(args *skel.CmdArgs) error {
+		return originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+	}
+
+	for _, ver := range []string{"0.3.1", "1.0.0"} {
+		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+		ver := ver
+
+		It(fmt.Sprintf("[%s] leases and releases an IPv6 address with ADD/DEL", ver), func() {
+			startDHCP6Server(time.Minute, 2*time.Minute, 5*time.Minute)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      contVethName,
+				StdinData:   netConf(ver, `"family": "v6"`),
+			}
+
+			result, err := add(args)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("2001:db8::5/128"))
+			Expect(result.IPs[0].Gateway).To(BeNil())
+			Expect(dhcp6Srv.Received()).To(Equal([]dhcp6MessageType{dhcp6Solicit, dhcp6Request}))
+
+			Expect(del(args)).To(Succeed())
+			Expect(dhcp6Srv.Received()).To(Equal([]dhcp6MessageType{dhcp6Solicit, dhcp6Request, dhcp6Release}))
+		})
+	}
+
+	It("leases IPv4 and IPv6 addresses and a delegated prefix", func() {
+		startDHCP6Server(time.Minute, 2*time.Minute, 5*time.Minute)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      contVethName,
+			StdinData:   netConf("1.0.0", `"family": "both", "prefixDelegation": true`),
+		}
+
+		result, err := add(args)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(2))
+		Expect(result.IPs[0].Address.String()).To(Equal("192.168.1.5/24"))
+		Expect(result.IPs[1].Address.String()).To(Equal("2001:db8::5/128"))
+		Expect(dhcp6Srv.DelegatedPrefix()).To(BeTrue())
+		Expect(result.Routes).To(ContainElement(&types.Route{Dst: net.IPNet{
+			IP:   net.ParseIP("2001:db8:1::"),
+			Mask: net.CIDRMask(56, 128),
+		}}))
+
+		Expect(del(args)).To(Succeed())
+		Expect(dhcp6Srv.Received()).To(ContainElement(dhcp6Release))
+	})
+
+	It("renews the IPv6 lease at T1", func() {
+		startDHCP6Server(time.Second, 2*time.Second, time.Minute)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      contVethName,
+			StdinData:   netConf("1.0.0", `"family": "v6"`),
+		}
+
+		_, err := add(args)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(dhcp6Srv.Received, 5*time.Second, 100*time.Millisecond).Should(ContainElement(dhcp6Renew))
+
+		Expect(del(args)).To(Succeed())
+	})
+
+	It("rejects an unknown family", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      contVethName,
+			StdinData:   netConf("1.0.0", `"family": "v5"`),
+		}
+
+		_, err := add(args)
+		Expect(err).To(MatchError(`error calling DHCP.Allocate: invalid family "v5", must be "v4", "v6" or "both"`))
+	})
+})
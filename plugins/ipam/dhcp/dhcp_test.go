@@ -276,6 +276,8 @@ var _ = Describe("DHCP Operations", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(len(addResult.IPs)).To(Equal(1))
 				Expect(addResult.IPs[0].Address.String()).To(Equal("192.168.1.5/24"))
+				// the default name servers of the test server
+				Expect(addResult.DNS.Nameservers).To(Equal([]string{"208.67.222.222", "208.67.220.220"}))
 				return nil
 			})
 			Expect(err).NotTo(HaveOccurred())
@@ -354,6 +356,49 @@ var _ = Describe("DHCP Operations", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 	}
+
+	It("sends the configured options templated from CNI_ARGS", func() {
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "mynet",
+		    "type": "ipvlan",
+		    "ipam": {
+			"type": "dhcp",
+			"daemonSocketPath": "%s",
+			"request": [{"option": "dns-servers"}, {"option": "121"}],
+			"provide": [
+			    {"option": "host-name", "value": "{{.PodName}}"},
+			    {"option": "vendor-class-identifier", "value": "{{.PodNamespace}}"}
+			]
+		    }
+		}`, socketPath)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      contVethName,
+			Args:        "K8S_POD_NAMESPACE=shop;K8S_POD_NAME=web-0;K8S_POD_INFRA_CONTAINER_ID=dummy",
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			addResult, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addResult.IPs[0].Address.String()).To(Equal("192.168.1.5/24"))
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
 })
 
 const (
@@ -52,6 +52,7 @@ type DHCPLease struct {
 	clientID      string
 	ack           *dhcp4.Packet
 	opts          dhcp4.Options
+	requestOpts   dhcp4.Options
 	link          netlink.Link
 	renewalTime   time.Time
 	rebindingTime time.Time
@@ -68,50 +69,64 @@ type DHCPLease struct {
 // by periodically renewing it. The acquired lease can be released by
 // calling DHCPLease.Stop()
 func AcquireLease(
-	clientID, netns, ifName string,
+	clientID, netns, ifName string, requestOpts dhcp4.Options,
 	timeout, resendMax time.Duration, broadcast bool,
 ) (*DHCPLease, error) {
-	errCh := make(chan error, 1)
 	l := &DHCPLease{
-		clientID:  clientID,
-		stop:      make(chan struct{}),
-		timeout:   timeout,
-		resendMax: resendMax,
-		broadcast: broadcast,
+		clientID:    clientID,
+		requestOpts: requestOpts,
+		stop:        make(chan struct{}),
+		timeout:     timeout,
+		resendMax:   resendMax,
+		broadcast:   broadcast,
 	}
 
 	log.Printf("%v: acquiring lease", clientID)
 
-	l.wg.Add(1)
+	err := startLease(netns, ifName, &l.wg, func(link netlink.Link) error {
+		l.link = link
+		if err := l.acquire(); err != nil {
+			return err
+		}
+
+		log.Printf("%v: lease acquired, expiration is %v", l.clientID, l.expireTime)
+		return nil
+	}, l.maintain)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// startLease looks up the link ifName in netns and calls acquire with it.
+// Once acquire succeeds, it returns and maintain runs in the background, on
+// the same OS thread, until the lease is stopped.
+func startLease(netns, ifName string, wg *sync.WaitGroup, acquire func(netlink.Link) error, maintain func()) error {
+	errCh := make(chan error, 1)
+
+	wg.Add(1)
 	go func() {
 		errCh <- ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
-			defer l.wg.Done()
+			defer wg.Done()
 
 			link, err := netlink.LinkByName(ifName)
 			if err != nil {
 				return fmt.Errorf("error looking up %q: %v", ifName, err)
 			}
 
-			l.link = link
-
-			if err = l.acquire(); err != nil {
+			if err = acquire(link); err != nil {
 				return err
 			}
 
-			log.Printf("%v: lease acquired, expiration is %v", l.clientID, l.expireTime)
-
 			errCh <- nil
 
-			l.maintain()
+			maintain()
 			return nil
 		})
 	}()
 
-	if err := <-errCh; err != nil {
-		return nil, err
-	}
-
-	return l, nil
+	return <-errCh
 }
 
 // Stop terminates the background task that maintains the lease
@@ -137,12 +152,8 @@ func (l *DHCPLease) acquire() error {
 		}
 	}
 
-	opts := make(dhcp4.Options)
-	opts[dhcp4.OptionClientIdentifier] = []byte(l.clientID)
-	opts[dhcp4.OptionParameterRequestList] = []byte{byte(dhcp4.OptionRouter), byte(dhcp4.OptionSubnetMask)}
-
 	pkt, err := backoffRetry(l.resendMax, func() (*dhcp4.Packet, error) {
-		ok, ack, err := DhcpRequest(c, opts)
+		ok, ack, err := DhcpRequest(c, l.requestOpts)
 		switch {
 		case err != nil:
 			return nil, err
@@ -190,44 +201,77 @@ func (l *DHCPLease) commit(ack *dhcp4.Packet) error {
 }
 
 func (l *DHCPLease) maintain() {
+	maintainLease(l.clientID, l, l.stop)
+}
+
+func (l *DHCPLease) times() (renewal, rebinding, expire time.Time) {
+	return l.renewalTime, l.rebindingTime, l.expireTime
+}
+
+// rebind gets a lease from any server, the one that granted the lease
+// having failed to renew it
+func (l *DHCPLease) rebind() error {
+	return l.acquire()
+}
+
+// leaseMaintainer is a DHCPv4 or DHCPv6 lease, which maintainLease keeps up
+// to date
+type leaseMaintainer interface {
+	// renew extends the lease with the server that granted it
+	renew() error
+	// rebind extends the lease with any server
+	rebind() error
+	release() error
+	// expire gives up the lease, which could not be extended in time
+	expire()
+	// times returns when the lease must be renewed, rebound and when it
+	// expires
+	times() (renewal, rebinding, expire time.Time)
+}
+
+// maintainLease renews, or else rebinds, l until stop is closed, and then
+// releases it. If l expires, its interface is brought down.
+func maintainLease(clientID string, l leaseMaintainer, stop <-chan struct{}) {
 	state := leaseStateBound
 
 	for {
 		var sleepDur time.Duration
+		renewalTime, rebindingTime, expireTime := l.times()
 
 		switch state {
 		case leaseStateBound:
-			sleepDur = l.renewalTime.Sub(time.Now())
+			sleepDur = renewalTime.Sub(time.Now())
 			if sleepDur <= 0 {
-				log.Printf("%v: renewing lease", l.clientID)
+				log.Printf("%v: renewing lease", clientID)
 				state = leaseStateRenewing
 				continue
 			}
 
 		case leaseStateRenewing:
 			if err := l.renew(); err != nil {
-				log.Printf("%v: %v", l.clientID, err)
+				log.Printf("%v: %v", clientID, err)
 
-				if time.Now().After(l.rebindingTime) {
-					log.Printf("%v: renawal time expired, rebinding", l.clientID)
+				if time.Now().After(rebindingTime) {
+					log.Printf("%v: renawal time expired, rebinding", clientID)
 					state = leaseStateRebinding
 				}
 			} else {
-				log.Printf("%v: lease renewed, expiration is %v", l.clientID, l.expireTime)
+				_, _, expireTime = l.times()
+				log.Printf("%v: lease renewed, expiration is %v", clientID, expireTime)
 				state = leaseStateBound
 			}
 
 		case leaseStateRebinding:
-			if err := l.acquire(); err != nil {
-				log.Printf("%v: %v", l.clientID, err)
+			if err := l.rebind(); err != nil {
+				log.Printf("%v: %v", clientID, err)
 
-				if time.Now().After(l.expireTime) {
-					log.Printf("%v: lease expired, bringing interface DOWN", l.clientID)
-					l.downIface()
+				if time.Now().After(expireTime) {
+					l.expire()
 					return
 				}
 			} else {
-				log.Printf("%v: lease rebound, expiration is %v", l.clientID, l.expireTime)
+				_, _, expireTime = l.times()
+				log.Printf("%v: lease rebound, expiration is %v", clientID, expireTime)
 				state = leaseStateBound
 			}
 		}
@@ -235,15 +279,20 @@ func (l *DHCPLease) maintain() {
 		select {
 		case <-time.After(sleepDur):
 
-		case <-l.stop:
+		case <-stop:
 			if err := l.release(); err != nil {
-				log.Printf("%v: failed to release DHCP lease: %v", l.clientID, err)
+				log.Printf("%v: failed to release DHCP lease: %v", clientID, err)
 			}
 			return
 		}
 	}
 }
 
+func (l *DHCPLease) expire() {
+	log.Printf("%v: lease expired, bringing interface DOWN", l.clientID)
+	l.downIface()
+}
+
 func (l *DHCPLease) downIface() {
 	if err := netlink.LinkSetDown(l.link); err != nil {
 		log.Printf("%v: failed to bring %v interface DOWN: %v", l.clientID, l.link.Attrs().Name, err)
@@ -257,11 +306,8 @@ func (l *DHCPLease) renew() error {
 	}
 	defer c.Close()
 
-	opts := make(dhcp4.Options)
-	opts[dhcp4.OptionClientIdentifier] = []byte(l.clientID)
-
 	pkt, err := backoffRetry(l.resendMax, func() (*dhcp4.Packet, error) {
-		ok, ack, err := DhcpRenew(c, *l.ack, opts)
+		ok, ack, err := DhcpRenew(c, *l.ack, l.requestOpts)
 		switch {
 		case err != nil:
 			return nil, err
@@ -337,19 +383,41 @@ func (l *DHCPLease) Routes() []*types.Route {
 	return routes
 }
 
+// DNS returns the name servers, domain name and search list of the lease
+func (l *DHCPLease) DNS() types.DNS {
+	return parseDNS(l.opts)
+}
+
+// MTU returns the interface MTU of the lease, or 0 if the server gave none
+func (l *DHCPLease) MTU() int {
+	return parseMTU(l.opts)
+}
+
 // jitter returns a random value within [-span, span) range
 func jitter(span time.Duration) time.Duration {
 	return time.Duration(float64(span) * (2.0*rand.Float64() - 1.0))
 }
 
 func backoffRetry(resendMax time.Duration, f func() (*dhcp4.Packet, error)) (*dhcp4.Packet, error) {
+	var pkt *dhcp4.Packet
+	err := backoff(resendMax, func() error {
+		var err error
+		pkt, err = f()
+		return err
+	})
+	return pkt, err
+}
+
+// backoff calls f until it succeeds, with an exponential backoff up to
+// resendMax between the calls
+func backoff(resendMax time.Duration, f func() error) error {
 	var baseDelay time.Duration = resendDelay0
 	var sleepTime time.Duration
 
 	for {
-		pkt, err := f()
+		err := f()
 		if err == nil {
-			return pkt, nil
+			return nil
 		}
 
 		log.Print(err)
@@ -367,7 +435,7 @@ func backoffRetry(resendMax time.Duration, f func() (*dhcp4.Packet, error)) (*dh
 		}
 	}
 
-	return nil, errNoMoreTries
+	return errNoMoreTries
 }
 
 func newDHCPClient(
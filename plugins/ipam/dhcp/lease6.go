@@ -0,0 +1,338 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The IAID of the IA_NA and IA_PD of a lease. The DUID identifies the
+// interface already, so it has a single IA of each type.
+const dhcp6IAID = 1
+
+// DHCP6Lease is a DHCPv6 lease of an address (IA_NA) and, optionally, of
+// delegated prefixes (IA_PD). Like DHCPLease, it uses 1 OS thread per lease.
+type DHCP6Lease struct {
+	clientID         string
+	duid             []byte
+	serverID         []byte
+	prefixDelegation bool
+	ia               *dhcp6IA
+	pd               *dhcp6IA
+	link             netlink.Link
+	renewalTime      time.Time
+	rebindingTime    time.Time
+	expireTime       time.Time
+	timeout          time.Duration
+	resendMax        time.Duration
+	stopping         uint32
+	stop             chan struct{}
+	wg               sync.WaitGroup
+}
+
+// AcquireLease6 gets a DHCPv6 lease and then maintains it in the background
+// by periodically renewing it. The acquired lease can be released by
+// calling DHCP6Lease.Stop()
+func AcquireLease6(
+	clientID, netns, ifName string,
+	timeout, resendMax time.Duration, prefixDelegation bool,
+) (*DHCP6Lease, error) {
+	l := &DHCP6Lease{
+		clientID:         clientID,
+		duid:             generateDUID(clientID),
+		prefixDelegation: prefixDelegation,
+		stop:             make(chan struct{}),
+		timeout:          timeout,
+		resendMax:        resendMax,
+	}
+
+	log.Printf("%v: acquiring DHCPv6 lease", clientID)
+
+	err := startLease(netns, ifName, &l.wg, func(link netlink.Link) error {
+		l.link = link
+		if err := l.acquire(); err != nil {
+			return err
+		}
+
+		log.Printf("%v: DHCPv6 lease acquired, expiration is %v", l.clientID, l.expireTime)
+		return nil
+	}, l.maintain)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Stop terminates the background task that maintains the lease
+// and issues a DHCPv6 Release
+func (l *DHCP6Lease) Stop() {
+	if atomic.CompareAndSwapUint32(&l.stopping, 0, 1) {
+		close(l.stop)
+	}
+	l.wg.Wait()
+}
+
+// acquire solicits the servers and requests the first address advertised
+func (l *DHCP6Lease) acquire() error {
+	if (l.link.Attrs().Flags & net.FlagUp) != net.FlagUp {
+		log.Printf("Link %q down. Attempting to set up", l.link.Attrs().Name)
+		if err := netlink.LinkSetUp(l.link); err != nil {
+			return err
+		}
+	}
+
+	c, err := newDHCP6Client(l.link, l.timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	start := time.Now()
+	var reply *dhcp6Message
+	err = backoff(l.resendMax, func() error {
+		solicit, err := l.newMessage(dhcp6Solicit, start, nil, l.emptyIAs())
+		if err != nil {
+			return err
+		}
+		advertise, err := c.exchange(solicit, dhcp6Advertise)
+		if err != nil {
+			return err
+		}
+		ia, pd, err := l.parseIAs(advertise)
+		if err != nil {
+			return err
+		}
+
+		request, err := l.newMessage(dhcp6Request, start, advertise.option(dhcp6OptionServerID), []*dhcp6IA{ia, pd})
+		if err != nil {
+			return err
+		}
+		reply, err = c.exchange(request, dhcp6Reply)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return l.commit(reply)
+}
+
+func (l *DHCP6Lease) maintain() {
+	maintainLease(l.clientID, l, l.stop)
+}
+
+func (l *DHCP6Lease) times() (renewal, rebinding, expire time.Time) {
+	return l.renewalTime, l.rebindingTime, l.expireTime
+}
+
+// renew extends the lease with the server that granted it
+func (l *DHCP6Lease) renew() error {
+	return l.extend(dhcp6Renew, l.serverID)
+}
+
+// rebind extends the lease with any server
+func (l *DHCP6Lease) rebind() error {
+	return l.extend(dhcp6Rebind, nil)
+}
+
+func (l *DHCP6Lease) extend(msgType dhcp6MessageType, serverID []byte) error {
+	c, err := newDHCP6Client(l.link, l.timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	start := time.Now()
+	var reply *dhcp6Message
+	err = backoff(l.resendMax, func() error {
+		m, err := l.newMessage(msgType, start, serverID, []*dhcp6IA{l.ia, l.pd})
+		if err != nil {
+			return err
+		}
+		reply, err = c.exchange(m, dhcp6Reply)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return l.commit(reply)
+}
+
+func (l *DHCP6Lease) release() error {
+	log.Printf("%v: releasing DHCPv6 lease", l.clientID)
+
+	c, err := newDHCP6Client(l.link, l.timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	m, err := l.newMessage(dhcp6Release, time.Now(), l.serverID, []*dhcp6IA{l.ia, l.pd})
+	if err != nil {
+		return err
+	}
+	// The lease is given up whether the server replies or not
+	if _, err := c.exchange(m, dhcp6Reply); err != nil {
+		return fmt.Errorf("failed to release DHCPv6 lease: %v", err)
+	}
+	return nil
+}
+
+// expire removes the leased address from the interface. Unlike DHCPLease,
+// it leaves the link up, which may still hold a DHCPv4 lease.
+func (l *DHCP6Lease) expire() {
+	log.Printf("%v: DHCPv6 lease expired, removing its address", l.clientID)
+	err := netlink.AddrDel(l.link, &netlink.Addr{IPNet: l.IPNet()})
+	if err != nil && err != syscall.EADDRNOTAVAIL {
+		log.Printf("%v: failed to remove %v from %v: %v", l.clientID, l.IPNet(), l.link.Attrs().Name, err)
+	}
+}
+
+// commit takes the IAs and times of reply
+func (l *DHCP6Lease) commit(reply *dhcp6Message) error {
+	ia, pd, err := l.parseIAs(reply)
+	if err != nil {
+		return err
+	}
+
+	// Per RFC 8415 section 14.2, T1 and T2 default to 0.5 and 0.8 times
+	// the shortest preferred lifetime, and the shortest T1 and T2 apply
+	var t1, t2, preferred, valid time.Duration = -1, -1, -1, -1
+	for _, i := range []*dhcp6IA{ia, pd} {
+		if i == nil {
+			continue
+		}
+		p, v := i.minLifetimes()
+		if preferred < 0 || p < preferred {
+			preferred = p
+		}
+		if valid < 0 || v < valid {
+			valid = v
+		}
+		if i.t1 > 0 && (t1 < 0 || i.t1 < t1) {
+			t1 = i.t1
+		}
+		if i.t2 > 0 && (t2 < 0 || i.t2 < t2) {
+			t2 = i.t2
+		}
+	}
+	if t2 < 0 || t2 > valid {
+		t2 = preferred * 8 / 10
+	}
+	if t1 < 0 || t1 > t2 {
+		t1 = preferred / 2
+	}
+
+	now := time.Now()
+	l.expireTime = now.Add(valid)
+	l.renewalTime = now.Add(t1)
+	l.rebindingTime = now.Add(t2)
+	l.serverID = reply.option(dhcp6OptionServerID)
+	l.ia = ia
+	l.pd = pd
+
+	return nil
+}
+
+// parseIAs returns the IA_NA and, if requested, the IA_PD of m, which must
+// hold an address and a prefix
+func (l *DHCP6Lease) parseIAs(m *dhcp6Message) (*dhcp6IA, *dhcp6IA, error) {
+	status, err := parseDHCP6Status(m.options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := status.err(); err != nil {
+		return nil, nil, err
+	}
+
+	ia, err := parseDHCP6IA(m.options, dhcp6OptionIANA, dhcp6IAID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ia == nil || len(ia.addrs) == 0 {
+		return nil, nil, fmt.Errorf("DHCPv6 %s holds no address", m.msgType)
+	}
+
+	var pd *dhcp6IA
+	if l.prefixDelegation {
+		pd, err = parseDHCP6IA(m.options, dhcp6OptionIAPD, dhcp6IAID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pd == nil || len(pd.prefixes) == 0 {
+			return nil, nil, fmt.Errorf("DHCPv6 %s holds no delegated prefix", m.msgType)
+		}
+	}
+
+	return ia, pd, nil
+}
+
+// emptyIAs are the IAs the client solicits
+func (l *DHCP6Lease) emptyIAs() []*dhcp6IA {
+	ias := []*dhcp6IA{{code: dhcp6OptionIANA, iaid: dhcp6IAID}}
+	if l.prefixDelegation {
+		ias = append(ias, &dhcp6IA{code: dhcp6OptionIAPD, iaid: dhcp6IAID})
+	}
+	return ias
+}
+
+func (l *DHCP6Lease) newMessage(msgType dhcp6MessageType, start time.Time, serverID []byte, ias []*dhcp6IA) (*dhcp6Message, error) {
+	m, err := newDHCP6Message(msgType)
+	if err != nil {
+		return nil, err
+	}
+	m.addOption(dhcp6OptionClientID, l.duid)
+	if serverID != nil {
+		m.addOption(dhcp6OptionServerID, serverID)
+	}
+	m.addOption(dhcp6OptionElapsedTime, elapsedTime(start))
+	for _, ia := range ias {
+		if ia != nil {
+			m.addOption(ia.code, ia.marshal())
+		}
+	}
+	return m, nil
+}
+
+// IPNet returns the leased address. DHCPv6 doesn't tell the length of the
+// prefix, which the router advertises, so it is a /128.
+func (l *DHCP6Lease) IPNet() *net.IPNet {
+	return &net.IPNet{
+		IP:   l.ia.addrs[0].ip,
+		Mask: net.CIDRMask(128, 128),
+	}
+}
+
+// Prefixes returns the delegated prefixes
+func (l *DHCP6Lease) Prefixes() []net.IPNet {
+	if l.pd == nil {
+		return nil
+	}
+	prefixes := make([]net.IPNet, 0, len(l.pd.prefixes))
+	for _, p := range l.pd.prefixes {
+		prefixes = append(prefixes, p.prefix)
+	}
+	return prefixes
+}
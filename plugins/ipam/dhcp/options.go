@@ -15,9 +15,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
@@ -66,7 +71,12 @@ func parseCIDRRoutes(opts dhcp4.Options) []*types.Route {
 	// See RFC4332 for format (http://tools.ietf.org/html/rfc3442)
 
 	routes := []*types.Route{}
-	if opt, ok := opts[dhcp4.OptionClasslessRouteFormat]; ok {
+	opt, ok := opts[dhcp4.OptionClasslessRouteFormat]
+	if !ok {
+		// Microsoft servers use a private code for the same option
+		opt, ok = opts[optionMSClasslessRoutes]
+	}
+	if ok {
 		for len(opt) >= 5 {
 			width := int(opt[0])
 			if width > 32 {
@@ -104,6 +114,45 @@ func parseCIDRRoutes(opts dhcp4.Options) []*types.Route {
 	return routes
 }
 
+// parseDNS returns the name servers, domain name and search list of opts
+func parseDNS(opts dhcp4.Options) types.DNS {
+	dns := types.DNS{}
+
+	if opt, ok := opts[dhcp4.OptionDomainNameServer]; ok {
+		for ; len(opt) >= 4; opt = opt[4:] {
+			dns.Nameservers = append(dns.Nameservers, net.IP(opt[0:4]).String())
+		}
+	}
+
+	if opt, ok := opts[dhcp4.OptionDomainName]; ok {
+		// Some servers NUL terminate the name
+		dns.Domain = strings.TrimRight(string(opt), "\x00 ")
+	}
+
+	if opt, ok := opts[optionDomainSearch]; ok {
+		// A malformed list is ignored as a whole
+		if search, err := decodeDomainNames(opt); err == nil {
+			dns.Search = search
+		}
+	}
+
+	return dns
+}
+
+// parseMTU returns the Interface MTU option, or 0 if there is none or it is
+// below the minimum of RFC 2132
+func parseMTU(opts dhcp4.Options) int {
+	opt, ok := opts[dhcp4.OptionInterfaceMTU]
+	if !ok || len(opt) != 2 {
+		return 0
+	}
+	mtu := int(binary.BigEndian.Uint16(opt))
+	if mtu < 68 {
+		return 0
+	}
+	return mtu
+}
+
 func parseSubnetMask(opts dhcp4.Options) net.IPMask {
 	mask, ok := opts[dhcp4.OptionSubnetMask]
 	if !ok {
@@ -137,3 +186,236 @@ func parseRenewalTime(opts dhcp4.Options) (time.Duration, error) {
 func parseRebindingTime(opts dhcp4.Options) (time.Duration, error) {
 	return parseDuration(opts, dhcp4.OptionRebindingTimeValue, "RebindingTime")
 }
+
+// Option codes dhcp4 has no constant for
+const (
+	optionClientFQDN        dhcp4.OptionCode = 81
+	optionDomainSearch      dhcp4.OptionCode = 119
+	optionMSClasslessRoutes dhcp4.OptionCode = 249
+)
+
+// optionNames are the names options can be given by in the configuration,
+// along with their codes
+var optionNames = map[string]dhcp4.OptionCode{
+	"subnet-mask":             dhcp4.OptionSubnetMask,
+	"router":                  dhcp4.OptionRouter,
+	"dns-servers":             dhcp4.OptionDomainNameServer,
+	"host-name":               dhcp4.OptionHostName,
+	"domain-name":             dhcp4.OptionDomainName,
+	"interface-mtu":           dhcp4.OptionInterfaceMTU,
+	"static-routes":           dhcp4.OptionStaticRoute,
+	"ntp-servers":             dhcp4.OptionNetworkTimeProtocolServers,
+	"vendor-class-identifier": dhcp4.OptionVendorClassIdentifier,
+	"user-class":              dhcp4.OptionUserClass,
+	"fqdn":                    optionClientFQDN,
+	"domain-search":           optionDomainSearch,
+	"classless-static-routes": dhcp4.OptionClasslessRouteFormat,
+}
+
+// parseOptionCode returns the code of the option named or numbered name
+func parseOptionCode(name string) (dhcp4.OptionCode, error) {
+	if code, ok := optionNames[name]; ok {
+		return code, nil
+	}
+	code, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || code == uint64(dhcp4.Pad) || code == uint64(dhcp4.End) {
+		return 0, fmt.Errorf("unknown DHCP option %q", name)
+	}
+	return dhcp4.OptionCode(code), nil
+}
+
+// RequestOption is an option the client asks the server for
+type RequestOption struct {
+	// Option is the name or the code of the option
+	Option string `json:"option"`
+}
+
+// ProvideOption is an option the client sends to the server
+type ProvideOption struct {
+	// Option is the name or the code of the option
+	Option string `json:"option"`
+	// Value is a template of the value, which can use the fields of
+	// optionValueArgs, like "{{.PodName}}.{{.PodNamespace}}". Options whose
+	// value is empty aren't sent.
+	Value string `json:"value,omitempty"`
+	// ValueHex is the value as hex encoded bytes, for raw options
+	ValueHex string `json:"valueHex,omitempty"`
+}
+
+// optionValueArgs are the fields the values of provided options can use
+type optionValueArgs struct {
+	ContainerID  string
+	IfName       string
+	NetworkName  string
+	PodName      string
+	PodNamespace string
+}
+
+// defaultRequestOptions are the options the client always asks for, those
+// the results are made of
+var defaultRequestOptions = []dhcp4.OptionCode{
+	dhcp4.OptionRouter,
+	dhcp4.OptionSubnetMask,
+	dhcp4.OptionDomainNameServer,
+	dhcp4.OptionDomainName,
+	optionDomainSearch,
+	dhcp4.OptionStaticRoute,
+	dhcp4.OptionClasslessRouteFormat,
+	optionMSClasslessRoutes,
+}
+
+// prepareOptions returns the options the client sends in its requests: the
+// client identifier, the parameter request list and the provided options
+func prepareOptions(clientID string, request []RequestOption, provide []ProvideOption, args optionValueArgs) (dhcp4.Options, error) {
+	opts := make(dhcp4.Options)
+	opts[dhcp4.OptionClientIdentifier] = []byte(clientID)
+
+	prl := make([]byte, 0, len(defaultRequestOptions)+len(request))
+	for _, code := range defaultRequestOptions {
+		prl = append(prl, byte(code))
+	}
+	for _, r := range request {
+		code, err := parseOptionCode(r.Option)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.IndexByte(prl, byte(code)) < 0 {
+			prl = append(prl, byte(code))
+		}
+	}
+	opts[dhcp4.OptionParameterRequestList] = prl
+
+	for _, p := range provide {
+		code, err := parseOptionCode(p.Option)
+		if err != nil {
+			return nil, err
+		}
+		switch code {
+		case dhcp4.OptionClientIdentifier, dhcp4.OptionParameterRequestList, dhcp4.OptionDHCPMessageType:
+			return nil, fmt.Errorf("DHCP option %q can't be provided", p.Option)
+		}
+
+		value, err := optionValue(code, p, args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of DHCP option %q: %v", p.Option, err)
+		}
+		if len(value) == 0 {
+			continue
+		}
+		if len(value) > 255 {
+			return nil, fmt.Errorf("value of DHCP option %q is longer than 255 bytes", p.Option)
+		}
+		opts[code] = value
+	}
+
+	return opts, nil
+}
+
+// optionValue returns the encoded value of p
+func optionValue(code dhcp4.OptionCode, p ProvideOption, args optionValueArgs) ([]byte, error) {
+	if p.ValueHex != "" {
+		return hex.DecodeString(p.ValueHex)
+	}
+
+	tmpl, err := template.New(p.Option).Option("missingkey=error").Parse(p.Value)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, args); err != nil {
+		return nil, err
+	}
+	value := b.String()
+	if value == "" {
+		return nil, nil
+	}
+
+	switch code {
+	case optionClientFQDN:
+		// RFC 4702: flags, two deprecated rcodes and the name in the
+		// canonical wire format (the E flag)
+		name, err := encodeDomainName(value)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{0x04, 0, 0}, name...), nil
+	case dhcp4.OptionUserClass:
+		// RFC 3004: a list of length prefixed user classes
+		if len(value) > 254 {
+			return nil, fmt.Errorf("user class is longer than 254 bytes")
+		}
+		return append([]byte{byte(len(value))}, value...), nil
+	}
+	return []byte(value), nil
+}
+
+// encodeDomainName encodes name as a sequence of length prefixed labels
+func encodeDomainName(name string) ([]byte, error) {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain name %q", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// decodeDomainNames decodes a list of domain names in the DNS encoding, with
+// compression, as in the Domain Search option (RFC 3397)
+func decodeDomainNames(b []byte) ([]string, error) {
+	var names []string
+	for off := 0; off < len(b); {
+		name, next, err := decodeDomainName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		off = next
+	}
+	return names, nil
+}
+
+// decodeDomainName decodes the name at off in b, and returns it along with
+// the offset following it
+func decodeDomainName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	// Pointers must go backwards, which also bounds their number
+	ptrLimit := off
+	for {
+		if off >= len(b) {
+			return "", 0, fmt.Errorf("truncated domain name")
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, fmt.Errorf("truncated domain name")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			ptr := int(binary.BigEndian.Uint16(b[off:off+2]) & 0x3fff)
+			if ptr >= ptrLimit {
+				return "", 0, fmt.Errorf("invalid domain name pointer")
+			}
+			ptrLimit = ptr
+			off = ptr
+		case length&0xc0 != 0:
+			return "", 0, fmt.Errorf("invalid domain name label")
+		default:
+			if off+1+length > len(b) {
+				return "", 0, fmt.Errorf("truncated domain name")
+			}
+			labels = append(labels, string(b[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
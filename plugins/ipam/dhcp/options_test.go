@@ -16,6 +16,7 @@ package main
 
 import (
 	"net"
+	"reflect"
 	"testing"
 
 	"github.com/containernetworking/cni/pkg/types"
@@ -73,3 +74,152 @@ func TestParseCIDRRoutes(t *testing.T) {
 
 	validateRoutes(t, routes)
 }
+
+func TestParseCIDRRoutesMicrosoft(t *testing.T) {
+	opts := make(dhcp4.Options)
+	opts[optionMSClasslessRoutes] = []byte{8, 10, 10, 1, 2, 3, 24, 192, 168, 1, 192, 168, 2, 3}
+	routes := parseCIDRRoutes(opts)
+
+	validateRoutes(t, routes)
+
+	// option 121 wins
+	opts[dhcp4.OptionClasslessRouteFormat] = []byte{0, 10, 1, 2, 3}
+	routes = parseCIDRRoutes(opts)
+	if len(routes) != 1 || routes[0].Dst.String() != "0.0.0.0/0" {
+		t.Errorf("expected the default route of option 121, got %v", routes)
+	}
+}
+
+func TestParseDNS(t *testing.T) {
+	opts := make(dhcp4.Options)
+	opts[dhcp4.OptionDomainNameServer] = []byte{10, 0, 0, 53, 10, 0, 1, 53}
+	opts[dhcp4.OptionDomainName] = []byte("example.com\x00")
+	// RFC 3397 section 2 example: eng.apple.com. and marketing.apple.com.
+	opts[optionDomainSearch] = []byte("\x03eng\x05apple\x03com\x00\x09marketing\xc0\x04")
+
+	dns := parseDNS(opts)
+	expected := types.DNS{
+		Nameservers: []string{"10.0.0.53", "10.0.1.53"},
+		Domain:      "example.com",
+		Search:      []string{"eng.apple.com", "marketing.apple.com"},
+	}
+	if !reflect.DeepEqual(dns, expected) {
+		t.Errorf("DNS mismatch: expected %v, got %v", expected, dns)
+	}
+
+	if dns := parseDNS(dhcp4.Options{}); !reflect.DeepEqual(dns, types.DNS{}) {
+		t.Errorf("expected no DNS settings, got %v", dns)
+	}
+}
+
+func TestDecodeDomainNamesErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte("\x03eng"),
+		[]byte("\x03eng\x00\xc0"),
+		// pointers must go backwards
+		[]byte("\xc0\x00"),
+		[]byte("\x03eng\xc0\x05\x00"),
+		[]byte("\x80eng\x00"),
+	} {
+		if names, err := decodeDomainNames(b); err == nil {
+			t.Errorf("expected an error decoding %q, got %v", b, names)
+		}
+	}
+}
+
+func TestParseMTU(t *testing.T) {
+	for _, tc := range []struct {
+		opt []byte
+		mtu int
+	}{
+		{opt: nil, mtu: 0},
+		{opt: []byte{0x05, 0xdc}, mtu: 1500},
+		{opt: []byte{0x00, 0x40}, mtu: 0},
+		{opt: []byte{0x05}, mtu: 0},
+	} {
+		opts := make(dhcp4.Options)
+		if tc.opt != nil {
+			opts[dhcp4.OptionInterfaceMTU] = tc.opt
+		}
+		if mtu := parseMTU(opts); mtu != tc.mtu {
+			t.Errorf("expected MTU %d for %v, got %d", tc.mtu, tc.opt, mtu)
+		}
+	}
+}
+
+func TestPrepareOptions(t *testing.T) {
+	args := optionValueArgs{
+		ContainerID:  "dummy",
+		IfName:       "eth0",
+		NetworkName:  "mynet",
+		PodName:      "web-0",
+		PodNamespace: "shop",
+	}
+	opts, err := prepareOptions("dummy/mynet/eth0", []RequestOption{
+		{Option: "dns-servers"},
+		{Option: "classless-static-routes"},
+		{Option: "26"},
+		{Option: "router"},
+	}, []ProvideOption{
+		{Option: "host-name", Value: "{{.PodName}}"},
+		{Option: "fqdn", Value: "{{.PodName}}.{{.PodNamespace}}.example.com"},
+		{Option: "vendor-class-identifier", Value: "cni"},
+		{Option: "user-class", Value: "{{.NetworkName}}"},
+		{Option: "224", ValueHex: "01ff"},
+		{Option: "225", Value: ""},
+	}, args)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := dhcp4.Options{
+		dhcp4.OptionClientIdentifier:      []byte("dummy/mynet/eth0"),
+		dhcp4.OptionParameterRequestList:  []byte{3, 1, 6, 15, 119, 33, 121, 249, 26},
+		dhcp4.OptionHostName:              []byte("web-0"),
+		optionClientFQDN:                  append([]byte{0x04, 0, 0, 5}, "web-0\x04shop\x07example\x03com\x00"...),
+		dhcp4.OptionVendorClassIdentifier: []byte("cni"),
+		dhcp4.OptionUserClass:             []byte("\x05mynet"),
+		224:                               {0x01, 0xff},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("options mismatch: expected %v, got %v", expected, opts)
+	}
+}
+
+func TestPrepareOptionsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		request []RequestOption
+		provide []ProvideOption
+		err     string
+	}{
+		{
+			request: []RequestOption{{Option: "no-such-option"}},
+			err:     `unknown DHCP option "no-such-option"`,
+		},
+		{
+			request: []RequestOption{{Option: "255"}},
+			err:     `unknown DHCP option "255"`,
+		},
+		{
+			provide: []ProvideOption{{Option: "61", Value: "other"}},
+			err:     `DHCP option "61" can't be provided`,
+		},
+		{
+			provide: []ProvideOption{{Option: "224", ValueHex: "xyz"}},
+			err:     `invalid value of DHCP option "224": encoding/hex: invalid byte: U+0078 'x'`,
+		},
+		{
+			provide: []ProvideOption{{Option: "host-name", Value: "{{.PodUID}}"}},
+			err:     `invalid value of DHCP option "host-name": template: host-name:1:2: executing "host-name" at <.PodUID>: can't evaluate field PodUID in type main.optionValueArgs`,
+		},
+		{
+			provide: []ProvideOption{{Option: "fqdn", Value: "a..b"}},
+			err:     `invalid value of DHCP option "fqdn": invalid domain name "a..b"`,
+		},
+	} {
+		_, err := prepareOptions("dummy/mynet/eth0", tc.request, tc.provide, optionValueArgs{})
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+}
@@ -15,11 +15,15 @@
 package allocator
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"os"
 	"strconv"
+	"time"
 
 	current "github.com/containernetworking/cni/pkg/types/100"
 
@@ -27,10 +31,30 @@ import (
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 )
 
+// IPv6 range sets holding more than largeRangeSetSize IPs are too big to
+// walk when they fill up. Whatever the strategy, once sequentialProbes IPs
+// were found taken, the allocator tries up to hashedProbes IPs spread over the
+// whole set instead, so the order of the strategy only holds while the IPs it
+// starts at are free.
+const (
+	largeRangeSetSize = 1 << 16
+	sequentialProbes  = 64
+	hashedProbes      = 1024
+)
+
+// reuseDelayKey holds the released IPs waiting for their reuse delay. Sticky
+// keys always contain a "/", so they can't clash with it.
+const reuseDelayKey = "reuse-delay"
+
 type IPAllocator struct {
 	rangeset *RangeSet
 	store    backend.Store
 	rangeID  string // Used for tracking last reserved ip
+
+	strategy    string
+	stickyKey   string
+	stickyGrace time.Duration
+	metadata    backend.Metadata // Recorded with each reservation
 }
 
 func NewIPAllocator(s *RangeSet, store backend.Store, id int) *IPAllocator {
@@ -41,6 +65,40 @@ func NewIPAllocator(s *RangeSet, store backend.Store, id int) *IPAllocator {
 	}
 }
 
+// Configure applies the allocation strategy settings of conf
+func (a *IPAllocator) Configure(conf *IPAMConfig) {
+	a.strategy = a.rangeset.AllocationStrategy(conf.AllocationStrategy)
+	a.stickyKey = conf.StickyKey
+	a.stickyGrace = time.Duration(conf.StickyGracePeriod)
+	if a.stickyGrace == 0 {
+		a.stickyGrace = defaultStickyGracePeriod
+	}
+	a.metadata = backend.Metadata{
+		Network:      conf.Name,
+		PodNamespace: conf.PodNamespace,
+		PodName:      conf.PodName,
+	}
+}
+
+// reserve reserves ip for the interface ifname of the container id,
+// recording when and for which pod
+func (a *IPAllocator) reserve(id string, ifname string, ip net.IP) (bool, error) {
+	meta := a.metadata
+	meta.AllocatedAt = time.Now()
+	return a.store.ReserveWithMetadata(id, ifname, ip, a.rangeID, meta)
+}
+
+// stickyKeyFor returns the key the IPs of a container interface are held
+// under. Without a workload identity the container ID is used, which only
+// helps runtimes that re-add the same container.
+func (a *IPAllocator) stickyKeyFor(id string, ifname string) string {
+	key := a.stickyKey
+	if key == "" {
+		key = id
+	}
+	return key + "/" + ifname
+}
+
 // Get allocates an IP
 func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*current.IPConfig, error) {
 	a.store.Lock()
@@ -49,6 +107,11 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 	var reservedIP *net.IPNet
 	var gw net.IP
 
+	// Make the IPs whose hold or reuse delay ended available again
+	if err := a.store.ReleaseExpiredHolds(time.Now()); err != nil {
+		return nil, err
+	}
+
 	if requestedIP != nil {
 		if err := canonicalizeIP(&requestedIP); err != nil {
 			return nil, err
@@ -63,10 +126,30 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 			return nil, fmt.Errorf("requested ip %s is subnet's gateway", requestedIP.String())
 		}
 
-		reserved, err := a.store.Reserve(id, ifname, requestedIP, a.rangeID)
+		if r.excludedUntil(requestedIP) != nil {
+			return nil, fmt.Errorf("requested ip %s is excluded from range %s", requestedIP.String(), r.String())
+		}
+
+		if r.unusableUntil(requestedIP) != nil {
+			return nil, fmt.Errorf("requested ip %s is not the first IP of a /%d prefix that can be delegated from range %s", requestedIP.String(), r.AllocationPrefixLength, r.String())
+		}
+
+		reserved, err := a.reserve(id, ifname, requestedIP)
 		if err != nil {
 			return nil, err
 		}
+		if !reserved && a.inReuseDelay(requestedIP) {
+			if !r.OverrideReuseDelay {
+				return nil, fmt.Errorf("requested IP address %s was released less than %s ago", requestedIP, time.Duration(r.ReuseDelay))
+			}
+			if err := a.store.ReleaseHeldIP(reuseDelayKey, requestedIP); err != nil {
+				return nil, err
+			}
+			reserved, err = a.reserve(id, ifname, requestedIP)
+			if err != nil {
+				return nil, err
+			}
+		}
 		if !reserved {
 			return nil, fmt.Errorf("requested IP address %s is not available in range set %s", requestedIP, a.rangeset.String())
 		}
@@ -85,23 +168,42 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 			}
 		}
 
-		iter, err := a.GetIter()
-		if err != nil {
-			return nil, err
-		}
-		for {
-			reservedIP, gw = iter.Next()
-			if reservedIP == nil {
-				break
+		if a.strategy == StrategySticky {
+			var err error
+			reservedIP, gw, err = a.reclaimHeld(id, ifname)
+			if err != nil {
+				return nil, err
 			}
+		}
 
-			reserved, err := a.store.Reserve(id, ifname, reservedIP.IP, a.rangeID)
+		if reservedIP == nil {
+			iter, err := a.GetIter()
 			if err != nil {
 				return nil, err
 			}
-
-			if reserved {
-				break
+			bounded := a.rangeset.isLargeIPv6()
+			for probes := 0; ; probes++ {
+				if bounded && probes == sequentialProbes {
+					reservedIP, gw, err = a.getHashed(id, ifname)
+					if err != nil {
+						return nil, err
+					}
+					break
+				}
+
+				reservedIP, gw = iter.Next()
+				if reservedIP == nil {
+					break
+				}
+
+				reserved, err := a.reserve(id, ifname, reservedIP.IP)
+				if err != nil {
+					return nil, err
+				}
+
+				if reserved {
+					break
+				}
 			}
 		}
 	}
@@ -116,6 +218,46 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 	}, nil
 }
 
+// DelegatedPrefix returns the prefix delegated along with ip, an IP Get
+// returned, or nil if its range doesn't delegate prefixes. The IP is the
+// first of the prefix, and is assigned with the mask of the subnet so it
+// stays on the link with the gateway.
+func (a *IPAllocator) DelegatedPrefix(ip net.IP) *net.IPNet {
+	r, err := a.rangeset.RangeFor(ip)
+	if err != nil || r.AllocationPrefixLength == 0 {
+		return nil
+	}
+	return &net.IPNet{IP: ip.Mask(r.prefixMask()), Mask: r.prefixMask()}
+}
+
+// getHashed reserves an IP picked by hashing the container and an attempt
+// number over the whole range set. The store refuses IPs that are taken,
+// so picking the same IP twice is harmless.
+func (a *IPAllocator) getHashed(id string, ifname string) (*net.IPNet, net.IP, error) {
+	total := a.rangeset.size()
+	for attempt := 0; attempt < hashedProbes; attempt++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\r\n%s\r\n%d", id, ifname, attempt)))
+		idx, candidate := a.rangeset.ipAt(new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), total))
+		r := (*a.rangeset)[idx]
+		if r.AllocationPrefixLength != 0 {
+			// Take the prefix the IP is in
+			candidate = candidate.Mask(r.prefixMask())
+		}
+		if !r.Contains(candidate) || candidate.Equal(r.Gateway) || r.unusableUntil(candidate) != nil {
+			continue
+		}
+
+		reserved, err := a.reserve(id, ifname, candidate)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reserved {
+			return &net.IPNet{IP: candidate, Mask: r.Subnet.Mask}, r.Gateway, nil
+		}
+	}
+	return nil, nil, nil
+}
+
 // Release clears all IPs allocated for the container with given ID
 func (a *IPAllocator) Release(id string, ifname string) error {
 	a.store.Lock()
@@ -124,6 +266,76 @@ func (a *IPAllocator) Release(id string, ifname string) error {
 	return a.store.ReleaseByID(id, ifname)
 }
 
+// Hold keeps the IPs of the container in this range set aside once it is
+// gone: for its workload for the grace period if the range set is sticky,
+// from everyone for the reuse delay of their range otherwise. A sticky IP
+// is held for the longer of the two. It must be called before Release,
+// which drops the IPs of all range sets.
+func (a *IPAllocator) Hold(id string, ifname string) error {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	now := time.Now()
+	for _, ip := range a.store.GetByID(id, ifname) {
+		r, err := a.rangeset.RangeFor(ip)
+		if err != nil {
+			continue
+		}
+
+		key, until := reuseDelayKey, now.Add(time.Duration(r.ReuseDelay))
+		if a.strategy == StrategySticky {
+			key = a.stickyKeyFor(id, ifname)
+			if stickyUntil := now.Add(a.stickyGrace); stickyUntil.After(until) {
+				until = stickyUntil
+			}
+		} else if r.ReuseDelay == 0 {
+			continue
+		}
+		if err := a.store.HoldIP(key, ip, until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inReuseDelay returns true if ip was released and its reuse delay hasn't
+// passed yet
+func (a *IPAllocator) inReuseDelay(ip net.IP) bool {
+	for _, held := range a.store.GetHeldIPs(reuseDelayKey) {
+		if held.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reclaimHeld reserves the IP held in this range set for the workload of
+// the container, if any
+func (a *IPAllocator) reclaimHeld(id string, ifname string) (*net.IPNet, net.IP, error) {
+	key := a.stickyKeyFor(id, ifname)
+	for _, held := range a.store.GetHeldIPs(key) {
+		if err := canonicalizeIP(&held); err != nil {
+			continue
+		}
+		r, err := a.rangeset.RangeFor(held)
+		if err != nil {
+			continue
+		}
+
+		if err := a.store.ReleaseHeldIP(key, held); err != nil {
+			return nil, nil, err
+		}
+		reserved, err := a.reserve(id, ifname, held)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reserved {
+			return &net.IPNet{IP: held, Mask: r.Subnet.Mask}, r.Gateway, nil
+		}
+	}
+	return nil, nil, nil
+}
+
 type RangeIter struct {
 	rangeset *RangeSet
 
@@ -138,15 +350,27 @@ type RangeIter struct {
 }
 
 // GetIter encapsulates the strategy for this allocator.
-// We use a round-robin strategy, attempting to evenly use the whole set.
-// More specifically, a crash-looping container will not see the same IP until
-// the entire range has been run through.
-// We may wish to consider avoiding recently-released IPs in the future.
+// By default we use a round-robin strategy, attempting to evenly use the
+// whole set. More specifically, a crash-looping container will not see the
+// same IP until the entire range has been run through. The sticky strategy
+// falls back to round-robin as well.
 func (a *IPAllocator) GetIter() (*RangeIter, error) {
 	iter := RangeIter{
 		rangeset: a.rangeset,
 	}
 
+	switch a.strategy {
+	case StrategyLowestFree:
+		iter.rangeIdx = 0
+		iter.startIP = (*a.rangeset)[0].RangeStart
+		return &iter, nil
+	case StrategyRandom:
+		if err := iter.startAtRandom(); err != nil {
+			return nil, err
+		}
+		return &iter, nil
+	}
+
 	// Round-robin by trying to allocate from the last reserved IP + 1
 	startFromLastReservedIP := false
 
@@ -178,44 +402,72 @@ func (a *IPAllocator) GetIter() (*RangeIter, error) {
 	return &iter, nil
 }
 
+// startAtRandom places the cursor on a random IP of the set, every IP
+// being equally likely
+func (i *RangeIter) startAtRandom() error {
+	n, err := rand.Int(rand.Reader, i.rangeset.size())
+	if err != nil {
+		return err
+	}
+
+	// We advance the cursor on every Next(), so the first call
+	// to next() will return the IP after the random one
+	i.rangeIdx, i.cur = i.rangeset.ipAt(n)
+	return nil
+}
+
 // Next returns the next IP, its mask, and its gateway. Returns nil
 // if the iterator has been exhausted
 func (i *RangeIter) Next() (*net.IPNet, net.IP) {
-	r := (*i.rangeset)[i.rangeIdx]
+	for {
+		r := (*i.rangeset)[i.rangeIdx]
+		first := false
+
+		if i.cur == nil {
+			// If this is the first time iterating and we're not starting in the middle
+			// of the range, then start at rangeStart, which is inclusive
+			i.cur = r.RangeStart
+			i.startIP = i.cur
+			first = true
+		} else {
+			// If we've reached the end of this range, we need to advance the range
+			// RangeEnd is inclusive as well
+			if i.cur.Equal(r.RangeEnd) {
+				i.rangeIdx += 1
+				i.rangeIdx %= len(*i.rangeset)
+				r = (*i.rangeset)[i.rangeIdx]
+
+				i.cur = r.RangeStart
+			} else {
+				i.cur = ip.NextIP(i.cur)
+			}
 
-	// If this is the first time iterating and we're not starting in the middle
-	// of the range, then start at rangeStart, which is inclusive
-	if i.cur == nil {
-		i.cur = r.RangeStart
-		i.startIP = i.cur
-		if i.cur.Equal(r.Gateway) {
-			return i.Next()
+			if i.startIP == nil {
+				i.startIP = i.cur
+				first = true
+			} else if i.cur.Equal(i.startIP) {
+				// IF we've looped back to where we started, give up
+				return nil, nil
+			}
 		}
-		return &net.IPNet{IP: i.cur, Mask: r.Subnet.Mask}, r.Gateway
-	}
-
-	// If we've reached the end of this range, we need to advance the range
-	// RangeEnd is inclusive as well
-	if i.cur.Equal(r.RangeEnd) {
-		i.rangeIdx += 1
-		i.rangeIdx %= len(*i.rangeset)
-		r = (*i.rangeset)[i.rangeIdx]
 
-		i.cur = r.RangeStart
-	} else {
-		i.cur = ip.NextIP(i.cur)
-	}
+		// Jump over excluded blocks, and the IPs that don't start a prefix
+		// to delegate, rather than walking them
+		if end := r.unusableUntil(i.cur); end != nil {
+			if first {
+				// Start after the block, so that coming back to it ends the loop
+				i.startIP = end
+			} else if r.Contains(i.startIP) && ip.Cmp(i.startIP, i.cur) >= 0 && ip.Cmp(i.startIP, end) <= 0 {
+				return nil, nil
+			}
+			i.cur = end
+			continue
+		}
 
-	if i.startIP == nil {
-		i.startIP = i.cur
-	} else if i.cur.Equal(i.startIP) {
-		// IF we've looped back to where we started, give up
-		return nil, nil
-	}
+		if i.cur.Equal(r.Gateway) {
+			continue
+		}
 
-	if i.cur.Equal(r.Gateway) {
-		return i.Next()
+		return &net.IPNet{IP: i.cur, Mask: r.Subnet.Mask}, r.Gateway
 	}
-
-	return &net.IPNet{IP: i.cur, Mask: r.Subnet.Mask}, r.Gateway
 }
@@ -17,9 +17,11 @@ package allocator
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 	fakestore "github.com/containernetworking/plugins/plugins/ipam/host-local/backend/testing"
 
 	. "github.com/onsi/ginkgo"
@@ -66,6 +68,26 @@ func newAllocatorWithMultiRanges() IPAllocator {
 	return alloc
 }
 
+// fullStore refuses all reservations, or the first freeAfter ones if set,
+// and counts the attempts
+type fullStore struct {
+	*fakestore.FakeStore
+	attempts  int
+	freeAfter int
+}
+
+func (s *fullStore) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
+	s.attempts++
+	if s.freeAfter > 0 && s.attempts > s.freeAfter {
+		return s.FakeStore.Reserve(id, ifname, ip, rangeID)
+	}
+	return false, nil
+}
+
+func (s *fullStore) ReserveWithMetadata(id string, ifname string, ip net.IP, rangeID string, meta backend.Metadata) (bool, error) {
+	return s.Reserve(id, ifname, ip, rangeID)
+}
+
 func (t AllocatorTestCase) run(idx int) (*current.IPConfig, error) {
 	fmt.Fprintln(GinkgoWriter, "Index:", idx)
 	p := RangeSet{}
@@ -370,6 +392,364 @@ var _ = Describe("host-local ip allocator", func() {
 			Expect(r.startIP).To(Equal(net.IP{192, 168, 1, 0}))
 		})
 	})
+
+	Context("with excluded addresses", func() {
+		mkExcludeAlloc := func(subnet string, exclude ...string) IPAllocator {
+			a := mkalloc()
+			p := RangeSet{Range{Subnet: mustSubnet(subnet), Exclude: exclude}}
+			Expect(p.Canonicalize()).To(Succeed())
+			a.rangeset = &p
+			return a
+		}
+
+		It("should skip them", func() {
+			a := mkExcludeAlloc("192.168.1.0/29", "192.168.1.3", "192.168.1.4/31")
+			r, _ := a.GetIter()
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 2}))
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 6}))
+			Expect(r.nextip()).To(BeNil())
+		})
+
+		It("should stop when starting inside an excluded block", func() {
+			a := mkExcludeAlloc("192.168.1.0/29", "192.168.1.2/31", "192.168.1.4/31")
+			a.store.Reserve("ID", "eth0", net.IP{192, 168, 1, 2}, a.rangeID)
+			a.store.ReleaseByID("ID", "eth0")
+			r, _ := a.GetIter()
+			Expect(r.nextip()).To(Equal(net.IP{192, 168, 1, 6}))
+			Expect(r.nextip()).To(BeNil())
+		})
+
+		It("should give up when everything is excluded", func() {
+			a := mkExcludeAlloc("192.168.1.0/29", "192.168.1.0/29")
+			r, _ := a.GetIter()
+			Expect(r.nextip()).To(BeNil())
+
+			_, err := a.Get("ID", "eth0", nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should jump over large blocks", func() {
+			a := mkExcludeAlloc("2001:db8::/64", "2001:db8::/65")
+			r, _ := a.GetIter()
+			Expect(r.nextip()).To(Equal(net.ParseIP("2001:db8::8000:0:0:0")))
+		})
+
+		It("should reject a requested IP that is excluded", func() {
+			a := mkExcludeAlloc("192.168.1.0/29", "192.168.1.4/31")
+			_, err := a.Get("ID", "eth0", net.IP{192, 168, 1, 5})
+			Expect(err).To(MatchError("requested ip 192.168.1.5 is excluded from range 192.168.1.1-192.168.1.6"))
+		})
+	})
+
+	Context("with a large IPv6 range set", func() {
+		mkLargeAlloc := func(ipmap map[string]string) IPAllocator {
+			a := mkalloc()
+			p := RangeSet{Range{Subnet: mustSubnet("2001:db8::/64")}}
+			Expect(p.Canonicalize()).To(Succeed())
+			a.rangeset = &p
+			// The fake store records reservations in the map it is given
+			reserved := map[string]string{}
+			for k, v := range ipmap {
+				reserved[k] = v
+			}
+			a.store = fakestore.NewFakeStore(reserved, map[string]net.IP{})
+			return a
+		}
+
+		It("should allocate the next IP while the range is sparse", func() {
+			a := mkLargeAlloc(map[string]string{})
+			res, err := a.Get("ID", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP.String()).To(Equal("2001:db8::2"))
+		})
+
+		It("should probe hashed IPs with the default strategy once the next ones are taken", func() {
+			taken := map[string]string{}
+			for i := 2; i < 2+4*sequentialProbes; i++ {
+				taken[fmt.Sprintf("2001:db8::%x", i)] = "other"
+			}
+			a := mkLargeAlloc(taken)
+			// Only counts the attempts, the first IP is taken anyway
+			store := &fullStore{FakeStore: a.store.(*fakestore.FakeStore), freeAfter: 1}
+			a.store = store
+
+			res, err := a.Get("ID", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.attempts).To(Equal(sequentialProbes + 1))
+			Expect(a.rangeset.Contains(res.Address.IP)).To(BeTrue())
+			Expect(taken).NotTo(HaveKey(res.Address.IP.String()))
+			Expect(res.Address.IP).NotTo(Equal(net.ParseIP(fmt.Sprintf("2001:db8::%x", 2+4*sequentialProbes))))
+		})
+
+		for _, strategy := range []string{StrategyRoundRobin, StrategyLowestFree, StrategyRandom, StrategySticky} {
+			strategy := strategy
+
+			It(fmt.Sprintf("should probe hashed IPs with the %s strategy once the next ones are taken", strategy), func() {
+				get := func() *current.IPConfig {
+					a := mkLargeAlloc(map[string]string{})
+					a.strategy = strategy
+					store := &fullStore{FakeStore: a.store.(*fakestore.FakeStore), freeAfter: sequentialProbes}
+					a.store = store
+
+					res, err := a.Get("ID", "eth0", nil)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(store.attempts).To(Equal(sequentialProbes + 1))
+					Expect(a.rangeset.Contains(res.Address.IP)).To(BeTrue())
+					return res
+				}
+
+				// The start may differ, but the same container gets the
+				// same hashed candidates
+				Expect(get().Address.IP).To(Equal(get().Address.IP))
+			})
+
+			It(fmt.Sprintf("should give up after a bounded number of probes with the %s strategy", strategy), func() {
+				a := mkLargeAlloc(map[string]string{})
+				a.strategy = strategy
+				store := &fullStore{FakeStore: a.store.(*fakestore.FakeStore)}
+				a.store = store
+
+				_, err := a.Get("ID", "eth0", nil)
+				Expect(err).To(MatchError("no IP addresses available in range set: 2001:db8::1-2001:db8::ffff:ffff:ffff:ffff"))
+				Expect(store.attempts).To(BeNumerically("<=", sequentialProbes+hashedProbes))
+			})
+		}
+
+		It("should walk small IPv6 ranges", func() {
+			p := RangeSet{Range{Subnet: mustSubnet("2001:db8::/120")}}
+			Expect(p.Canonicalize()).To(Succeed())
+			Expect(p.isLargeIPv6()).To(BeFalse())
+		})
+	})
+
+	Context("when delegating prefixes", func() {
+		mkPrefixAlloc := func() IPAllocator {
+			a := mkalloc()
+			p := RangeSet{Range{Subnet: mustSubnet("192.168.1.0/26"), AllocationPrefixLength: 28}}
+			Expect(p.Canonicalize()).To(Succeed())
+			a.rangeset = &p
+			return a
+		}
+
+		It("should allocate whole prefixes", func() {
+			a := mkPrefixAlloc()
+			res, err := a.Get("ID", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.16/26"))
+			Expect(res.Gateway).To(Equal(net.IP{192, 168, 1, 1}))
+			Expect(a.DelegatedPrefix(res.Address.IP).String()).To(Equal("192.168.1.16/28"))
+
+			res, err = a.Get("ID2", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.32/26"))
+			Expect(a.DelegatedPrefix(res.Address.IP).String()).To(Equal("192.168.1.32/28"))
+
+			// The last prefix holds the broadcast address
+			_, err = a.Get("ID3", "eth0", nil)
+			Expect(err).To(HaveOccurred())
+
+			// Reserved under the first IP only
+			Expect(a.store.GetByID("ID", "eth0")).To(Equal([]net.IP{net.ParseIP("192.168.1.16")}))
+		})
+
+		It("should only accept requested IPs that start a prefix", func() {
+			a := mkPrefixAlloc()
+			_, err := a.Get("ID", "eth0", net.IP{192, 168, 1, 17})
+			Expect(err).To(MatchError("requested ip 192.168.1.17 is not the first IP of a /28 prefix that can be delegated from range 192.168.1.1-192.168.1.62"))
+
+			res, err := a.Get("ID", "eth0", net.IP{192, 168, 1, 32})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.32/26"))
+		})
+
+		It("should delegate prefixes of large IPv6 ranges", func() {
+			a := mkalloc()
+			p := RangeSet{Range{Subnet: mustSubnet("2001:db8::/64"), AllocationPrefixLength: 80}}
+			Expect(p.Canonicalize()).To(Succeed())
+			a.rangeset = &p
+			store := &fullStore{FakeStore: a.store.(*fakestore.FakeStore)}
+			a.store = store
+
+			_, err := a.Get("ID", "eth0", nil)
+			Expect(err).To(HaveOccurred())
+			Expect(store.attempts).To(BeNumerically("<=", sequentialProbes+hashedProbes))
+
+			a.store = store.FakeStore
+			res, err := a.Get("ID", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("2001:db8:0:0:1::/64"))
+			Expect(a.DelegatedPrefix(res.Address.IP).String()).To(Equal("2001:db8:0:0:1::/80"))
+		})
+	})
+
+	Context("with the lowestFree strategy", func() {
+		It("should allocate the lowest free IP", func() {
+			a := mkalloc()
+			a.strategy = StrategyLowestFree
+			for _, ip := range []net.IP{{192, 168, 1, 2}, {192, 168, 1, 4}} {
+				reserved, err := a.store.Reserve("other", "eth0", ip, a.rangeID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reserved).To(BeTrue())
+			}
+
+			res, err := a.Get("ID", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).To(Equal(net.IP{192, 168, 1, 3}))
+			res, err = a.Get("ID2", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).To(Equal(net.IP{192, 168, 1, 5}))
+		})
+	})
+
+	Context("with the random strategy", func() {
+		It("should visit every IP of the set once", func() {
+			a := newAllocatorWithMultiRanges()
+			a.strategy = StrategyRandom
+
+			r, err := a.GetIter()
+			Expect(err).NotTo(HaveOccurred())
+			ips := []string{}
+			for ip := r.nextip(); ip != nil; ip = r.nextip() {
+				ips = append(ips, ip.String())
+			}
+			Expect(ips).To(ConsistOf(
+				"192.168.1.0", "192.168.1.1", "192.168.1.2", "192.168.1.3",
+				"192.168.2.0", "192.168.2.1", "192.168.2.2", "192.168.2.3",
+			))
+		})
+	})
+
+	It("should record the pod and time of each allocation", func() {
+		a := mkalloc()
+		a.Configure(&IPAMConfig{Name: "mynet", PodNamespace: "prod", PodName: "db-0"})
+
+		before := time.Now()
+		res, err := a.Get("c1", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		reservations, err := a.store.ListReservations()
+		Expect(err).NotTo(HaveOccurred())
+		var meta *backend.Metadata
+		for _, r := range reservations {
+			if r.IP.Equal(res.Address.IP) {
+				meta = r.Metadata
+			}
+		}
+		Expect(meta).NotTo(BeNil())
+		Expect(meta.Network).To(Equal("mynet"))
+		Expect(meta.PodNamespace).To(Equal("prod"))
+		Expect(meta.PodName).To(Equal("db-0"))
+		Expect(meta.AllocatedAt).To(BeTemporally(">=", before))
+	})
+
+	Context("with a reuse delay", func() {
+		var a IPAllocator
+
+		BeforeEach(func() {
+			a = mkalloc()
+			(*a.rangeset)[0].ReuseDelay = Duration(time.Minute)
+			a.Configure(&IPAMConfig{AllocationStrategy: StrategyLowestFree})
+		})
+
+		release := func(id string) {
+			Expect(a.Hold(id, "eth0")).To(Succeed())
+			Expect(a.Release(id, "eth0")).To(Succeed())
+		}
+
+		It("should skip released IPs until the delay passes", func() {
+			res, err := a.Get("c1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			first := res.Address.IP
+			release("c1")
+			Expect(a.store.GetHeldIPs(reuseDelayKey)).To(Equal([]net.IP{net.ParseIP(first.String())}))
+
+			res, err = a.Get("c2", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).NotTo(Equal(first))
+
+			// Once expired, the lowest free IP is the released one again
+			a.store.(*fakestore.FakeStore).ReleaseExpiredHolds(time.Now().Add(time.Hour))
+			res, err = a.Get("c3", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).To(Equal(first))
+		})
+
+		It("should only hand out requested IPs during the delay if allowed", func() {
+			requested := net.ParseIP("192.168.1.2")
+			_, err := a.Get("c1", "eth0", requested)
+			Expect(err).NotTo(HaveOccurred())
+			release("c1")
+
+			_, err = a.Get("c2", "eth0", requested)
+			Expect(err).To(MatchError("requested IP address 192.168.1.2 was released less than 1m0s ago"))
+
+			(*a.rangeset)[0].OverrideReuseDelay = true
+			res, err := a.Get("c2", "eth0", requested)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP.String()).To(Equal("192.168.1.2"))
+			Expect(a.store.GetHeldIPs(reuseDelayKey)).To(BeEmpty())
+		})
+
+		It("should release IPs right away without a delay", func() {
+			(*a.rangeset)[0].ReuseDelay = 0
+			_, err := a.Get("c1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			release("c1")
+			Expect(a.store.GetHeldIPs(reuseDelayKey)).To(BeEmpty())
+			Expect(a.store.ListReservations()).To(BeEmpty())
+		})
+	})
+
+	Context("with the sticky strategy", func() {
+		var a IPAllocator
+
+		BeforeEach(func() {
+			a = mkalloc()
+			a.Configure(&IPAMConfig{AllocationStrategy: StrategySticky, StickyKey: "db-0"})
+		})
+
+		It("should hand a released IP back to the same workload", func() {
+			res, err := a.Get("c1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			first := res.Address.IP
+
+			Expect(a.Hold("c1", "eth0")).To(Succeed())
+			Expect(a.Release("c1", "eth0")).To(Succeed())
+
+			// Someone else doesn't get it
+			other := mkalloc()
+			other.store = a.store
+			res, err = other.Get("c2", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).NotTo(Equal(first))
+
+			// The restarted workload does
+			res, err = a.Get("c3", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).To(Equal(first))
+			Expect(a.store.GetHeldIPs("db-0/eth0")).To(BeEmpty())
+		})
+
+		It("should make the IP available again after the grace period", func() {
+			a.stickyGrace = -time.Second
+
+			res, err := a.Get("c1", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			first := res.Address.IP
+
+			Expect(a.Hold("c1", "eth0")).To(Succeed())
+			Expect(a.Release("c1", "eth0")).To(Succeed())
+			Expect(a.store.GetHeldIPs("db-0/eth0")).To(BeEmpty())
+
+			// The expired hold is dropped and the workload gets the next IP
+			res, err = a.Get("c3", "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.Address.IP).NotTo(Equal(first))
+			reserved, err := a.store.Reserve("c4", "eth0", first, a.rangeID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		})
+	})
 })
 
 // nextip is a convenience function used for testing
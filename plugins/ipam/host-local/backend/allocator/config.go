@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/version"
@@ -41,6 +42,24 @@ type Net struct {
 	} `json:"args"`
 }
 
+// Allocation strategies, which pick the next free IP of a range set. In
+// large IPv6 range sets, all of them probe IPs spread over the whole set once
+// the next ones are taken.
+const (
+	// StrategyRoundRobin continues after the last reserved IP, so released
+	// IPs are reused as late as possible
+	StrategyRoundRobin = "roundRobin"
+	// StrategyLowestFree takes the lowest free IP, keeping allocations compact
+	StrategyLowestFree = "lowestFree"
+	// StrategyRandom starts looking at a random IP
+	StrategyRandom = "random"
+	// StrategySticky hands a released IP back to the same workload if it
+	// comes back within the grace period, round-robin otherwise
+	StrategySticky = "sticky"
+)
+
+const defaultStickyGracePeriod = 5 * time.Minute
+
 // IPAMConfig represents the IP related network configuration.
 // This nests Range because we initially only supported a single
 // range directly, and wish to preserve backwards compatability
@@ -50,18 +69,58 @@ type IPAMConfig struct {
 	Type       string         `json:"type"`
 	Routes     []*types.Route `json:"routes"`
 	DataDir    string         `json:"dataDir"`
+	Store      string         `json:"store,omitempty"` // The backend keeping the reservations, "disk" by default
 	ResolvConf string         `json:"resolvConf"`
 	Ranges     []RangeSet     `json:"ranges"`
 	IPArgs     []net.IP       `json:"-"` // Requested IPs from CNI_ARGS, args and capabilities
+	// AllocationStrategy applies to the range sets that don't set their own
+	AllocationStrategy string   `json:"allocationStrategy,omitempty"`
+	StickyGracePeriod  Duration `json:"stickyGracePeriod,omitempty"` // Defaults to 5m
+	StickyKey          string   `json:"-"`                           // Workload identity from CNI_ARGS or args
+	// The pod from CNI_ARGS, recorded with the reservations
+	PodNamespace string `json:"-"`
+	PodName      string `json:"-"`
 }
 
 type IPAMEnvArgs struct {
 	types.CommonArgs
-	IP ip.IP `json:"ip,omitempty"`
+	IP                ip.IP                      `json:"ip,omitempty"`
+	K8S_POD_NAMESPACE types.UnmarshallableString `json:"k8sPodNamespace,omitempty"`
+	K8S_POD_NAME      types.UnmarshallableString `json:"k8sPodName,omitempty"`
 }
 
 type IPAMArgs struct {
-	IPs []*ip.IP `json:"ips"`
+	IPs       []*ip.IP `json:"ips"`
+	StickyKey string   `json:"stickyKey,omitempty"`
+}
+
+// Duration is a time.Duration written as a string, e.g. "10m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case "", StrategyRoundRobin, StrategyLowestFree, StrategyRandom, StrategySticky:
+		return nil
+	default:
+		return fmt.Errorf("unknown allocation strategy %q", strategy)
+	}
 }
 
 type RangeSet []Range
@@ -71,10 +130,45 @@ type Range struct {
 	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`   // The last ip, inclusive
 	Subnet     types.IPNet `json:"subnet"`
 	Gateway    net.IP      `json:"gateway,omitempty"`
+	// AllocationStrategy applies to the whole range set this range is in
+	AllocationStrategy string `json:"allocationStrategy,omitempty"`
+	// Exclude lists IPs and CIDRs of the subnet that are never allocated
+	Exclude []string `json:"exclude,omitempty"`
+	// AllocationPrefixLength, if set, makes each attachment get a whole
+	// aligned prefix of that length, reserved under its first IP. The first
+	// IP is the address of the attachment, and the prefix is routed to it.
+	AllocationPrefixLength int `json:"allocationPrefixLength,omitempty"`
+	// ReuseDelay keeps released IPs from being allocated again until it
+	// passes, so stale conntrack and DNS entries can expire first
+	ReuseDelay Duration `json:"reuseDelay,omitempty"`
+	// OverrideReuseDelay lets explicitly requested IPs be allocated during
+	// their reuse delay
+	OverrideReuseDelay bool `json:"overrideReuseDelay,omitempty"`
+
+	// Supernet and NodeSubnetSize replace Subnet when each node of a
+	// cluster allocates from its own part of a shared network
+	Supernet           *types.IPNet `json:"supernet,omitempty"`
+	NodeSubnetSize     int          `json:"nodeSubnetSize,omitempty"`     // Prefix length of the node subnets
+	NodeIndex          *int         `json:"nodeIndex,omitempty"`          // Picks the subnet explicitly
+	NodeName           string       `json:"nodeName,omitempty"`           // Defaults to the hostname
+	NodeSubnetClaimDir string       `json:"nodeSubnetClaimDir,omitempty"` // Shared by the nodes, see claimNodeSubnet
+
+	excluded []net.IPNet // Exclude, parsed by Canonicalize
 }
 
 // NewIPAMConfig creates a NetworkConfig from the given network name.
 func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
+	return loadIPAMConfig(bytes, envArgs, false)
+}
+
+// LoadIPAMConfigForAdd is LoadIPAMConfig for ADD, which also claims a node
+// subnet for the ranges of a supernet this node has none of yet. The other
+// commands must not claim subnets as a side effect.
+func LoadIPAMConfigForAdd(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
+	return loadIPAMConfig(bytes, envArgs, true)
+}
+
+func loadIPAMConfig(bytes []byte, envArgs string, claim bool) (*IPAMConfig, string, error) {
 	n := Net{}
 	if err := json.Unmarshal(bytes, &n); err != nil {
 		return nil, "", err
@@ -95,6 +189,12 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		if e.IP.ToIP() != nil {
 			n.IPAM.IPArgs = []net.IP{e.IP.ToIP()}
 		}
+
+		n.IPAM.PodNamespace = string(e.K8S_POD_NAMESPACE)
+		n.IPAM.PodName = string(e.K8S_POD_NAME)
+		if e.K8S_POD_NAME != "" {
+			n.IPAM.StickyKey = string(e.K8S_POD_NAMESPACE) + "/" + string(e.K8S_POD_NAME)
+		}
 	}
 
 	// parse custom IPs from CNI args in network config
@@ -103,6 +203,16 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 			n.IPAM.IPArgs = append(n.IPAM.IPArgs, i.ToIP())
 		}
 	}
+	if n.Args != nil && n.Args.A != nil && n.Args.A.StickyKey != "" {
+		n.IPAM.StickyKey = n.Args.A.StickyKey
+	}
+
+	if err := validateStrategy(n.IPAM.AllocationStrategy); err != nil {
+		return nil, "", err
+	}
+	if n.IPAM.StickyGracePeriod < 0 {
+		return nil, "", fmt.Errorf("invalid stickyGracePeriod %s", time.Duration(n.IPAM.StickyGracePeriod))
+	}
 
 	// parse custom IPs from runtime configuration
 	if len(n.RuntimeConfig.IPs) > 0 {
@@ -133,6 +243,16 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		return nil, "", fmt.Errorf("no IP ranges specified")
 	}
 
+	if claim {
+		for i := range n.IPAM.Ranges {
+			for j := range n.IPAM.Ranges[i] {
+				if err := n.IPAM.Ranges[i][j].claimNodeSubnet(); err != nil {
+					return nil, "", fmt.Errorf("invalid range set %d: %s", i, err)
+				}
+			}
+		}
+	}
+
 	// Validate all ranges
 	numV4 := 0
 	numV6 := 0
@@ -15,7 +15,9 @@
 package allocator
 
 import (
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	. "github.com/onsi/ginkgo"
@@ -478,4 +480,83 @@ var _ = Describe("IPAM config", func() {
 			net.ParseIP("2001:db8::1"),
 		}))
 	})
+
+	It("Should parse allocation strategies", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"args": {
+				"cni": {
+					"stickyKey": "db-0"
+				}
+			},
+			"ipam": {
+				"type": "host-local",
+				"allocationStrategy": "lowestFree",
+				"stickyGracePeriod": "1h",
+				"ranges": [
+					[{"subnet": "10.1.2.0/24", "reuseDelay": "30s", "overrideReuseDelay": true}],
+					[{"subnet": "10.1.4.0/24", "allocationStrategy": "sticky"}, {"subnet": "10.1.6.0/24"}]
+				]
+			}
+		}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.StickyGracePeriod).To(Equal(Duration(time.Hour)))
+		Expect(conf.Ranges[0][0].ReuseDelay).To(Equal(Duration(30 * time.Second)))
+		Expect(conf.Ranges[0][0].OverrideReuseDelay).To(BeTrue())
+		Expect(conf.Ranges[1][0].ReuseDelay).To(BeZero())
+		Expect(conf.StickyKey).To(Equal("db-0"))
+		Expect(conf.Ranges[0].AllocationStrategy(conf.AllocationStrategy)).To(Equal(StrategyLowestFree))
+		Expect(conf.Ranges[1].AllocationStrategy(conf.AllocationStrategy)).To(Equal(StrategySticky))
+		Expect(conf.Ranges[1].AllocationStrategy("")).To(Equal(StrategySticky))
+		Expect(conf.Ranges[0].AllocationStrategy("")).To(Equal(StrategyRoundRobin))
+	})
+
+	It("Should take the sticky key from the pod in CNI_ARGS", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24"
+			}
+		}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "IgnoreUnknown=1;K8S_POD_NAMESPACE=prod;K8S_POD_NAME=db-0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.StickyKey).To(Equal("prod/db-0"))
+		Expect(conf.PodNamespace).To(Equal("prod"))
+		Expect(conf.PodName).To(Equal("db-0"))
+	})
+
+	It("Should reject invalid allocation strategies", func() {
+		for _, tc := range []struct {
+			ipam string
+			err  string
+		}{
+			{`"allocationStrategy": "leastRecent", "subnet": "10.1.2.0/24"`, `unknown allocation strategy "leastRecent"`},
+			{`"ranges": [[{"subnet": "10.1.2.0/24", "allocationStrategy": "foo"}]]`, `invalid range set 0: unknown allocation strategy "foo"`},
+			{`"ranges": [[{"subnet": "10.1.2.0/24", "allocationStrategy": "random"}, {"subnet": "10.1.4.0/24", "allocationStrategy": "sticky"}]]`,
+				`invalid range set 0: conflicting allocation strategies "random" and "sticky"`},
+			{`"stickyGracePeriod": "-1m", "subnet": "10.1.2.0/24"`, `invalid stickyGracePeriod -1m0s`},
+			{`"ranges": [[{"subnet": "10.1.2.0/24", "reuseDelay": "-1m"}]]`, `invalid range set 0: invalid reuseDelay -1m0s`},
+		} {
+			input := fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					%s
+				}
+			}`, tc.ipam)
+			_, _, err := LoadIPAMConfig([]byte(input), "")
+			Expect(err).To(MatchError(tc.err))
+		}
+	})
 })
@@ -0,0 +1,273 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/utils/filelock"
+)
+
+// nodeSubnetClaim is the content of a claim file of NodeSubnetClaimDir
+type nodeSubnetClaim struct {
+	Node   string `json:"node"`
+	Subnet string `json:"subnet"`
+}
+
+// canonicalizeNodeSubnet sets Subnet to the subnet of Supernet this node
+// allocates from. A Subnet that is already set must be one of them. With a
+// claim directory, it is the subnet claimed by this node, or the one it
+// would claim first if it has none yet: claims are only made on ADD, by
+// claimNodeSubnet.
+func (r *Range) canonicalizeNodeSubnet() error {
+	supernet, err := r.canonicalSupernet()
+	if err != nil {
+		return err
+	}
+
+	if r.Subnet.IP != nil {
+		subnet := net.IPNet(r.Subnet)
+		if err := canonicalizeIP(&subnet.IP); err != nil {
+			return err
+		}
+		subnetOnes, _ := subnet.Mask.Size()
+		if subnetOnes != r.NodeSubnetSize || len(subnet.IP) != len(supernet.IP) || !supernet.Contains(subnet.IP) {
+			return fmt.Errorf("Subnet %s is not a node subnet of supernet %s", subnet.String(), supernet.String())
+		}
+		return nil
+	}
+
+	if r.NodeIndex != nil {
+		ones, _ := supernet.Mask.Size()
+		count := new(big.Int).Lsh(big.NewInt(1), uint(r.NodeSubnetSize-ones))
+		index := big.NewInt(int64(*r.NodeIndex))
+		if index.Sign() < 0 || index.Cmp(count) >= 0 {
+			return fmt.Errorf("nodeIndex %d out of range, supernet %s has %s subnets of size /%d", *r.NodeIndex, supernet.String(), count, r.NodeSubnetSize)
+		}
+		r.Subnet = types.IPNet(nthSubnet(supernet, r.NodeSubnetSize, index))
+		return nil
+	}
+
+	name, index, err := r.nodeSubnetIndex(supernet)
+	if err != nil {
+		return err
+	}
+	if r.NodeSubnetClaimDir != "" {
+		claims, err := readNodeSubnetClaims(r.NodeSubnetClaimDir, supernet, r.NodeSubnetSize)
+		if err != nil {
+			return err
+		}
+		if subnet, ok := claims[name]; ok {
+			r.Subnet = types.IPNet(*subnet)
+			return nil
+		}
+	}
+	// Without a claim directory two nodes may hash to the same subnet, the
+	// supernet should have many more subnets than the cluster has nodes
+	r.Subnet = types.IPNet(nthSubnet(supernet, r.NodeSubnetSize, index))
+	return nil
+}
+
+// claimNodeSubnet claims a subnet of Supernet for this node in the claim
+// directory, if the range has one and the node has no subnet there yet.
+// Canonicalize then picks the claim up.
+func (r *Range) claimNodeSubnet() error {
+	if r.Supernet == nil || r.Subnet.IP != nil || r.NodeIndex != nil || r.NodeSubnetClaimDir == "" {
+		return nil
+	}
+	supernet, err := r.canonicalSupernet()
+	if err != nil {
+		return err
+	}
+	name, index, err := r.nodeSubnetIndex(supernet)
+	if err != nil {
+		return err
+	}
+	subnet, err := claimNodeSubnet(r.NodeSubnetClaimDir, name, supernet, r.NodeSubnetSize, index)
+	if err != nil {
+		return err
+	}
+	r.Subnet = types.IPNet(*subnet)
+	return nil
+}
+
+// canonicalSupernet returns Supernet once checked against NodeSubnetSize
+func (r *Range) canonicalSupernet() (net.IPNet, error) {
+	supernet := net.IPNet(*r.Supernet)
+	if err := canonicalizeIP(&supernet.IP); err != nil {
+		return supernet, err
+	}
+	if len(supernet.IP) != len(supernet.Mask) {
+		return supernet, fmt.Errorf("Supernet IP and Mask version mismatch")
+	}
+	if !supernet.IP.Equal(supernet.IP.Mask(supernet.Mask)) {
+		return supernet, fmt.Errorf("Supernet %s has host bits set", supernet.String())
+	}
+
+	ones, bits := supernet.Mask.Size()
+	if r.NodeSubnetSize <= ones || r.NodeSubnetSize > bits {
+		return supernet, fmt.Errorf("nodeSubnetSize %d does not fit in supernet %s", r.NodeSubnetSize, supernet.String())
+	}
+	return supernet, nil
+}
+
+// nodeSubnetIndex returns the name of this node and the index of the node
+// subnet of supernet it hashes to
+func (r *Range) nodeSubnetIndex(supernet net.IPNet) (string, *big.Int, error) {
+	name := r.NodeName
+	if name == "" {
+		var err error
+		if name, err = os.Hostname(); err != nil {
+			return "", nil, fmt.Errorf("failed to get the node name: %v", err)
+		}
+	}
+
+	ones, _ := supernet.Mask.Size()
+	count := new(big.Int).Lsh(big.NewInt(1), uint(r.NodeSubnetSize-ones))
+	sum := sha256.Sum256([]byte(name))
+	return name, new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), count), nil
+}
+
+// nthSubnet returns the subnet of prefix length size at index in supernet
+func nthSubnet(supernet net.IPNet, size int, index *big.Int) net.IPNet {
+	_, bits := supernet.Mask.Size()
+	offset := new(big.Int).Lsh(index, uint(bits-size))
+	return net.IPNet{
+		IP:   intToIP(offset.Add(offset, ipToInt(supernet.IP)), len(supernet.IP)),
+		Mask: net.CIDRMask(size, bits),
+	}
+}
+
+// readNodeSubnetClaims returns the node subnets of supernet claimed in dir,
+// by node name
+func readNodeSubnetClaims(dir string, supernet net.IPNet, size int) (map[string]*net.IPNet, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	claims := map[string]*net.IPNet{}
+	for _, fi := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		claim := nodeSubnetClaim{}
+		if err := json.Unmarshal(data, &claim); err != nil {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(claim.Subnet)
+		if err != nil {
+			continue
+		}
+		if ones, _ := subnet.Mask.Size(); ones != size || !supernet.Contains(subnet.IP) {
+			continue
+		}
+		claims[claim.Node] = subnet
+	}
+	return claims, nil
+}
+
+// claimNodeSubnet returns the subnet claimed by node in dir, a directory
+// shared by all nodes. If node has none yet, it claims the first free one
+// starting at index. Claims are files named after the subnets, created
+// under the lock of dir, and are never released.
+func claimNodeSubnet(dir, node string, supernet net.IPNet, size int, index *big.Int) (*net.IPNet, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := filelock.NewFileLock(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	claims, err := readNodeSubnetClaims(dir, supernet, size)
+	if err != nil {
+		return nil, err
+	}
+	if subnet, ok := claims[node]; ok {
+		return subnet, nil
+	}
+	taken := map[string]bool{}
+	for _, subnet := range claims {
+		taken[subnet.String()] = true
+	}
+
+	ones, _ := supernet.Mask.Size()
+	count := new(big.Int).Lsh(big.NewInt(1), uint(size-ones))
+	one := big.NewInt(1)
+	for tries := 0; tries <= len(taken); tries++ {
+		subnet := nthSubnet(supernet, size, index)
+		if !taken[subnet.String()] {
+			data, err := json.Marshal(&nodeSubnetClaim{Node: node, Subnet: subnet.String()})
+			if err != nil {
+				return nil, err
+			}
+			fname := strings.NewReplacer("/", "_", ":", "_").Replace(subnet.String())
+			if err := writeClaim(filepath.Join(dir, fname), data); err != nil {
+				return nil, err
+			}
+			return &subnet, nil
+		}
+		index.Add(index, one)
+		if index.Cmp(count) >= 0 {
+			index.SetInt64(0)
+		}
+		if big.NewInt(int64(tries+1)).Cmp(count) >= 0 {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no free node subnet left in supernet %s", supernet.String())
+}
+
+// writeClaim writes a claim file in a temporary file renamed into place, as
+// claims are read without the lock
+func writeClaim(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("node subnet claim %s already exists", path)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".claim")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
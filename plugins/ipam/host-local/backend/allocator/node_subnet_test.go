@@ -0,0 +1,189 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Node subnets", func() {
+	supernet := func(s string) *types.IPNet {
+		n := mustSubnet(s)
+		return &n
+	}
+
+	It("should carve the subnet of an explicit index", func() {
+		index := 3
+		r := Range{Supernet: supernet("10.0.0.0/16"), NodeSubnetSize: 24, NodeIndex: &index}
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r.Subnet).To(Equal(networkSubnet("10.0.3.0/24")))
+		Expect(r.RangeStart).To(Equal(net.IP{10, 0, 3, 1}))
+		Expect(r.Gateway).To(Equal(net.IP{10, 0, 3, 1}))
+
+		// Canonicalizing again keeps the subnet
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r.Subnet).To(Equal(networkSubnet("10.0.3.0/24")))
+
+		index = 4
+		r = Range{Supernet: supernet("2001:db8::/48"), NodeSubnetSize: 64, NodeIndex: &index}
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r.Subnet).To(Equal(networkSubnet("2001:db8:0:4::/64")))
+	})
+
+	It("should derive the subnet from the node name", func() {
+		r1 := Range{Supernet: supernet("10.0.0.0/8"), NodeSubnetSize: 24, NodeName: "node-1"}
+		Expect(r1.Canonicalize()).To(Succeed())
+		r2 := Range{Supernet: supernet("10.0.0.0/8"), NodeSubnetSize: 24, NodeName: "node-1"}
+		Expect(r2.Canonicalize()).To(Succeed())
+		Expect(r1.Subnet).To(Equal(r2.Subnet))
+
+		r3 := Range{Supernet: supernet("10.0.0.0/8"), NodeSubnetSize: 24, NodeName: "node-2"}
+		Expect(r3.Canonicalize()).To(Succeed())
+		Expect(r3.Subnet).NotTo(Equal(r1.Subnet))
+	})
+
+	It("should claim distinct subnets in a shared directory", func() {
+		dir, err := ioutil.TempDir("", "node_subnets")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		subnets := map[string]string{}
+		for _, node := range []string{"node-1", "node-2", "node-3", "node-4", "node-1"} {
+			r := Range{Supernet: supernet("10.0.0.0/22"), NodeSubnetSize: 24, NodeName: node, NodeSubnetClaimDir: dir}
+			Expect(r.claimNodeSubnet()).To(Succeed())
+			Expect(r.Canonicalize()).To(Succeed())
+			subnet := (*net.IPNet)(&r.Subnet).String()
+			if prev, ok := subnets[node]; ok {
+				Expect(subnet).To(Equal(prev))
+			}
+			subnets[node] = subnet
+		}
+		Expect(subnets).To(HaveLen(4))
+		Expect(subnets).To(ConsistOf("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"))
+
+		r := Range{Supernet: supernet("10.0.0.0/22"), NodeSubnetSize: 24, NodeName: "node-5", NodeSubnetClaimDir: dir}
+		Expect(r.claimNodeSubnet()).To(MatchError("no free node subnet left in supernet 10.0.0.0/22"))
+	})
+
+	It("should write claims whole, and skip partial ones", func() {
+		dir, err := ioutil.TempDir("", "node_subnets")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		// Left over by a node that crashed while claiming
+		Expect(ioutil.WriteFile(filepath.Join(dir, ".claim123"), []byte(`{"node": "node-2", "sub`), 0644)).To(Succeed())
+
+		r := Range{Supernet: supernet("10.0.0.0/22"), NodeSubnetSize: 24, NodeName: "node-1", NodeSubnetClaimDir: dir}
+		Expect(r.claimNodeSubnet()).To(Succeed())
+		claims, err := readNodeSubnetClaims(dir, net.IPNet(*supernet("10.0.0.0/22")), 24)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(claims).To(HaveLen(1))
+		Expect(claims).To(HaveKey("node-1"))
+
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		fname := strings.NewReplacer("/", "_").Replace((*net.IPNet)(&r.Subnet).String())
+		Expect(names).To(ConsistOf(".claim123", "lock", fname))
+	})
+
+	It("should reject invalid node subnets", func() {
+		r := Range{Supernet: supernet("10.0.0.0/16"), NodeSubnetSize: 16}
+		Expect(r.Canonicalize()).To(MatchError("nodeSubnetSize 16 does not fit in supernet 10.0.0.0/16"))
+
+		index := 256
+		r = Range{Supernet: supernet("10.0.0.0/16"), NodeSubnetSize: 24, NodeIndex: &index}
+		Expect(r.Canonicalize()).To(MatchError("nodeIndex 256 out of range, supernet 10.0.0.0/16 has 256 subnets of size /24"))
+
+		r = Range{Supernet: supernet("10.0.0.0/16"), NodeSubnetSize: 24, Subnet: mustSubnet("10.1.0.0/24")}
+		Expect(r.Canonicalize()).To(MatchError("Subnet 10.1.0.0/24 is not a node subnet of supernet 10.0.0.0/16"))
+	})
+
+	It("should load a config with a supernet", func() {
+		input := `{
+	"cniVersion": "0.3.1",
+	"name": "mynet",
+	"type": "ipvlan",
+	"master": "foo0",
+	"ipam": {
+		"type": "host-local",
+		"ranges": [[{"supernet": "10.0.0.0/16", "nodeSubnetSize": 24, "nodeIndex": 7}]]
+	}
+}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Ranges[0][0].Subnet).To(Equal(networkSubnet("10.0.7.0/24")))
+	})
+
+	It("should only claim a subnet when loading the config for ADD", func() {
+		dir, err := ioutil.TempDir("", "node_subnets")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		input := fmt.Sprintf(`{
+	"cniVersion": "0.3.1",
+	"name": "mynet",
+	"type": "ipvlan",
+	"master": "foo0",
+	"ipam": {
+		"type": "host-local",
+		"ranges": [[{"supernet": "10.0.0.0/22", "nodeSubnetSize": 24, "nodeName": "node-1", "nodeSubnetClaimDir": "%s"}]]
+	}
+}`, dir)
+		expectClaims := func(n int) {
+			claims, err := readNodeSubnetClaims(dir, net.IPNet(*supernet("10.0.0.0/22")), 24)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(claims).To(HaveLen(n))
+		}
+
+		_, _, err = LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		expectClaims(0)
+
+		// Leave a single subnet to node-1
+		for i, node := range []string{"node-2", "node-3", "node-4"} {
+			_, err := claimNodeSubnet(dir, node, net.IPNet(*supernet("10.0.0.0/22")), 24, big.NewInt(int64(i)))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		_, _, err = LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		expectClaims(3)
+
+		conf, _, err := LoadIPAMConfigForAdd([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Ranges[0][0].Subnet).To(Equal(networkSubnet("10.0.3.0/24")))
+		expectClaims(4)
+
+		// Once claimed, all commands use the subnet
+		conf, _, err = LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Ranges[0][0].Subnet).To(Equal(networkSubnet("10.0.3.0/24")))
+	})
+})
@@ -16,7 +16,10 @@ package allocator
 
 import (
 	"fmt"
+	"math/big"
 	"net"
+	"sort"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ip"
@@ -25,6 +28,12 @@ import (
 // Canonicalize takes a given range and ensures that all information is consistent,
 // filling out Start, End, and Gateway with sane values if missing
 func (r *Range) Canonicalize() error {
+	if r.Supernet != nil {
+		if err := r.canonicalizeNodeSubnet(); err != nil {
+			return err
+		}
+	}
+
 	if err := canonicalizeIP(&r.Subnet.IP); err != nil {
 		return err
 	}
@@ -84,9 +93,72 @@ func (r *Range) Canonicalize() error {
 		r.RangeEnd = lastIP(r.Subnet)
 	}
 
+	// Exclude: single IPs or CIDRs, all inside the subnet
+	r.excluded = nil
+	for _, e := range r.Exclude {
+		n, err := parseExclude(e)
+		if err != nil {
+			return err
+		}
+		subnet := (net.IPNet)(r.Subnet)
+		subnetOnes, _ := r.Subnet.Mask.Size()
+		ones, _ := n.Mask.Size()
+		if len(n.IP) != len(r.Subnet.IP) || !subnet.Contains(n.IP) || ones < subnetOnes {
+			return fmt.Errorf("Exclude %s not in network %s", e, subnet.String())
+		}
+		r.excluded = append(r.excluded, *n)
+	}
+
+	if r.AllocationPrefixLength != 0 {
+		ones, bits := r.Subnet.Mask.Size()
+		if r.AllocationPrefixLength <= ones || r.AllocationPrefixLength > bits {
+			return fmt.Errorf("allocationPrefixLength %d does not fit in network %s", r.AllocationPrefixLength, (*net.IPNet)(&r.Subnet).String())
+		}
+	}
+
+	if r.ReuseDelay < 0 {
+		return fmt.Errorf("invalid reuseDelay %s", time.Duration(r.ReuseDelay))
+	}
+
 	return nil
 }
 
+// parseExclude parses an entry of Exclude, a single IP being its own block
+func parseExclude(e string) (*net.IPNet, error) {
+	if addr := net.ParseIP(e); addr != nil {
+		if err := canonicalizeIP(&addr); err != nil {
+			return nil, err
+		}
+		bits := len(addr) * 8
+		return &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(e)
+	if err != nil {
+		return nil, fmt.Errorf("Exclude %q is neither an IP nor a CIDR", e)
+	}
+	return n, nil
+}
+
+// excludedUntil returns the last IP of the excluded block addr is in,
+// capped to RangeEnd, or nil if addr is not excluded. Overlapping blocks
+// are merged so that the iterator can jump over them at once.
+func (r *Range) excludedUntil(addr net.IP) net.IP {
+	var end net.IP
+	for _, n := range r.excluded {
+		if !n.Contains(addr) {
+			continue
+		}
+		last := blockEnd(n)
+		if end == nil || ip.Cmp(last, end) > 0 {
+			end = last
+		}
+	}
+	if end != nil && r.RangeEnd != nil && ip.Cmp(end, r.RangeEnd) > 0 {
+		end = r.RangeEnd
+	}
+	return end
+}
+
 // IsValidIP checks if a given ip is a valid, allocatable address in a given Range
 func (r *Range) Contains(addr net.IP) bool {
 	if err := canonicalizeIP(&addr); err != nil {
@@ -136,6 +208,133 @@ func (r *Range) Overlaps(r1 *Range) bool {
 		r1.Contains(r.RangeEnd)
 }
 
+// blockEnd returns the last IP of n
+func blockEnd(n net.IPNet) net.IP {
+	last := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		last[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return last
+}
+
+// Capacity returns the number of IPs of the range that can be allocated,
+// leaving out the gateway and the excluded addresses. For ranges that
+// delegate prefixes, it is the number of prefixes that can be.
+func (r *Range) Capacity() *big.Int {
+	shift := uint(0)
+	if r.AllocationPrefixLength != 0 {
+		shift = uint(len(r.RangeStart)*8 - r.AllocationPrefixLength)
+	}
+	unit := new(big.Int).Lsh(big.NewInt(1), shift)
+
+	// Units that fit in the range, from first to last
+	first := new(big.Int).Add(ipToInt(r.RangeStart), unit)
+	first.Sub(first, big.NewInt(1)).Rsh(first, shift)
+	last := new(big.Int).Add(ipToInt(r.RangeEnd), big.NewInt(1))
+	last.Rsh(last, shift).Sub(last, big.NewInt(1))
+	capacity := new(big.Int).Sub(last, first)
+	capacity.Add(capacity, big.NewInt(1))
+	if capacity.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	// The units holding the gateway or excluded IPs. Blocks may overlap,
+	// walk them in order to count each unit once.
+	type block struct{ start, end *big.Int }
+	var blocks []block
+	addBlock := func(start, end net.IP) {
+		b := block{new(big.Int).Rsh(ipToInt(start), shift), new(big.Int).Rsh(ipToInt(end), shift)}
+		if b.start.Cmp(first) < 0 {
+			b.start = first
+		}
+		if b.end.Cmp(last) > 0 {
+			b.end = last
+		}
+		if b.start.Cmp(b.end) <= 0 {
+			blocks = append(blocks, b)
+		}
+	}
+	for _, n := range r.excluded {
+		addBlock(n.IP, blockEnd(n))
+	}
+	if len(r.Gateway) == len(r.RangeStart) {
+		addBlock(r.Gateway, r.Gateway)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].start.Cmp(blocks[j].start) < 0 })
+	next := first // The first unit not counted yet
+	for _, b := range blocks {
+		if b.start.Cmp(next) < 0 {
+			b.start = next
+		}
+		if b.start.Cmp(b.end) > 0 {
+			continue
+		}
+		capacity.Sub(capacity, new(big.Int).Sub(b.end, b.start))
+		capacity.Sub(capacity, big.NewInt(1))
+		next = new(big.Int).Add(b.end, big.NewInt(1))
+	}
+	return capacity
+}
+
+// prefixMask returns the mask of the delegated prefixes, if the range
+// delegates any
+func (r *Range) prefixMask() net.IPMask {
+	return net.CIDRMask(r.AllocationPrefixLength, len(r.Subnet.IP)*8)
+}
+
+// unusableUntil returns the last IP of the block starting at addr that
+// can't be allocated, capped to RangeEnd, or nil if addr can be. When the
+// range delegates prefixes, only the first IPs of the aligned prefixes that
+// fit in the range and hold neither the gateway nor excluded IPs can be.
+func (r *Range) unusableUntil(addr net.IP) net.IP {
+	if end := r.excludedUntil(addr); end != nil {
+		return end
+	}
+	if r.AllocationPrefixLength == 0 {
+		return nil
+	}
+
+	prefix := net.IPNet{IP: addr.Mask(r.prefixMask()), Mask: r.prefixMask()}
+	end := blockEnd(prefix)
+	usable := prefix.IP.Equal(addr) && ip.Cmp(prefix.IP, r.RangeStart) >= 0 && ip.Cmp(end, r.RangeEnd) <= 0 &&
+		!prefix.Contains(r.Gateway)
+	for _, n := range r.excluded {
+		if prefix.Contains(n.IP) || n.Contains(prefix.IP) {
+			usable = false
+		}
+	}
+	if usable {
+		return nil
+	}
+	if ip.Cmp(end, r.RangeEnd) > 0 {
+		end = r.RangeEnd
+	}
+	return end
+}
+
+// size returns the number of IPs between RangeStart and RangeEnd
+func (r *Range) size() *big.Int {
+	size := new(big.Int).Sub(ipToInt(r.RangeEnd), ipToInt(r.RangeStart))
+	return size.Add(size, big.NewInt(1))
+}
+
+// ipAt returns the IP offset IPs after RangeStart
+func (r *Range) ipAt(offset *big.Int) net.IP {
+	i := new(big.Int).Add(ipToInt(r.RangeStart), offset)
+	return intToIP(i, len(r.RangeStart))
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(ip)
+}
+
+func intToIP(i *big.Int, length int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, length)
+	copy(ip[length-len(b):], b)
+	return ip
+}
+
 func (r *Range) String() string {
 	return fmt.Sprintf("%s-%s", r.RangeStart.String(), r.RangeEnd.String())
 }
@@ -16,6 +16,7 @@ package allocator
 
 import (
 	"fmt"
+	"math/big"
 	"net"
 	"strings"
 )
@@ -61,10 +62,20 @@ func (s *RangeSet) Canonicalize() error {
 	}
 
 	fam := 0
+	strategy := ""
 	for i := range *s {
 		if err := (*s)[i].Canonicalize(); err != nil {
 			return err
 		}
+		if rs := (*s)[i].AllocationStrategy; rs != "" {
+			if err := validateStrategy(rs); err != nil {
+				return err
+			}
+			if strategy != "" && rs != strategy {
+				return fmt.Errorf("conflicting allocation strategies %q and %q", strategy, rs)
+			}
+			strategy = rs
+		}
 		if i == 0 {
 			fam = len((*s)[i].RangeStart)
 		} else {
@@ -87,6 +98,52 @@ func (s *RangeSet) Canonicalize() error {
 	return nil
 }
 
+// AllocationStrategy returns the allocation strategy set by the ranges of
+// this set, or def if they don't set one
+func (s *RangeSet) AllocationStrategy(def string) string {
+	for _, r := range *s {
+		if r.AllocationStrategy != "" {
+			return r.AllocationStrategy
+		}
+	}
+	if def != "" {
+		return def
+	}
+	return StrategyRoundRobin
+}
+
+// size returns the number of IPs of all ranges in this set
+func (s *RangeSet) size() *big.Int {
+	total := big.NewInt(0)
+	for _, r := range *s {
+		total.Add(total, r.size())
+	}
+	return total
+}
+
+// ipAt returns the index of the range holding the IP offset IPs after the
+// start of the set, the ranges being laid end to end, and that IP
+func (s *RangeSet) ipAt(offset *big.Int) (int, net.IP) {
+	n := new(big.Int).Set(offset)
+	for idx, r := range *s {
+		size := r.size()
+		if n.Cmp(size) < 0 {
+			return idx, r.ipAt(n)
+		}
+		n.Sub(n, size)
+	}
+	return -1, nil
+}
+
+// isLargeIPv6 returns true for IPv6 sets holding more than
+// largeRangeSetSize IPs
+func (s *RangeSet) isLargeIPv6() bool {
+	if (*s)[0].RangeStart.To4() != nil {
+		return false
+	}
+	return s.size().Cmp(big.NewInt(largeRangeSetSize)) > 0
+}
+
 func (s *RangeSet) String() string {
 	out := []string{}
 	for _, r := range *s {
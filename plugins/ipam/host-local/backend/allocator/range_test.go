@@ -140,6 +140,81 @@ var _ = Describe("IP ranges", func() {
 		}))
 	})
 
+	It("should parse excluded IPs and CIDRs", func() {
+		r := Range{
+			Subnet:  mustSubnet("192.0.2.0/24"),
+			Exclude: []string{"192.0.2.10", "192.0.2.64/26"},
+		}
+		err := r.Canonicalize()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(r.excludedUntil(net.ParseIP("192.0.2.9"))).To(BeNil())
+		Expect(r.excludedUntil(net.ParseIP("192.0.2.10"))).To(Equal(net.IP{192, 0, 2, 10}))
+		Expect(r.excludedUntil(net.ParseIP("192.0.2.100"))).To(Equal(net.IP{192, 0, 2, 127}))
+		Expect(r.excludedUntil(net.ParseIP("192.0.2.128"))).To(BeNil())
+	})
+
+	It("should reject invalid exclusions", func() {
+		r := Range{Subnet: mustSubnet("192.0.2.0/24"), Exclude: []string{"192.0.3.10"}}
+		Expect(r.Canonicalize()).To(MatchError("Exclude 192.0.3.10 not in network 192.0.2.0/24"))
+
+		r = Range{Subnet: mustSubnet("192.0.2.0/24"), Exclude: []string{"192.0.0.0/16"}}
+		Expect(r.Canonicalize()).To(MatchError("Exclude 192.0.0.0/16 not in network 192.0.2.0/24"))
+
+		r = Range{Subnet: mustSubnet("192.0.2.0/24"), Exclude: []string{"2001:db8::1"}}
+		Expect(r.Canonicalize()).To(MatchError("Exclude 2001:db8::1 not in network 192.0.2.0/24"))
+
+		r = Range{Subnet: mustSubnet("192.0.2.0/24"), Exclude: []string{"foo"}}
+		Expect(r.Canonicalize()).To(MatchError(`Exclude "foo" is neither an IP nor a CIDR`))
+	})
+
+	It("should count the IPs that can be allocated", func() {
+		r := Range{Subnet: mustSubnet("192.0.2.0/24")}
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r.Capacity().Int64()).To(Equal(int64(253)))
+
+		// Overlapping blocks, one of them holding the gateway, and one
+		// reaching past the end of the range
+		r = Range{
+			Subnet:     mustSubnet("192.0.2.0/24"),
+			RangeStart: net.ParseIP("192.0.2.0"),
+			RangeEnd:   net.ParseIP("192.0.2.100"),
+			Exclude:    []string{"192.0.2.0/30", "192.0.2.2", "192.0.2.64/26"},
+		}
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r.Capacity().Int64()).To(Equal(int64(101 - 4 - 37)))
+
+		r = Range{Subnet: mustSubnet("2001:db8::/64")}
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r.Capacity().String()).To(Equal("18446744073709551614"))
+	})
+
+	It("should delegate aligned prefixes", func() {
+		r := Range{
+			Subnet:                 mustSubnet("192.0.2.0/24"),
+			AllocationPrefixLength: 28,
+			Exclude:                []string{"192.0.2.40"},
+		}
+		Expect(r.Canonicalize()).To(Succeed())
+
+		// The first prefix holds the gateway, the third an excluded IP,
+		// and the last the broadcast address
+		Expect(r.Capacity().Int64()).To(Equal(int64(13)))
+		Expect(r.unusableUntil(net.ParseIP("192.0.2.1"))).To(Equal(net.IP{192, 0, 2, 15}))
+		Expect(r.unusableUntil(net.ParseIP("192.0.2.16"))).To(BeNil())
+		Expect(r.unusableUntil(net.ParseIP("192.0.2.17"))).To(Equal(net.IP{192, 0, 2, 31}))
+		Expect(r.unusableUntil(net.ParseIP("192.0.2.32"))).To(Equal(net.IP{192, 0, 2, 47}))
+		Expect(r.unusableUntil(net.ParseIP("192.0.2.240"))).To(Equal(net.IP{192, 0, 2, 254}))
+
+		r = Range{Subnet: mustSubnet("2001:db8::/64"), AllocationPrefixLength: 80}
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r.Capacity().Int64()).To(Equal(int64(65535)))
+		Expect(r.prefixMask()).To(Equal(net.CIDRMask(80, 128)))
+
+		r = Range{Subnet: mustSubnet("192.0.2.0/24"), AllocationPrefixLength: 24}
+		Expect(r.Canonicalize()).To(MatchError("allocationPrefixLength 24 does not fit in network 192.0.2.0/24"))
+	})
+
 	It("should accept v4 IPs in range and reject IPs out of range", func() {
 		r := Range{
 			Subnet:     mustSubnet("192.0.2.0/24"),
@@ -21,7 +21,9 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/containernetworking/plugins/pkg/utils/filelock"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 )
 
@@ -31,10 +33,15 @@ const LineBreak = "\r\n"
 var defaultDataDir = "/var/lib/cni/networks"
 
 // Store is a simple disk-backed store that creates one file per IP
-// address in a given directory. The contents of the file are the container ID.
+// address in a given directory. The contents of the file are the container ID
+// and the interface name, older versions only wrote the ID. The metadata of
+// the reservation is kept in a separate file, see metadataDirName.
+// An index of the IPs of each container is kept alongside, so lookups by
+// container don't need to read every file.
 type Store struct {
-	*FileLock
-	dataDir string
+	*filelock.FileLock
+	dataDir     string
+	indexSynced bool // The index was reconciled since the lock was taken
 }
 
 // Store implements the Store interface
@@ -44,35 +51,90 @@ func New(network, dataDir string) (*Store, error) {
 	if dataDir == "" {
 		dataDir = defaultDataDir
 	}
-	dir := filepath.Join(dataDir, network)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(dataDir, network), 0755); err != nil {
 		return nil, err
 	}
+	return Open(network, dataDir)
+}
 
-	lk, err := NewFileLock(dir)
+// Open is New for the commands that only read the store: it fails rather
+// than create the directory of the network if it is missing
+func Open(network, dataDir string) (*Store, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	dir := filepath.Join(dataDir, network)
+	lk, err := filelock.NewFileLock(dir)
 	if err != nil {
 		return nil, err
 	}
-	return &Store{lk, dir}, nil
+	return &Store{FileLock: lk, dataDir: dir}, nil
+}
+
+// Lock takes the lock and brings the index up to date with the data
+// directory, see reconcileIndex
+func (s *Store) Lock() error {
+	if err := s.FileLock.Lock(); err != nil {
+		return err
+	}
+	if err := s.reconcileIndex(); err != nil {
+		s.FileLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unlock records that the index reflects the changes made under the lock,
+// and releases it
+func (s *Store) Unlock() error {
+	err := s.syncIndex()
+	if unlockErr := s.FileLock.Unlock(); unlockErr != nil {
+		return unlockErr
+	}
+	return err
 }
 
 func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
-	fname := GetEscapedPath(s.dataDir, ip.String())
+	return s.ReserveWithMetadata(id, ifname, ip, rangeID, backend.Metadata{})
+}
 
-	f, err := os.OpenFile(fname, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
-	if os.IsExist(err) {
+func (s *Store) ReserveWithMetadata(id string, ifname string, ip net.IP, rangeID string, meta backend.Metadata) (bool, error) {
+	if meta.AllocatedAt.IsZero() {
+		meta.AllocatedAt = time.Now()
+	}
+
+	fname := GetEscapedPath(s.dataDir, ip.String())
+	if _, err := os.Stat(fname); err == nil {
 		return false, nil
 	}
-	if err != nil {
+
+	// The index and metadata are written first, so that an interrupted
+	// reservation leaves entries lookups ignore rather than a reservation
+	// the index misses
+	if err := s.addToIndex(id, ifname, ip); err != nil {
 		return false, err
 	}
-	if _, err := f.WriteString(strings.TrimSpace(id) + LineBreak + ifname); err != nil {
-		f.Close()
-		os.Remove(f.Name())
+	if err := s.writeMetadata(id, ifname, ip, meta); err != nil {
+		s.removeFromIndex(id, ifname, ip)
 		return false, err
 	}
-	if err := f.Close(); err != nil {
-		os.Remove(f.Name())
+
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err == nil {
+		_, err = f.WriteString(strings.TrimSpace(id) + LineBreak + ifname)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(fname)
+		}
+	}
+	if err != nil {
+		s.removeMetadata(ip)
+		s.removeFromIndex(id, ifname, ip)
 		return false, err
 	}
 	// store the reserved ip in lastIPFile
@@ -95,27 +157,37 @@ func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
 }
 
 func (s *Store) Release(ip net.IP) error {
-	return os.Remove(GetEscapedPath(s.dataDir, ip.String()))
+	fname := GetEscapedPath(s.dataDir, ip.String())
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fname); err != nil {
+		return err
+	}
+	id, ifname := parseReservation(data)
+	if _, held := heldFor(id); held {
+		if err := os.Remove(s.holdPath(ip)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := s.removeMetadata(ip); err != nil {
+		return err
+	}
+	return s.removeFromIndex(id, ifname, ip)
 }
 
-func (s *Store) FindByKey(id string, ifname string, match string) (bool, error) {
-	found := false
-
-	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			return nil
-		}
-		if strings.TrimSpace(string(data)) == match {
-			found = true
-		}
-		return nil
-	})
-	return found, err
+// splitKey returns the container ID and interface name a FindByKey or
+// ReleaseByKey match stands for
+func splitKey(id string, match string) (string, string) {
+	if match == strings.TrimSpace(id) {
+		return match, ""
+	}
+	return parseReservation([]byte(match))
+}
 
+func (s *Store) FindByKey(id string, ifname string, match string) (bool, error) {
+	return len(s.lookupIndex(splitKey(id, match))) > 0, nil
 }
 
 func (s *Store) FindByID(id string, ifname string) bool {
@@ -136,25 +208,22 @@ func (s *Store) FindByID(id string, ifname string) bool {
 }
 
 func (s *Store) ReleaseByKey(id string, ifname string, match string) (bool, error) {
+	keyID, keyIfName := splitKey(id, match)
+
 	found := false
-	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
+	for _, ip := range s.lookupIndex(keyID, keyIfName) {
+		if err := os.Remove(GetEscapedPath(s.dataDir, ip.String())); err != nil {
+			continue
 		}
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			return nil
-		}
-		if strings.TrimSpace(string(data)) == match {
-			if err := os.Remove(path); err != nil {
-				return nil
-			}
-			found = true
-		}
-		return nil
-	})
-	return found, err
+		s.removeMetadata(ip)
+		found = true
+	}
 
+	// Drop the whole entry, IPs that failed verification are stale
+	if err := os.Remove(s.indexPath(keyID, keyIfName)); err != nil && !os.IsNotExist(err) {
+		return found, err
+	}
+	return found, nil
 }
 
 // N.B. This function eats errors to be tolerant and
@@ -174,31 +243,50 @@ func (s *Store) ReleaseByID(id string, ifname string) error {
 
 // GetByID returns the IPs which have been allocated to the specific ID
 func (s *Store) GetByID(id string, ifname string) []net.IP {
-	var ips []net.IP
+	ips := s.lookupIndex(id, ifname)
+	if ifname != "" {
+		// include files written by a previous version, which only hold the id
+		ips = append(ips, s.lookupIndex(id, "")...)
+	}
+	return ips
+}
 
-	match := strings.TrimSpace(id) + LineBreak + ifname
-	// matchOld for backwards compatibility
-	matchOld := strings.TrimSpace(id)
+// ListReservations returns all IPs reserved in this network
+func (s *Store) ListReservations() ([]backend.Reservation, error) {
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
 
-	// walk through all ips in this network to get the ones which belong to a specific ID
-	_ = filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
+	var reservations []backend.Reservation
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
 		}
-		data, err := ioutil.ReadFile(path)
+		ip := reservationIP(fi.Name())
+		if ip == nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dataDir, fi.Name()))
 		if err != nil {
-			return nil
+			continue
 		}
-		if strings.TrimSpace(string(data)) == match || strings.TrimSpace(string(data)) == matchOld {
-			_, ipString := filepath.Split(path)
-			if ip := net.ParseIP(ipString); ip != nil {
-				ips = append(ips, ip)
-			}
+		id, ifname := parseReservation(data)
+		if key, held := heldFor(id); held {
+			reservations = append(reservations, backend.Reservation{
+				IP:      ip,
+				HeldFor: key,
+			})
+			continue
 		}
-		return nil
-	})
-
-	return ips
+		reservations = append(reservations, backend.Reservation{
+			IP:          ip,
+			ContainerID: id,
+			IfName:      ifname,
+			Metadata:    s.readMetadata(id, ifname, ip),
+		})
+	}
+	return reservations, nil
 }
 
 func GetEscapedPath(dataDir string, fname string) string {
@@ -0,0 +1,304 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store Operations", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "disk_test")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	writeReservation := func(ip, content string) {
+		dir := filepath.Join(dataDir, "mynet")
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(GetEscapedPath(dir, ip), []byte(content), 0644)).To(Succeed())
+	}
+
+	It("finds, gets and releases IPs by container", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		reserved, err := s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserved, err = s.Reserve("c1", "eth0", net.ParseIP("2001:db8::2"), "1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserved, err = s.Reserve("c1", "eth1", net.ParseIP("10.0.0.3"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		// The IP is taken whatever the index says
+		reserved, err = s.Reserve("c2", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+
+		Expect(s.FindByID("c1", "eth0")).To(BeTrue())
+		Expect(s.FindByID("c2", "eth0")).To(BeFalse())
+		Expect(s.GetByID("c1", "eth0")).To(ConsistOf(net.ParseIP("10.0.0.2"), net.ParseIP("2001:db8::2")))
+		Expect(s.GetByID("c1", "eth1")).To(Equal([]net.IP{net.ParseIP("10.0.0.3")}))
+
+		Expect(s.ReleaseByID("c1", "eth0")).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(BeEmpty())
+		Expect(s.GetByID("c1", "eth1")).To(Equal([]net.IP{net.ParseIP("10.0.0.3")}))
+		_, err = os.Stat(GetEscapedPath(s.dataDir, "10.0.0.2"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = os.Stat(s.indexPath("c1", "eth0"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(s.Release(net.ParseIP("10.0.0.3"))).To(Succeed())
+		Expect(s.GetByID("c1", "eth1")).To(BeEmpty())
+		_, err = os.Stat(s.indexPath("c1", "eth1"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("indexes the reservations of an existing data directory", func() {
+		writeReservation("10.0.0.2", "c1"+LineBreak+"eth0")
+		writeReservation("10.0.0.3", "c1"+LineBreak+"eth0")
+		writeReservation("10.0.0.4", "c2"+LineBreak+"eth0")
+		writeReservation("10.0.0.5", "c3")
+		writeReservation(lastIPFilePrefix+"0", "10.0.0.5")
+
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		Expect(s.GetByID("c1", "eth0")).To(ConsistOf(net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")))
+		Expect(s.GetByID("c2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.4")}))
+
+		// Files holding only the container ID match any interface
+		Expect(s.FindByID("c3", "eth0")).To(BeTrue())
+		Expect(s.GetByID("c3", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.5")}))
+		Expect(s.ReleaseByID("c3", "eth0")).To(Succeed())
+		Expect(s.FindByID("c3", "eth0")).To(BeFalse())
+
+		// The temporary build directory is gone
+		_, err = os.Stat(filepath.Join(s.dataDir, indexDirName+".tmp"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("indexes the reservations older versions make once the index exists", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		Expect(s.Lock()).To(Succeed())
+		reserved, err := s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		Expect(s.Unlock()).To(Succeed())
+
+		// Written by an older version still running on the node
+		writeReservation("10.0.0.3", "c2"+LineBreak+"eth0")
+		writeReservation("10.0.0.4", "c3")
+
+		Expect(s.Lock()).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		Expect(s.GetByID("c2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.3")}))
+		Expect(s.ReleaseByID("c3", "eth0")).To(Succeed())
+		Expect(s.Unlock()).To(Succeed())
+		_, err = os.Stat(GetEscapedPath(s.dataDir, "10.0.0.4"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(s.FindByID("c2", "eth0")).To(BeTrue())
+		Expect(s.ReleaseByID("c2", "eth0")).To(Succeed())
+		Expect(s.FindByID("c2", "eth0")).To(BeFalse())
+	})
+
+	It("ignores the index entries of interrupted reservations", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		// Interrupted before the reservation file was written
+		Expect(s.Lock()).To(Succeed())
+		Expect(s.addToIndex("c1", "eth0", net.ParseIP("10.0.0.2"))).To(Succeed())
+		Expect(s.Unlock()).To(Succeed())
+
+		Expect(s.FindByID("c1", "eth0")).To(BeFalse())
+		reserved, err := s.Reserve("c2", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		Expect(s.GetByID("c1", "eth0")).To(BeEmpty())
+		Expect(s.GetByID("c2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+	})
+
+	It("ignores index entries whose reservation changed hands", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		reserved, err := s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		// Replaced behind the index's back
+		writeReservation("10.0.0.2", "c2"+LineBreak+"eth0")
+
+		Expect(s.FindByID("c1", "eth0")).To(BeFalse())
+		Expect(s.ReleaseByID("c1", "eth0")).To(Succeed())
+		_, err = os.Stat(GetEscapedPath(s.dataDir, "10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("records metadata with reservations and reads older files", func() {
+		allocatedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+		writeReservation("10.0.0.2", "c1")
+		writeReservation("10.0.0.3", "c2"+LineBreak+"eth0")
+
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		reserved, err := s.ReserveWithMetadata("c3", "eth0", net.ParseIP("10.0.0.4"), "0", backend.Metadata{
+			AllocatedAt:  allocatedAt,
+			Network:      "mynet",
+			PodNamespace: "default",
+			PodName:      "web-0",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserved, err = s.Reserve("c4", "eth0", net.ParseIP("10.0.0.5"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		reservations, err := s.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations).To(HaveLen(4))
+		byIP := map[string]backend.Reservation{}
+		for _, r := range reservations {
+			byIP[r.IP.String()] = r
+		}
+		Expect(byIP["10.0.0.2"].Metadata).To(BeNil())
+		Expect(byIP["10.0.0.3"].Metadata).To(BeNil())
+		Expect(byIP["10.0.0.4"].IfName).To(Equal("eth0"))
+		Expect(byIP["10.0.0.4"].Metadata).To(Equal(&backend.Metadata{
+			AllocatedAt:  allocatedAt,
+			Network:      "mynet",
+			PodNamespace: "default",
+			PodName:      "web-0",
+		}))
+		// Plain reservations are timestamped too
+		Expect(byIP["10.0.0.5"].Metadata).NotTo(BeNil())
+		Expect(byIP["10.0.0.5"].Metadata.AllocatedAt).To(BeTemporally("~", time.Now(), time.Minute))
+
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		Expect(s.GetByID("c2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.3")}))
+		Expect(s.GetByID("c3", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.4")}))
+		for _, id := range []string{"c1", "c2", "c3", "c4"} {
+			Expect(s.ReleaseByID(id, "eth0")).To(Succeed())
+		}
+		reservations, err = s.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations).To(BeEmpty())
+		files, err := ioutil.ReadDir(filepath.Join(s.dataDir, metadataDirName))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+
+	It("keeps the metadata out of the reservation files older versions read", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		reserved, err := s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, "10.0.0.2"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("c1" + LineBreak + "eth0"))
+
+		// An older version releasing the IP leaves the metadata behind,
+		// it isn't shown for the next reservation of the IP
+		Expect(os.Remove(GetEscapedPath(s.dataDir, "10.0.0.2"))).To(Succeed())
+		writeReservation("10.0.0.2", "c2"+LineBreak+"eth0")
+		reservations, err := s.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations).To(HaveLen(1))
+		Expect(reservations[0].ContainerID).To(Equal("c2"))
+		Expect(reservations[0].Metadata).To(BeNil())
+	})
+
+	It("holds released IPs for a key until they expire", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+			reserved, err := s.Reserve("c1", "eth0", net.ParseIP(ip), "0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+
+		now := time.Now()
+		Expect(s.HoldIP("db-0", net.ParseIP("10.0.0.2"), now.Add(time.Hour))).To(Succeed())
+		Expect(s.HoldIP("db-1", net.ParseIP("10.0.0.3"), now.Add(time.Minute))).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(BeEmpty())
+		Expect(s.GetHeldIPs("db-0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+
+		// Held IPs stay taken
+		reserved, err := s.Reserve("c2", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+
+		reservations, err := s.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations).To(HaveLen(2))
+		Expect(reservations[0].HeldFor).To(Equal("db-0"))
+		Expect(reservations[0].ContainerID).To(BeEmpty())
+
+		// The index is rebuilt with the holds
+		Expect(os.RemoveAll(filepath.Join(s.dataDir, indexDirName))).To(Succeed())
+		s2, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s2.Close()
+		Expect(s2.GetHeldIPs("db-1")).To(Equal([]net.IP{net.ParseIP("10.0.0.3")}))
+
+		Expect(s.ReleaseHeldIP("db-1", net.ParseIP("10.0.0.2"))).To(MatchError(`10.0.0.2 is not held for "db-1"`))
+
+		Expect(s.ReleaseExpiredHolds(now.Add(10 * time.Minute))).To(Succeed())
+		Expect(s.GetHeldIPs("db-1")).To(BeEmpty())
+		_, err = os.Stat(GetEscapedPath(s.dataDir, "10.0.0.3"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = os.Stat(s.holdPath(net.ParseIP("10.0.0.3")))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		Expect(s.ReleaseHeldIP("db-0", net.ParseIP("10.0.0.2"))).To(Succeed())
+		reserved, err = s.Reserve("c2", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	})
+})
@@ -0,0 +1,160 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A held IP keeps its reservation file, owned by holdIDPrefix followed by
+// the key it is held for. When the hold expires is recorded in a file
+// named after the IP in holdsDirName.
+const (
+	holdIDPrefix = "held-for:"
+	holdsDirName = "holds"
+)
+
+type holdEntry struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+}
+
+func holdID(key string) string {
+	return holdIDPrefix + key
+}
+
+func (s *Store) holdPath(ip net.IP) string {
+	return GetEscapedPath(filepath.Join(s.dataDir, holdsDirName), ip.String())
+}
+
+func (s *Store) readHold(ip net.IP) (*holdEntry, error) {
+	data, err := ioutil.ReadFile(s.holdPath(ip))
+	if err != nil {
+		return nil, err
+	}
+	entry := &holdEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *Store) HoldIP(key string, ip net.IP, until time.Time) error {
+	fname := GetEscapedPath(s.dataDir, ip.String())
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	id, ifname := parseReservation(data)
+
+	if err := os.MkdirAll(filepath.Join(s.dataDir, holdsDirName), 0755); err != nil {
+		return err
+	}
+	hold, err := json.Marshal(&holdEntry{Key: key, Until: until})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.holdPath(ip), hold, 0644); err != nil {
+		return err
+	}
+
+	// Swap the owner of the reservation, the IP is never free meanwhile
+	tmp := fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(holdID(key)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := s.removeMetadata(ip); err != nil {
+		return err
+	}
+	if err := s.removeFromIndex(id, ifname, ip); err != nil {
+		return err
+	}
+	return s.addToIndex(holdID(key), "", ip)
+}
+
+func (s *Store) GetHeldIPs(key string) []net.IP {
+	var ips []net.IP
+	now := time.Now()
+	for _, ip := range s.lookupIndex(holdID(key), "") {
+		hold, err := s.readHold(ip)
+		if err != nil || hold.Key != key || hold.Until.Before(now) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func (s *Store) ReleaseHeldIP(key string, ip net.IP) error {
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, ip.String()))
+	if err != nil {
+		return err
+	}
+	if id, _ := parseReservation(data); id != holdID(key) {
+		return fmt.Errorf("%s is not held for %q", ip, key)
+	}
+	return s.Release(ip)
+}
+
+func (s *Store) ReleaseExpiredHolds(now time.Time) error {
+	files, err := ioutil.ReadDir(filepath.Join(s.dataDir, holdsDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, fi := range files {
+		ip := reservationIP(fi.Name())
+		if ip == nil {
+			continue
+		}
+		hold, err := s.readHold(ip)
+		if err != nil || !hold.Until.Before(now) {
+			continue
+		}
+		data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, ip.String()))
+		if id, _ := parseReservation(data); err != nil || id != holdID(hold.Key) {
+			// The reservation went away, clean up what is left
+			os.Remove(s.holdPath(ip))
+			continue
+		}
+		if err := s.Release(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// heldFor returns the key a reservation owner holds an IP for, if any
+func heldFor(id string) (string, bool) {
+	if !strings.HasPrefix(id, holdIDPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(id, holdIDPrefix), true
+}
@@ -0,0 +1,326 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// indexDirName is the directory, next to the per-IP reservation files, that
+// maps each container ID and interface name to the IPs reserved for it.
+// The reservation files remain the source of truth; the index only avoids
+// reading all of them to find the IPs of one container.
+//
+// Versions of this plugin that predate the index may still write to the
+// data directory, during an upgrade for instance. The index records the
+// modification time of the data directory it reflects, in indexSyncedName,
+// and is rebuilt when the directory changed behind its back. This relies on
+// modification times with a sub-second resolution, as current file systems
+// record them.
+const indexDirName = "by-id"
+
+// indexSyncedName is the file of the index directory holding the
+// modification time of the data directory, in nanoseconds, as of the last
+// change made through the index
+const indexSyncedName = "synced"
+
+// indexEntry is the content of one index file
+type indexEntry struct {
+	ID     string   `json:"id"`
+	IfName string   `json:"ifname"`
+	IPs    []string `json:"ips"`
+}
+
+// parseReservation returns the container ID and interface name stored in
+// a reservation file. Files written by older versions only hold the ID.
+func parseReservation(data []byte) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(string(data)), LineBreak, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// reservationIP returns the IP a reservation file in the data directory is
+// named after, or nil for the other files found there
+func reservationIP(fname string) net.IP {
+	if runtime.GOOS == "windows" {
+		fname = strings.Replace(fname, "_", ":", -1)
+	}
+	return net.ParseIP(fname)
+}
+
+func indexFileName(id, ifname string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(id) + LineBreak + ifname))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) indexPath(id, ifname string) string {
+	return filepath.Join(s.dataDir, indexDirName, indexFileName(id, ifname))
+}
+
+func readIndexFile(path string) (*indexEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &indexEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// writeIndexFile atomically replaces path with entry, or removes it if
+// entry holds no IPs
+func writeIndexFile(path string, entry *indexEntry) error {
+	if len(entry.IPs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// lookupIndex returns the IPs the index holds for id and ifname. IPs whose
+// reservation file no longer belongs to them are skipped.
+func (s *Store) lookupIndex(id, ifname string) []net.IP {
+	if err := s.ensureIndex(); err != nil {
+		return nil
+	}
+	entry, err := readIndexFile(s.indexPath(id, ifname))
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, ipString := range entry.IPs {
+		ip := net.ParseIP(ipString)
+		if ip == nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, ip.String()))
+		if err != nil {
+			continue
+		}
+		owner, ownerIfName := parseReservation(data)
+		if owner != strings.TrimSpace(id) || (ownerIfName != ifname && ownerIfName != "") {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// addToIndex records ip as reserved for id and ifname
+func (s *Store) addToIndex(id, ifname string, ip net.IP) error {
+	if err := s.ensureIndex(); err != nil {
+		return err
+	}
+	path := s.indexPath(id, ifname)
+	entry, err := readIndexFile(path)
+	if err != nil {
+		entry = &indexEntry{ID: strings.TrimSpace(id), IfName: ifname}
+	}
+	for _, ipString := range entry.IPs {
+		if ipString == ip.String() {
+			return nil
+		}
+	}
+	entry.IPs = append(entry.IPs, ip.String())
+	return writeIndexFile(path, entry)
+}
+
+// removeFromIndex forgets ip for id and ifname
+func (s *Store) removeFromIndex(id, ifname string, ip net.IP) error {
+	path := s.indexPath(id, ifname)
+	entry, err := readIndexFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	ips := entry.IPs[:0]
+	for _, ipString := range entry.IPs {
+		if ipString != ip.String() {
+			ips = append(ips, ipString)
+		}
+	}
+	entry.IPs = ips
+	return writeIndexFile(path, entry)
+}
+
+// dataDirModTime returns the modification time of the data directory,
+// which changes whenever a reservation file is created or removed
+func (s *Store) dataDirModTime() (int64, error) {
+	fi, err := os.Stat(s.dataDir)
+	if err != nil {
+		return 0, err
+	}
+	return fi.ModTime().UnixNano(), nil
+}
+
+// readIndexSynced returns the modification time of the data directory the
+// index reflects, or -1 if there is no index
+func (s *Store) readIndexSynced() int64 {
+	data, err := ioutil.ReadFile(filepath.Join(s.dataDir, indexDirName, indexSyncedName))
+	if err != nil {
+		return -1
+	}
+	synced, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return synced
+}
+
+func (s *Store) writeIndexSynced(synced int64) error {
+	path := filepath.Join(s.dataDir, indexDirName, indexSyncedName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(synced, 10)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// reconcileIndex rebuilds the index if the data directory changed since it
+// was last synced: it is missing, reservations were made or released by a
+// version without the index, or a change was interrupted. The caller must
+// hold the lock.
+func (s *Store) reconcileIndex() error {
+	modTime, err := s.dataDirModTime()
+	if err != nil {
+		return err
+	}
+	if s.readIndexSynced() == modTime {
+		s.indexSynced = true
+		return nil
+	}
+	if err := s.buildIndex(); err != nil {
+		return err
+	}
+	if err := s.writeIndexSynced(modTime); err != nil {
+		return err
+	}
+	s.indexSynced = true
+	return nil
+}
+
+// ensureIndex reconciles the index if Lock hasn't, for a store used without
+// it
+func (s *Store) ensureIndex() error {
+	if s.indexSynced {
+		return nil
+	}
+	return s.reconcileIndex()
+}
+
+// syncIndex records that the index reflects the data directory, once this
+// store changed both. The caller must hold the lock.
+func (s *Store) syncIndex() error {
+	if !s.indexSynced {
+		return nil
+	}
+	s.indexSynced = false
+	modTime, err := s.dataDirModTime()
+	if err != nil {
+		return err
+	}
+	if s.readIndexSynced() == modTime {
+		return nil
+	}
+	return s.writeIndexSynced(modTime)
+}
+
+// buildIndex creates the index from the reservation files, replacing the
+// existing one. The index is populated in a temporary directory and renamed
+// into place, so it is either complete or absent. The caller must hold the
+// lock.
+func (s *Store) buildIndex() error {
+	indexDir := filepath.Join(s.dataDir, indexDirName)
+	tmpDir := indexDir + ".tmp"
+	oldDir := indexDir + ".old"
+	for _, dir := range []string{tmpDir, oldDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	reservations, err := s.ListReservations()
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	entries := map[string]*indexEntry{}
+	for _, r := range reservations {
+		id := r.ContainerID
+		if r.HeldFor != "" {
+			id = holdID(r.HeldFor)
+		}
+		name := indexFileName(id, r.IfName)
+		if entries[name] == nil {
+			entries[name] = &indexEntry{ID: id, IfName: r.IfName}
+		}
+		entries[name].IPs = append(entries[name].IPs, r.IP.String())
+	}
+
+	for name, entry := range entries {
+		if err := writeIndexFile(filepath.Join(tmpDir, name), entry); err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+	}
+
+	if err := os.Rename(indexDir, oldDir); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := os.Rename(tmpDir, indexDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	return os.RemoveAll(oldDir)
+}
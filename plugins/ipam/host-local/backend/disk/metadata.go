@@ -0,0 +1,81 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+)
+
+// metadataDirName is the directory holding the metadata of the
+// reservations, in a file named after the IP. The reservation files keep
+// the format older versions match on release, so they can still release
+// the IPs reserved by this one.
+const metadataDirName = "metadata"
+
+// metadataEntry is the content of one metadata file. It names the
+// reservation it belongs to, as an older version releasing the IP leaves
+// the file behind.
+type metadataEntry struct {
+	ID     string `json:"id"`
+	IfName string `json:"ifname"`
+	backend.Metadata
+}
+
+func (s *Store) metadataPath(ip net.IP) string {
+	return GetEscapedPath(filepath.Join(s.dataDir, metadataDirName), ip.String())
+}
+
+func (s *Store) writeMetadata(id, ifname string, ip net.IP, meta backend.Metadata) error {
+	if err := os.MkdirAll(filepath.Join(s.dataDir, metadataDirName), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(&metadataEntry{ID: strings.TrimSpace(id), IfName: ifname, Metadata: meta})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.metadataPath(ip), data, 0644)
+}
+
+// readMetadata returns the metadata of the reservation of ip for the
+// interface ifname of the container id, or nil if it has none
+func (s *Store) readMetadata(id, ifname string, ip net.IP) *backend.Metadata {
+	data, err := ioutil.ReadFile(s.metadataPath(ip))
+	if err != nil {
+		return nil
+	}
+	entry := &metadataEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil
+	}
+	if entry.ID != id || entry.IfName != ifname {
+		// Left over by an earlier reservation of the IP
+		return nil
+	}
+	return &entry.Metadata
+}
+
+func (s *Store) removeMetadata(ip net.IP) error {
+	if err := os.Remove(s.metadataPath(ip)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
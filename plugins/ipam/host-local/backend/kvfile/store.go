@@ -0,0 +1,476 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kvfile implements a store keeping all the reservations of a
+// network in a single bbolt database. Every change is a transaction that
+// only touches the keys of the IPs it reserves or releases, and bbolt keeps
+// the file consistent on a crash. The database is opened between Lock and
+// Unlock, so the changes made under one Lock are serialized with all other
+// users of the file, including other nodes sharing it over a clustered
+// filesystem that supports flock.
+package kvfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/containernetworking/plugins/pkg/utils/filelock"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+)
+
+const (
+	defaultDataDir = "/var/lib/cni/networks"
+	fileName       = "store.db"
+)
+
+// The buckets of the database
+var (
+	// reservationsBucket maps each reserved or held IP to its entry
+	reservationsBucket = []byte("reservations")
+	// byIDBucket indexes the reservations by container: it holds a key
+	// made by idKey for each of them
+	byIDBucket = []byte("byID")
+	// heldBucket indexes the holds by key: it holds a key made by heldKey
+	// for each of them
+	heldBucket = []byte("held")
+	// lastReservedBucket maps each range ID to its last reserved IP
+	lastReservedBucket = []byte("lastReserved")
+)
+
+var buckets = [][]byte{reservationsBucket, byIDBucket, heldBucket, lastReservedBucket}
+
+type entry struct {
+	ContainerID string     `json:"containerID,omitempty"`
+	IfName      string     `json:"ifname,omitempty"`
+	HeldFor     string     `json:"heldFor,omitempty"`
+	HeldUntil   *time.Time `json:"heldUntil,omitempty"`
+
+	Metadata *backend.Metadata `json:"metadata,omitempty"`
+}
+
+// Store is a backend.Store keeping its state in a single file
+type Store struct {
+	*filelock.FileLock
+	path string
+
+	// db is open while the store is locked. It is nil when the store is
+	// locked shared before the database was ever created.
+	db     *bolt.DB
+	locked bool
+}
+
+// Store implements the Store interface
+var _ backend.Store = &Store{}
+
+func New(network, dataDir string) (*Store, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	if err := os.MkdirAll(filepath.Join(dataDir, network), 0755); err != nil {
+		return nil, err
+	}
+	return Open(network, dataDir)
+}
+
+// Open is New for the commands that only read the store: it fails rather
+// than create the directory of the network if it is missing
+func Open(network, dataDir string) (*Store, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	dir := filepath.Join(dataDir, network)
+
+	// The lock is on the directory, as it is taken before opening the database
+	lk, err := filelock.NewFileLock(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{FileLock: lk, path: filepath.Join(dir, fileName)}, nil
+}
+
+// open opens the database, creating it and its buckets unless readOnly
+func (s *Store) open(readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		// bolt can't create a database read-only
+		if _, err := os.Stat(s.path); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", s.path, err)
+	}
+	if readOnly {
+		return db, nil
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize %s: %v", s.path, err)
+	}
+	return db, nil
+}
+
+func (s *Store) Lock() error {
+	if err := s.FileLock.Lock(); err != nil {
+		return err
+	}
+	db, err := s.open(false)
+	if err != nil {
+		s.FileLock.Unlock()
+		return err
+	}
+	s.db, s.locked = db, true
+	return nil
+}
+
+func (s *Store) Unlock() error {
+	s.closeDB()
+	return s.FileLock.Unlock()
+}
+
+func (s *Store) RLock() error {
+	if err := s.FileLock.RLock(); err != nil {
+		return err
+	}
+	db, err := s.open(true)
+	if err != nil && !os.IsNotExist(err) {
+		s.FileLock.RUnlock()
+		return err
+	}
+	s.db, s.locked = db, true
+	return nil
+}
+
+func (s *Store) RUnlock() error {
+	s.closeDB()
+	return s.FileLock.RUnlock()
+}
+
+func (s *Store) Close() error {
+	s.closeDB()
+	return s.FileLock.Close()
+}
+
+func (s *Store) closeDB() {
+	if s.db != nil {
+		s.db.Close()
+	}
+	s.db, s.locked = nil, false
+}
+
+// view runs fn in a read transaction. The operations called without the
+// lock open the database for themselves.
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	db := s.db
+	if !s.locked {
+		var err error
+		if db, err = s.open(false); err != nil {
+			return err
+		}
+		defer db.Close()
+	} else if db == nil {
+		// Nothing was ever stored
+		return nil
+	}
+	return db.View(fn)
+}
+
+// update runs fn in a write transaction, committed unless fn fails
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	db := s.db
+	if !s.locked {
+		var err error
+		if db, err = s.open(false); err != nil {
+			return err
+		}
+		defer db.Close()
+	} else if db == nil {
+		return bolt.ErrDatabaseReadOnly
+	}
+	return db.Update(fn)
+}
+
+// idKey returns the key indexing the reservation of ip for the interface
+// ifname of the container id. Neither can hold a NUL.
+func idKey(id, ifname string, ip string) []byte {
+	return []byte(id + "\x00" + ifname + "\x00" + ip)
+}
+
+// heldKey returns the key indexing the hold of ip for key
+func heldKey(key string, ip string) []byte {
+	return []byte(key + "\x00" + ip)
+}
+
+// ipsWithPrefix returns the IPs ending the keys of b starting with prefix
+func ipsWithPrefix(b *bolt.Bucket, prefix []byte) []string {
+	var ips []string
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ips = append(ips, string(k[len(prefix):]))
+	}
+	return ips
+}
+
+func getEntry(tx *bolt.Tx, ip string) (*entry, error) {
+	data := tx.Bucket(reservationsBucket).Get([]byte(ip))
+	if data == nil {
+		return nil, nil
+	}
+	e := &entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("failed to parse the reservation of %s: %v", ip, err)
+	}
+	return e, nil
+}
+
+func putEntry(tx *bolt.Tx, ip string, e *entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(reservationsBucket).Put([]byte(ip), data)
+}
+
+// deleteEntry drops ip, reserved or held as e, along with its index key
+func deleteEntry(tx *bolt.Tx, ip string, e *entry) error {
+	if e.HeldFor != "" {
+		if err := tx.Bucket(heldBucket).Delete(heldKey(e.HeldFor, ip)); err != nil {
+			return err
+		}
+	} else if err := tx.Bucket(byIDBucket).Delete(idKey(e.ContainerID, e.IfName, ip)); err != nil {
+		return err
+	}
+	return tx.Bucket(reservationsBucket).Delete([]byte(ip))
+}
+
+func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
+	return s.ReserveWithMetadata(id, ifname, ip, rangeID, backend.Metadata{})
+}
+
+func (s *Store) ReserveWithMetadata(id string, ifname string, ip net.IP, rangeID string, meta backend.Metadata) (bool, error) {
+	if meta.AllocatedAt.IsZero() {
+		meta.AllocatedAt = time.Now()
+	}
+	reserved := false
+	err := s.update(func(tx *bolt.Tx) error {
+		if tx.Bucket(reservationsBucket).Get([]byte(ip.String())) != nil {
+			return nil
+		}
+		if err := putEntry(tx, ip.String(), &entry{ContainerID: id, IfName: ifname, Metadata: &meta}); err != nil {
+			return err
+		}
+		if err := tx.Bucket(byIDBucket).Put(idKey(id, ifname, ip.String()), []byte{}); err != nil {
+			return err
+		}
+		if err := tx.Bucket(lastReservedBucket).Put([]byte(rangeID), []byte(ip.String())); err != nil {
+			return err
+		}
+		reserved = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return reserved, nil
+}
+
+// LastReservedIP returns the last reserved IP if exists
+func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
+	var ip net.IP
+	err := s.view(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(lastReservedBucket).Get([]byte(rangeID)); data != nil {
+			ip = net.ParseIP(string(data))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil {
+		return nil, os.ErrNotExist
+	}
+	return ip, nil
+}
+
+func (s *Store) Release(ip net.IP) error {
+	return s.update(func(tx *bolt.Tx) error {
+		e, err := getEntry(tx, ip.String())
+		if err != nil || e == nil {
+			return err
+		}
+		return deleteEntry(tx, ip.String(), e)
+	})
+}
+
+func (s *Store) ReleaseByID(id string, ifname string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		for _, ip := range ipsWithPrefix(tx.Bucket(byIDBucket), idKey(id, ifname, "")) {
+			if err := deleteEntry(tx, ip, &entry{ContainerID: id, IfName: ifname}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) GetByID(id string, ifname string) []net.IP {
+	var ips []net.IP
+	err := s.view(func(tx *bolt.Tx) error {
+		for _, ip := range ipsWithPrefix(tx.Bucket(byIDBucket), idKey(id, ifname, "")) {
+			ips = append(ips, net.ParseIP(ip))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	sortIPs(ips)
+	return ips
+}
+
+func (s *Store) ListReservations() ([]backend.Reservation, error) {
+	reservations := []backend.Reservation{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(reservationsBucket).ForEach(func(k, v []byte) error {
+			e := &entry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return fmt.Errorf("failed to parse the reservation of %s: %v", k, err)
+			}
+			reservations = append(reservations, backend.Reservation{
+				IP:          net.ParseIP(string(k)),
+				ContainerID: e.ContainerID,
+				IfName:      e.IfName,
+				HeldFor:     e.HeldFor,
+				Metadata:    e.Metadata,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return bytes.Compare(reservations[i].IP.To16(), reservations[j].IP.To16()) < 0
+	})
+	return reservations, nil
+}
+
+func (s *Store) HoldIP(key string, ip net.IP, until time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		e, err := getEntry(tx, ip.String())
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			return fmt.Errorf("%s is not reserved", ip)
+		}
+		if err := deleteEntry(tx, ip.String(), e); err != nil {
+			return err
+		}
+		if err := putEntry(tx, ip.String(), &entry{HeldFor: key, HeldUntil: &until}); err != nil {
+			return err
+		}
+		return tx.Bucket(heldBucket).Put(heldKey(key, ip.String()), []byte{})
+	})
+}
+
+func (s *Store) GetHeldIPs(key string) []net.IP {
+	var ips []net.IP
+	now := time.Now()
+	err := s.view(func(tx *bolt.Tx) error {
+		for _, ip := range ipsWithPrefix(tx.Bucket(heldBucket), heldKey(key, "")) {
+			e, err := getEntry(tx, ip)
+			if err != nil {
+				return err
+			}
+			if e != nil && e.HeldUntil != nil && !e.HeldUntil.Before(now) {
+				ips = append(ips, net.ParseIP(ip))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	sortIPs(ips)
+	return ips
+}
+
+func (s *Store) ReleaseHeldIP(key string, ip net.IP) error {
+	return s.update(func(tx *bolt.Tx) error {
+		e, err := getEntry(tx, ip.String())
+		if err != nil {
+			return err
+		}
+		if e == nil || e.HeldFor != key {
+			return fmt.Errorf("%s is not held for %q", ip, key)
+		}
+		return deleteEntry(tx, ip.String(), e)
+	})
+}
+
+func (s *Store) ReleaseExpiredHolds(now time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		// Keys can't be deleted while iterating over them
+		var expired []string
+		err := tx.Bucket(heldBucket).ForEach(func(k, _ []byte) error {
+			ip := string(k[strings.LastIndexByte(string(k), 0)+1:])
+			e, err := getEntry(tx, ip)
+			if err != nil {
+				return err
+			}
+			if e != nil && (e.HeldUntil == nil || e.HeldUntil.Before(now)) {
+				expired = append(expired, ip)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, ip := range expired {
+			e, err := getEntry(tx, ip)
+			if err != nil {
+				return err
+			}
+			if err := deleteEntry(tx, ip, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func sortIPs(ips []net.IP) {
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvfile
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Single file store", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "kvfile_test")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	reserve := func(s *Store, id, ifname, ip, rangeID string) {
+		reserved, err := s.Reserve(id, ifname, net.ParseIP(ip), rangeID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	}
+
+	It("reserves, gets and releases IPs by container", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		_, err = s.LastReservedIP("0")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		reserve(s, "c1", "eth0", "10.0.0.3", "0")
+		reserve(s, "c1", "eth0", "2001:db8::2", "1")
+		reserve(s, "c1", "eth1", "10.0.0.2", "0")
+
+		reserved, err := s.Reserve("c2", "eth0", net.ParseIP("10.0.0.3"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+
+		last, err := s.LastReservedIP("0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.2"))
+
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.3"), net.ParseIP("2001:db8::2")}))
+
+		// Everything survives reopening the file
+		s2, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s2.Close()
+		reservations, err := s2.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations).To(HaveLen(3))
+		Expect(reservations[0].IP.String()).To(Equal("10.0.0.2"))
+		Expect(reservations[0].ContainerID).To(Equal("c1"))
+		Expect(reservations[0].IfName).To(Equal("eth1"))
+
+		Expect(s.ReleaseByID("c1", "eth0")).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(BeEmpty())
+		Expect(s.Release(net.ParseIP("10.0.0.2"))).To(Succeed())
+		Expect(s2.GetByID("c1", "eth1")).To(BeEmpty())
+
+		// Only the database and its lock are kept
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, "mynet"))
+		Expect(err).ToNot(HaveOccurred())
+		names := []string{}
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		Expect(names).To(ConsistOf("lock", fileName))
+	})
+
+	It("records metadata with reservations", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		meta := backend.Metadata{
+			AllocatedAt:  time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+			Network:      "mynet",
+			PodNamespace: "default",
+			PodName:      "web-0",
+		}
+		reserved, err := s.ReserveWithMetadata("c1", "eth0", net.ParseIP("10.0.0.2"), "0", meta)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserve(s, "c2", "eth0", "10.0.0.3", "0")
+
+		reservations, err := s.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations).To(HaveLen(2))
+		Expect(reservations[0].Metadata).To(Equal(&meta))
+		Expect(reservations[1].Metadata.AllocatedAt).To(BeTemporally("~", time.Now(), time.Minute))
+
+		// Holds don't keep the metadata of the released reservation
+		Expect(s.HoldIP("db-0", net.ParseIP("10.0.0.2"), time.Now().Add(time.Hour))).To(Succeed())
+		reservations, err = s.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations[0].Metadata).To(BeNil())
+	})
+
+	It("holds released IPs for a key until they expire", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		reserve(s, "c1", "eth0", "10.0.0.2", "0")
+		reserve(s, "c1", "eth0", "10.0.0.3", "0")
+
+		now := time.Now()
+		Expect(s.HoldIP("db-0", net.ParseIP("10.0.0.2"), now.Add(time.Hour))).To(Succeed())
+		Expect(s.HoldIP("db-1", net.ParseIP("10.0.0.3"), now.Add(time.Minute))).To(Succeed())
+		Expect(s.HoldIP("db-1", net.ParseIP("10.0.0.4"), now.Add(time.Minute))).To(MatchError("10.0.0.4 is not reserved"))
+		Expect(s.GetByID("c1", "eth0")).To(BeEmpty())
+		Expect(s.GetHeldIPs("db-0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+
+		reserved, err := s.Reserve("c2", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+
+		reservations, err := s.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations[0].HeldFor).To(Equal("db-0"))
+		Expect(reservations[0].ContainerID).To(BeEmpty())
+
+		Expect(s.ReleaseHeldIP("db-1", net.ParseIP("10.0.0.2"))).To(MatchError(`10.0.0.2 is not held for "db-1"`))
+
+		Expect(s.ReleaseExpiredHolds(now.Add(10 * time.Minute))).To(Succeed())
+		Expect(s.GetHeldIPs("db-1")).To(BeEmpty())
+		Expect(s.GetHeldIPs("db-0")).To(HaveLen(1))
+
+		Expect(s.ReleaseHeldIP("db-0", net.ParseIP("10.0.0.2"))).To(Succeed())
+		reserve(s, "c2", "eth0", "10.0.0.2", "0")
+	})
+
+	It("refuses files it can't read", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		Expect(ioutil.WriteFile(s.path, []byte(`{"version": 1}`), 0644)).To(Succeed())
+		_, err = s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).To(HaveOccurred())
+		Expect(s.Lock()).To(HaveOccurred())
+
+		// A failed change leaves the file alone
+		data, err := ioutil.ReadFile(s.path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"version": 1}`))
+	})
+
+	It("keeps the database open while locked", func() {
+		s, err := New("mynet", dataDir)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		// Reading a store that was never written creates nothing
+		Expect(s.RLock()).To(Succeed())
+		reservations, err := s.ListReservations()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reservations).To(BeEmpty())
+		_, err = s.Reserve("c1", "eth0", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).To(HaveOccurred())
+		Expect(s.RUnlock()).To(Succeed())
+
+		Expect(s.Lock()).To(Succeed())
+		reserve(s, "c1", "eth0", "10.0.0.2", "0")
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		Expect(s.Unlock()).To(Succeed())
+
+		Expect(s.RLock()).To(Succeed())
+		Expect(s.GetByID("c1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.2")}))
+		_, err = s.Reserve("c2", "eth0", net.ParseIP("10.0.0.3"), "0")
+		Expect(err).To(HaveOccurred())
+		Expect(s.RUnlock()).To(Succeed())
+	})
+})
@@ -14,15 +14,57 @@
 
 package backend
 
-import "net"
+import (
+	"net"
+	"time"
+)
+
+// Reservation is an IP reserved for an interface of a container
+type Reservation struct {
+	IP          net.IP `json:"ip"`
+	ContainerID string `json:"containerID"`
+	// IfName is empty for reservations made by old versions, which
+	// belong to every interface of the container
+	IfName string `json:"ifname,omitempty"`
+	// HeldFor is set instead of ContainerID for released IPs kept aside
+	// for a sticky key
+	HeldFor string `json:"heldFor,omitempty"`
+	// Metadata is nil for reservations made by old versions
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// Metadata describes how an IP came to be reserved, to help debugging
+type Metadata struct {
+	AllocatedAt  time.Time `json:"allocatedAt"`
+	Network      string    `json:"network,omitempty"`
+	PodNamespace string    `json:"podNamespace,omitempty"`
+	PodName      string    `json:"podName,omitempty"`
+}
 
 type Store interface {
 	Lock() error
 	Unlock() error
+	// RLock takes the lock shared, for the operations that only read
+	RLock() error
+	RUnlock() error
 	Close() error
 	Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error)
+	// ReserveWithMetadata is Reserve, recording meta with the reservation.
+	// A zero meta.AllocatedAt is set to the current time.
+	ReserveWithMetadata(id string, ifname string, ip net.IP, rangeID string, meta Metadata) (bool, error)
 	LastReservedIP(rangeID string) (net.IP, error)
 	Release(ip net.IP) error
 	ReleaseByID(id string, ifname string) error
 	GetByID(id string, ifname string) []net.IP
+	ListReservations() ([]Reservation, error)
+
+	// HoldIP turns the reservation of ip into a hold for key, which keeps
+	// other containers from getting it until the hold expires
+	HoldIP(key string, ip net.IP, until time.Time) error
+	// GetHeldIPs returns the unexpired IPs held for key
+	GetHeldIPs(key string) []net.IP
+	// ReleaseHeldIP drops the hold of key on ip, making it available
+	ReleaseHeldIP(key string, ip net.IP) error
+	// ReleaseExpiredHolds drops the holds that expired before now
+	ReleaseExpiredHolds(now time.Time) error
 }
@@ -15,8 +15,10 @@
 package testing
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"time"
 
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 )
@@ -24,13 +26,20 @@ import (
 type FakeStore struct {
 	ipMap          map[string]string
 	lastReservedIP map[string]net.IP
+	holds          map[string]fakeHold
+	metadata       map[string]backend.Metadata
+}
+
+type fakeHold struct {
+	key   string
+	until time.Time
 }
 
 // FakeStore implements the Store interface
 var _ backend.Store = &FakeStore{}
 
 func NewFakeStore(ipmap map[string]string, lastIPs map[string]net.IP) *FakeStore {
-	return &FakeStore{ipmap, lastIPs}
+	return &FakeStore{ipmap, lastIPs, map[string]fakeHold{}, map[string]backend.Metadata{}}
 }
 
 func (s *FakeStore) Lock() error {
@@ -41,6 +50,14 @@ func (s *FakeStore) Unlock() error {
 	return nil
 }
 
+func (s *FakeStore) RLock() error {
+	return nil
+}
+
+func (s *FakeStore) RUnlock() error {
+	return nil
+}
+
 func (s *FakeStore) Close() error {
 	return nil
 }
@@ -50,11 +67,20 @@ func (s *FakeStore) Reserve(id string, ifname string, ip net.IP, rangeID string)
 	if _, ok := s.ipMap[key]; !ok {
 		s.ipMap[key] = id
 		s.lastReservedIP[rangeID] = ip
+		delete(s.metadata, key)
 		return true, nil
 	}
 	return false, nil
 }
 
+func (s *FakeStore) ReserveWithMetadata(id string, ifname string, ip net.IP, rangeID string, meta backend.Metadata) (bool, error) {
+	reserved, err := s.Reserve(id, ifname, ip, rangeID)
+	if reserved {
+		s.metadata[ip.String()] = meta
+	}
+	return reserved, err
+}
+
 func (s *FakeStore) LastReservedIP(rangeID string) (net.IP, error) {
 	ip, ok := s.lastReservedIP[rangeID]
 	if !ok {
@@ -91,6 +117,66 @@ func (s *FakeStore) GetByID(id string, ifname string) []net.IP {
 	return ips
 }
 
+func (s *FakeStore) ListReservations() ([]backend.Reservation, error) {
+	var reservations []backend.Reservation
+	for k, v := range s.ipMap {
+		if h, ok := s.holds[k]; ok {
+			reservations = append(reservations, backend.Reservation{
+				IP:      net.ParseIP(k),
+				HeldFor: h.key,
+			})
+			continue
+		}
+		r := backend.Reservation{
+			IP:          net.ParseIP(k),
+			ContainerID: v,
+		}
+		if meta, ok := s.metadata[k]; ok {
+			r.Metadata = &meta
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+func (s *FakeStore) HoldIP(key string, ip net.IP, until time.Time) error {
+	if _, ok := s.ipMap[ip.String()]; !ok {
+		return os.ErrNotExist
+	}
+	s.ipMap[ip.String()] = "held-for:" + key
+	s.holds[ip.String()] = fakeHold{key, until}
+	return nil
+}
+
+func (s *FakeStore) GetHeldIPs(key string) []net.IP {
+	var ips []net.IP
+	for k, h := range s.holds {
+		if h.key == key && !h.until.Before(time.Now()) {
+			ips = append(ips, net.ParseIP(k))
+		}
+	}
+	return ips
+}
+
+func (s *FakeStore) ReleaseHeldIP(key string, ip net.IP) error {
+	if h, ok := s.holds[ip.String()]; !ok || h.key != key {
+		return fmt.Errorf("%s is not held for %q", ip, key)
+	}
+	delete(s.holds, ip.String())
+	delete(s.ipMap, ip.String())
+	return nil
+}
+
+func (s *FakeStore) ReleaseExpiredHolds(now time.Time) error {
+	for k, h := range s.holds {
+		if h.until.Before(now) {
+			delete(s.holds, k)
+			delete(s.ipMap, k)
+		}
+	}
+	return nil
+}
+
 func (s *FakeStore) SetIPMap(m map[string]string) {
 	s.ipMap = m
 }
@@ -0,0 +1,145 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+// Attachment is a container interface that is still in use
+type Attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+// GCConf is the configuration of a garbage collection: the network
+// configuration with the attachments that must be kept, as passed to the
+// GC verb of the CNI spec
+type GCConf struct {
+	ValidAttachments *[]Attachment `json:"cni.dev/valid-attachments"`
+}
+
+// GCReport lists the reservations released by a garbage collection, or
+// that would be released on a dry run
+type GCReport struct {
+	DryRun   bool                  `json:"dryRun"`
+	Released []backend.Reservation `json:"released"`
+}
+
+// runGC collects the network configuration read from in and writes the
+// report to out. It backs the "host-local gc" subcommand until the CNI
+// library supports the GC verb.
+func runGC(in io.Reader, out io.Writer, dryRun bool) error {
+	stdinData, err := ioutil.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("error reading from stdin: %v", err)
+	}
+
+	report, gcErr := cmdGC(stdinData, dryRun)
+	if report != nil {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	}
+	return gcErr
+}
+
+// cmdGC releases all reservations of the network configured in stdinData
+// that don't belong to one of its valid attachments
+func cmdGC(stdinData []byte, dryRun bool) (*GCReport, error) {
+	ipamConf, _, err := allocator.LoadIPAMConfig(stdinData, "")
+	if err != nil {
+		return nil, err
+	}
+
+	conf := GCConf{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	// Without the list every reservation would go
+	if conf.ValidAttachments == nil {
+		return nil, fmt.Errorf("\"cni.dev/valid-attachments\" field is required. It lists the attachments whose IPs are kept.")
+	}
+
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	return gc(store, *conf.ValidAttachments, dryRun)
+}
+
+// gc releases the reservations of store that don't belong to one of valid
+func gc(store backend.Store, valid []Attachment, dryRun bool) (*GCReport, error) {
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	defer store.Unlock()
+
+	// Held IPs are not attached to anything, they go once expired
+	if !dryRun {
+		if err := store.ReleaseExpiredHolds(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	reservations, err := store.ListReservations()
+	if err != nil {
+		return nil, err
+	}
+
+	keep := map[Attachment]bool{}
+	keepID := map[string]bool{}
+	for _, a := range valid {
+		keep[a] = true
+		keepID[a.ContainerID] = true
+	}
+
+	report := &GCReport{DryRun: dryRun, Released: []backend.Reservation{}}
+	var errs []string
+	for _, r := range reservations {
+		if r.HeldFor != "" {
+			continue
+		}
+		// Reservations of old versions belong to all interfaces of the container
+		if keep[Attachment{r.ContainerID, r.IfName}] || (r.IfName == "" && keepID[r.ContainerID]) {
+			continue
+		}
+		if !dryRun {
+			if err := store.Release(r.IP); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to release %s: %v", r.IP, err))
+				continue
+			}
+		}
+		report.Released = append(report.Released, r)
+	}
+
+	if errs != nil {
+		return report, errors.New(strings.Join(errs, ";"))
+	}
+	return report, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host-local gc", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "host_local_gc")
+		Expect(err).NotTo(HaveOccurred())
+
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		for _, r := range []struct {
+			id, ifname, ip string
+		}{
+			{"live", "eth0", "10.1.2.2"},
+			{"live", "eth1", "10.1.2.3"},
+			{"leaked", "eth0", "10.1.2.4"},
+		} {
+			reserved, err := store.Reserve(r.id, r.ifname, net.ParseIP(r.ip), "0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+		// Written by an old version, belongs to all interfaces
+		err = ioutil.WriteFile(filepath.Join(tmpDir, "mynet", "10.1.2.5"), []byte("live"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	gcConf := func(attachments string) string {
+		return fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": "%s"
+			}
+			%s
+		}`, tmpDir, attachments)
+	}
+
+	runAndReport := func(conf string, dryRun bool) (*GCReport, error) {
+		out := &bytes.Buffer{}
+		err := runGC(strings.NewReader(conf), out, dryRun)
+		if out.Len() == 0 {
+			return nil, err
+		}
+		report := &GCReport{}
+		Expect(json.Unmarshal(out.Bytes(), report)).To(Succeed())
+		return report, err
+	}
+
+	reserved := func(ip string) bool {
+		_, err := os.Stat(filepath.Join(tmpDir, "mynet", ip))
+		return err == nil
+	}
+
+	It("reports without releasing on a dry run", func() {
+		report, err := runAndReport(gcConf(`, "cni.dev/valid-attachments": [{"containerID": "live", "ifname": "eth0"}]`), true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.DryRun).To(BeTrue())
+		Expect(report.Released).To(HaveLen(2))
+		Expect(report.Released[0].IP.String()).To(Equal("10.1.2.3"))
+		Expect(report.Released[0].ContainerID).To(Equal("live"))
+		Expect(report.Released[0].IfName).To(Equal("eth1"))
+		Expect(report.Released[1].IP.String()).To(Equal("10.1.2.4"))
+
+		for _, ip := range []string{"10.1.2.2", "10.1.2.3", "10.1.2.4", "10.1.2.5"} {
+			Expect(reserved(ip)).To(BeTrue())
+		}
+	})
+
+	It("releases the reservations of attachments that are gone", func() {
+		report, err := runAndReport(gcConf(`, "cni.dev/valid-attachments": [{"containerID": "live", "ifname": "eth0"}]`), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.DryRun).To(BeFalse())
+		Expect(report.Released).To(HaveLen(2))
+
+		Expect(reserved("10.1.2.2")).To(BeTrue())
+		Expect(reserved("10.1.2.3")).To(BeFalse())
+		Expect(reserved("10.1.2.4")).To(BeFalse())
+		Expect(reserved("10.1.2.5")).To(BeTrue())
+
+		// The released IPs are gone from the index as well
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		Expect(store.GetByID("leaked", "eth0")).To(BeEmpty())
+	})
+
+	It("releases everything if no attachment is valid", func() {
+		report, err := runAndReport(gcConf(`, "cni.dev/valid-attachments": []`), false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Released).To(HaveLen(4))
+	})
+
+	It("requires the list of valid attachments", func() {
+		_, err := runAndReport(gcConf(""), false)
+		Expect(err).To(MatchError("\"cni.dev/valid-attachments\" field is required. It lists the attachments whose IPs are kept."))
+		Expect(reserved("10.1.2.4")).To(BeTrue())
+	})
+})
@@ -15,12 +15,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -28,6 +30,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/testutils"
 
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/kvfile"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -637,6 +640,264 @@ var _ = Describe("host-local Operations", func() {
 			Expect(result.IPs[1].Address.IP).To(Equal(net.ParseIP("2001:db8:1::999")))
 		})
 
+		It(fmt.Sprintf("[%s] delegates a prefix per attachment", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [
+						[{ "subnet": "2001:db8:1::/64", "allocationPrefixLength": 80 }]
+					]
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("2001:db8:1:0:1::/64"))
+			Expect(result.IPs[0].Gateway).To(Equal(net.ParseIP("2001:db8:1::1")))
+			Expect(result.Routes).To(Equal([]*types.Route{{Dst: mustCIDR("2001:db8:1:0:1::/80")}}))
+
+			// One reservation file holds the whole prefix
+			files, err := ioutil.ReadDir(filepath.Join(tmpDir, "mynet"))
+			Expect(err).NotTo(HaveOccurred())
+			reservations := []string{}
+			for _, fi := range files {
+				if !fi.IsDir() && !strings.HasPrefix(fi.Name(), "last_reserved_ip") && fi.Name() != "lock" {
+					reservations = append(reservations, fi.Name())
+				}
+			}
+			Expect(reservations).To(Equal([]string{disk.GetEscapedPath("", "2001:db8:1:0:1::")}))
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = os.Stat(disk.GetEscapedPath(filepath.Join(tmpDir, "mynet"), "2001:db8:1:0:1::"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It(fmt.Sprintf("[%s] keeps reservations in the store selected by the config", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"store": "kvfile",
+					"subnet": "10.1.2.0/24"
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.2/24"))
+			checkArgs := *args
+			checkArgs.StdinData = withPrevResult(conf, r)
+			Expect(cmdCheck(&checkArgs)).To(Succeed())
+
+			store, err := kvfile.New("mynet", tmpDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			Expect(store.GetByID("dummy", ifname)).To(Equal([]net.IP{net.ParseIP("10.1.2.2")}))
+
+			// Nothing went to the default store
+			_, err = os.Stat(filepath.Join(tmpDir, "mynet", "10.1.2.2"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.GetByID("dummy", ifname)).To(BeEmpty())
+			Expect(cmdCheck(&checkArgs)).To(HaveOccurred())
+
+			args.StdinData = []byte(strings.Replace(conf, `"kvfile"`, `"etcd"`, 1))
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(`unknown store "etcd"`))
+		})
+
+		It(fmt.Sprintf("[%s] doesn't reuse released IPs during their reuse delay", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"allocationStrategy": "lowestFree",
+					"ranges": [[{"subnet": "10.1.2.0/24", "reuseDelay": "1h"}]]
+				}
+			}`, ver, tmpDir)
+
+			add := func(id string) string {
+				args := &skel.CmdArgs{ContainerID: id, Netns: nspath, IfName: ifname, StdinData: []byte(conf)}
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				return result.IPs[0].Address.IP.String()
+			}
+
+			Expect(add("c1")).To(Equal("10.1.2.2"))
+			args := &skel.CmdArgs{ContainerID: "c1", Netns: nspath, IfName: ifname, StdinData: []byte(conf)}
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(add("c2")).To(Equal("10.1.2.3"))
+			report, err := cmdStatus([]byte(conf))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.RangeSets[0].Allocations[0].IP.String()).To(Equal("10.1.2.2"))
+			Expect(report.RangeSets[0].Allocations[0].HeldFor).To(Equal("reuse-delay"))
+		})
+
+		It(fmt.Sprintf("[%s] records the pod of each allocation", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"subnet": "10.1.2.0/24"
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+				Args:        "IgnoreUnknown=1;K8S_POD_NAMESPACE=prod;K8S_POD_NAME=db-0",
+			}
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			report, err := cmdStatus([]byte(conf))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.RangeSets[0].Allocations).To(HaveLen(1))
+			meta := report.RangeSets[0].Allocations[0].Metadata
+			Expect(meta).NotTo(BeNil())
+			Expect(meta.Network).To(Equal("mynet"))
+			Expect(meta.PodNamespace).To(Equal("prod"))
+			Expect(meta.PodName).To(Equal("db-0"))
+			Expect(meta.AllocatedAt).To(BeTemporally("~", time.Now(), time.Minute))
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			report, err = cmdStatus([]byte(conf))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.RangeSets[0].Allocations).To(BeEmpty())
+		})
+
+		It(fmt.Sprintf("[%s] checks the addresses against the reservations and ranges", ver), func() {
+			if !testutils.SpecVersionHasCHECK(ver) {
+				return
+			}
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [
+						[{ "subnet": "10.1.2.0/24" }],
+						[{ "subnet": "2001:db8:1::/64" }]
+					]
+				}
+			}`, ver, tmpDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			checkArgs := *args
+			checkArgs.StdinData = withPrevResult(conf, r)
+			Expect(cmdCheck(&checkArgs)).To(Succeed())
+
+			// The v6 address went away
+			store, err := disk.New("mynet", tmpDir)
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			Expect(store.Release(net.ParseIP("2001:db8:1::2"))).To(Succeed())
+			Expect(cmdCheck(&checkArgs)).To(MatchError("host-local: " +
+				"no address reserved in range set 2001:db8:1::1-2001:db8:1:0:ffff:ffff:ffff:ffff; " +
+				"address 2001:db8:1::2 is not reserved"))
+
+			// ... and was given to another container
+			reserved, err := store.Reserve("other", "eth0", net.ParseIP("2001:db8:1::2"), "1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+			Expect(cmdCheck(&checkArgs)).To(MatchError("host-local: " +
+				"no address reserved in range set 2001:db8:1::1-2001:db8:1:0:ffff:ffff:ffff:ffff; " +
+				"address 2001:db8:1::2 is reserved for container other interface eth0"))
+
+			// The ranges no longer hold the v4 address, which has a twin
+			reserved, err = store.Reserve("dummy", ifname, net.ParseIP("10.1.3.2"), "0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+			checkArgs.StdinData = withPrevResult(strings.Replace(conf, "10.1.2.0/24", "10.1.3.0/24", 1), r)
+			Expect(cmdCheck(&checkArgs)).To(MatchError("host-local: " +
+				"no address reserved in range set 2001:db8:1::1-2001:db8:1:0:ffff:ffff:ffff:ffff; " +
+				"address 10.1.2.2 is in none of the configured ranges; " +
+				"address 2001:db8:1::2 is reserved for container other interface eth0; " +
+				"reserved address 10.1.3.2 is missing from prevResult"))
+
+			// Without a previous result there is nothing to check
+			Expect(cmdCheck(args)).To(MatchError("Required prevResult missing"))
+		})
+
 		It(fmt.Sprintf("[%s] fails if a requested custom IP is not used", ver), func() {
 			conf := fmt.Sprintf(`{
 				"cniVersion": "%s",
@@ -681,6 +942,18 @@ var _ = Describe("host-local Operations", func() {
 	}
 })
 
+// withPrevResult adds result to the network configuration conf
+func withPrevResult(conf string, result types.Result) []byte {
+	netConf := map[string]interface{}{}
+	Expect(json.Unmarshal([]byte(conf), &netConf)).To(Succeed())
+	data, err := json.Marshal(result)
+	Expect(err).NotTo(HaveOccurred())
+	netConf["prevResult"] = json.RawMessage(data)
+	stdinData, err := json.Marshal(netConf)
+	Expect(err).NotTo(HaveOccurred())
+	return stdinData
+}
+
 func mustCIDR(s string) net.IPNet {
 	ip, n, err := net.ParseCIDR(s)
 	n.IP = ip
@@ -15,13 +15,18 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"log"
 	"net"
+	"os"
 	"strings"
 
+	"github.com/containernetworking/plugins/pkg/dns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
-	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -30,34 +35,139 @@ import (
 )
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("host-local"))
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		var dryRun bool
+		gcFlags := flag.NewFlagSet("gc", flag.ExitOnError)
+		gcFlags.BoolVar(&dryRun, "dry-run", false, "only report the reservations that would be released")
+		gcFlags.Parse(os.Args[2:])
+
+		if err := runGC(os.Stdin, os.Stdout, dryRun); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) > 1 && os.Args[1] == "status" {
+		var confPath string
+		var asJSON bool
+		statusFlags := flag.NewFlagSet("status", flag.ExitOnError)
+		statusFlags.StringVar(&confPath, "config", "", "read the network configuration from this file instead of stdin")
+		statusFlags.BoolVar(&asJSON, "json", false, "print the status as JSON")
+		statusFlags.Parse(os.Args[2:])
+
+		if err := runStatus(os.Stdin, os.Stdout, confPath, asJSON); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+	} else {
+		skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("host-local"))
+	}
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-
 	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
 	if err != nil {
 		return err
 	}
 
-	// Look to see if there is at least one IP address allocated to the container
-	// in the data dir, irrespective of what that address actually is
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	// Get PrevResult from stdin... store in RawPrevResult
+	n := &types.NetConf{}
+	if err := json.Unmarshal(args.StdinData, n); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+	if err := version.ParsePrevResult(n); err != nil {
+		return err
+	}
+	result, err := current.NewResultFromResult(n.PrevResult)
 	if err != nil {
 		return err
 	}
-	defer store.Close()
 
-	containerIpFound := store.FindByID(args.ContainerID, args.IfName)
-	if containerIpFound == false {
-		return fmt.Errorf("host-local: Failed to find address added by container %v", args.ContainerID)
+	store, err := newStore(ipamConf)
+	if err != nil {
+		return err
 	}
+	defer store.Close()
+
+	store.Lock()
+	defer store.Unlock()
 
+	if errors := checkAllocations(store, ipamConf, args.ContainerID, args.IfName, result); errors != nil {
+		return fmt.Errorf("host-local: %s", strings.Join(errors, "; "))
+	}
 	return nil
 }
 
+// checkAllocations compares the IPs of result with the reservations of the
+// interface in store, and with the range sets of ipamConf. It returns the
+// mismatches found.
+func checkAllocations(store backend.Store, ipamConf *allocator.IPAMConfig, id, ifname string, result *current.Result) []string {
+	reservations, err := store.ListReservations()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	owners := map[string]backend.Reservation{}
+	for _, r := range reservations {
+		owners[r.IP.String()] = r
+	}
+
+	var errors []string
+
+	// Each range set has given the interface one IP
+	reserved := store.GetByID(id, ifname)
+	for _, rangeset := range ipamConf.Ranges {
+		var found []string
+		for _, ip := range reserved {
+			if rangeset.Contains(ip) {
+				found = append(found, ip.String())
+			}
+		}
+		if len(found) == 0 {
+			errors = append(errors, fmt.Sprintf("no address reserved in range set %s", rangeset.String()))
+		} else if len(found) > 1 {
+			errors = append(errors, fmt.Sprintf("%d addresses reserved in range set %s: %s", len(found), rangeset.String(), strings.Join(found, ", ")))
+		}
+	}
+
+	// The IPs of the result are the ones reserved, in the range sets
+	inResult := map[string]bool{}
+	for _, ipc := range result.IPs {
+		addr := ipc.Address.IP
+		inResult[addr.String()] = true
+
+		owner, ok := owners[addr.String()]
+		switch {
+		case !ok:
+			errors = append(errors, fmt.Sprintf("address %s is not reserved", addr))
+		case owner.HeldFor != "":
+			errors = append(errors, fmt.Sprintf("address %s is held for %q", addr, owner.HeldFor))
+		case owner.ContainerID != id || (owner.IfName != ifname && owner.IfName != ""):
+			errors = append(errors, fmt.Sprintf("address %s is reserved for container %s interface %s", addr, owner.ContainerID, owner.IfName))
+		}
+
+		inRanges := false
+		for _, rangeset := range ipamConf.Ranges {
+			if rangeset.Contains(addr) {
+				inRanges = true
+				break
+			}
+		}
+		if !inRanges {
+			errors = append(errors, fmt.Sprintf("address %s is in none of the configured ranges", addr))
+		}
+	}
+	for _, ip := range reserved {
+		if !inResult[ip.String()] {
+			errors = append(errors, fmt.Sprintf("reserved address %s is missing from prevResult", ip))
+		}
+	}
+
+	return errors
+}
+
 func cmdAdd(args *skel.CmdArgs) error {
-	ipamConf, confVersion, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
+	ipamConf, confVersion, err := allocator.LoadIPAMConfigForAdd(args.StdinData, args.Args)
 	if err != nil {
 		return err
 	}
@@ -65,14 +175,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
 
 	if ipamConf.ResolvConf != "" {
-		dns, err := parseResolvConf(ipamConf.ResolvConf)
+		resolvConf, err := dns.ParseResolvConf(ipamConf.ResolvConf)
 		if err != nil {
 			return err
 		}
-		result.DNS = *dns
+		result.DNS = *resolvConf
 	}
 
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	store, err := newStore(ipamConf)
 	if err != nil {
 		return err
 	}
@@ -86,12 +196,16 @@ func cmdAdd(args *skel.CmdArgs) error {
 	// and error if some remain
 	requestedIPs := map[string]net.IP{} //net.IP cannot be a key
 
+	// Routes to the prefixes delegated by the ranges that delegate any
+	prefixRoutes := []*types.Route{}
+
 	for _, ip := range ipamConf.IPArgs {
 		requestedIPs[ip.String()] = ip
 	}
 
 	for idx, rangeset := range ipamConf.Ranges {
 		allocator := allocator.NewIPAllocator(&rangeset, store, idx)
+		allocator.Configure(ipamConf)
 
 		// Check to see if there are any custom IPs requested in this range.
 		var requestedIP net.IP
@@ -115,6 +229,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 		allocs = append(allocs, allocator)
 
 		result.IPs = append(result.IPs, ipConf)
+
+		// The delegated prefix is routed to the attachment, with no gateway
+		// as it is on the link
+		if prefix := allocator.DelegatedPrefix(ipConf.Address.IP); prefix != nil {
+			prefixRoutes = append(prefixRoutes, &types.Route{Dst: *prefix})
+		}
 	}
 
 	// If an IP was requested that wasn't fulfilled, fail
@@ -129,7 +249,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf(errstr)
 	}
 
-	result.Routes = ipamConf.Routes
+	result.Routes = append(ipamConf.Routes, prefixRoutes...)
 
 	return types.PrintResult(result, confVersion)
 }
@@ -140,17 +260,30 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	store, err := newStore(ipamConf)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	// Loop through all ranges, releasing all IPs, even if an error occurs
+	ipAllocators := []*allocator.IPAllocator{}
+	for idx := range ipamConf.Ranges {
+		ipAllocator := allocator.NewIPAllocator(&ipamConf.Ranges[idx], store, idx)
+		ipAllocator.Configure(ipamConf)
+		ipAllocators = append(ipAllocators, ipAllocator)
+	}
+
+	// Keep the IPs of sticky range sets and ranges with a reuse delay aside
+	// first, releasing drops the IPs of all range sets
 	var errors []string
-	for idx, rangeset := range ipamConf.Ranges {
-		ipAllocator := allocator.NewIPAllocator(&rangeset, store, idx)
+	for _, ipAllocator := range ipAllocators {
+		if err := ipAllocator.Hold(args.ContainerID, args.IfName); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
 
+	// Loop through all ranges, releasing all IPs, even if an error occurs
+	for _, ipAllocator := range ipAllocators {
 		err := ipAllocator.Release(args.ContainerID, args.IfName)
 		if err != nil {
 			errors = append(errors, err.Error())
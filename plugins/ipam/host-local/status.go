@@ -0,0 +1,204 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+// StatusReport describes the allocations of a network
+type StatusReport struct {
+	Network   string           `json:"network"`
+	RangeSets []RangeSetStatus `json:"rangeSets"`
+	// Reservations outside of all range sets, left over by an older
+	// configuration of the network
+	Orphaned []backend.Reservation `json:"orphaned"`
+}
+
+// RangeSetStatus describes the allocations of one range set. The IP counts
+// don't fit in an int64 for IPv6 ranges.
+type RangeSetStatus struct {
+	Ranges         []string              `json:"ranges"`
+	LastReservedIP net.IP                `json:"lastReservedIP,omitempty"`
+	Capacity       *big.Int              `json:"capacity"`
+	Allocated      int                   `json:"allocated"`
+	Free           *big.Int              `json:"free"`
+	Utilization    float64               `json:"utilization"` // Allocated over capacity, from 0 to 1
+	Allocations    []backend.Reservation `json:"allocations"`
+}
+
+// runStatus reads the network configuration from in, or from the file at
+// confPath if set, and writes its status to out
+func runStatus(in io.Reader, out io.Writer, confPath string, asJSON bool) error {
+	var stdinData []byte
+	var err error
+	if confPath != "" {
+		stdinData, err = ioutil.ReadFile(confPath)
+	} else {
+		stdinData, err = ioutil.ReadAll(in)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the network configuration: %v", err)
+	}
+
+	report, err := cmdStatus(stdinData)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		return enc.Encode(report)
+	}
+	return printStatus(out, report)
+}
+
+// cmdStatus reports the allocations of the network configured in stdinData
+func cmdStatus(stdinData []byte) (*StatusReport, error) {
+	ipamConf, _, err := allocator.LoadIPAMConfig(stdinData, "")
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openStore(ipamConf)
+	if os.IsNotExist(err) {
+		// Nothing was allocated in the network yet
+		return status(nil, ipamConf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	return status(store, ipamConf)
+}
+
+// status reports the allocations of store in the range sets of ipamConf. A
+// nil store has no allocations.
+func status(store backend.Store, ipamConf *allocator.IPAMConfig) (*StatusReport, error) {
+	var reservations []backend.Reservation
+	if store != nil {
+		// status only reads the store, so it shares the lock with other readers
+		if err := store.RLock(); err != nil {
+			return nil, err
+		}
+		defer store.RUnlock()
+
+		var err error
+		if reservations, err = store.ListReservations(); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &StatusReport{Network: ipamConf.Name, Orphaned: []backend.Reservation{}}
+	for idx, rangeset := range ipamConf.Ranges {
+		s := RangeSetStatus{Capacity: big.NewInt(0), Allocations: []backend.Reservation{}}
+		for i := range rangeset {
+			s.Ranges = append(s.Ranges, rangeset[i].String())
+			s.Capacity.Add(s.Capacity, rangeset[i].Capacity())
+		}
+		if store != nil {
+			if ip, err := store.LastReservedIP(strconv.Itoa(idx)); err == nil && rangeset.Contains(ip) {
+				s.LastReservedIP = ip
+			}
+		}
+		report.RangeSets = append(report.RangeSets, s)
+	}
+
+	for _, r := range reservations {
+		found := false
+		for idx, rangeset := range ipamConf.Ranges {
+			if rangeset.Contains(r.IP) {
+				s := &report.RangeSets[idx]
+				s.Allocations = append(s.Allocations, r)
+				found = true
+				break
+			}
+		}
+		if !found {
+			report.Orphaned = append(report.Orphaned, r)
+		}
+	}
+
+	for idx := range report.RangeSets {
+		s := &report.RangeSets[idx]
+		s.Allocated = len(s.Allocations)
+		s.Free = new(big.Int).Sub(s.Capacity, big.NewInt(int64(s.Allocated)))
+		if s.Free.Sign() < 0 {
+			s.Free.SetInt64(0)
+		}
+		if s.Capacity.Sign() > 0 {
+			s.Utilization, _ = new(big.Float).Quo(
+				new(big.Float).SetInt64(int64(s.Allocated)),
+				new(big.Float).SetInt(s.Capacity),
+			).Float64()
+		}
+	}
+	return report, nil
+}
+
+// printStatus writes report to out in a human readable form
+func printStatus(out io.Writer, report *StatusReport) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "network %s\n", report.Network)
+	for idx, s := range report.RangeSets {
+		fmt.Fprintf(w, "\nrange set %d: %v\n", idx, s.Ranges)
+		if s.LastReservedIP != nil {
+			fmt.Fprintf(w, "last reserved IP: %s\n", s.LastReservedIP)
+		}
+		fmt.Fprintf(w, "allocated %d of %s, %s free (%.1f%% used)\n", s.Allocated, s.Capacity, s.Free, s.Utilization*100)
+		printReservations(w, s.Allocations)
+	}
+	if len(report.Orphaned) > 0 {
+		fmt.Fprintf(w, "\noutside of all range sets:\n")
+		printReservations(w, report.Orphaned)
+	}
+	return w.Flush()
+}
+
+func printReservations(w io.Writer, reservations []backend.Reservation) {
+	if len(reservations) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "IP\tCONTAINER ID\tIFNAME\tALLOCATED\tPOD\n")
+	for _, r := range reservations {
+		id := r.ContainerID
+		if r.HeldFor != "" {
+			id = fmt.Sprintf("(held for %s)", r.HeldFor)
+		}
+		// Reservations made by old versions have no metadata
+		allocated, pod := "-", "-"
+		if r.Metadata != nil {
+			allocated = r.Metadata.AllocatedAt.Format(time.RFC3339)
+			if r.Metadata.PodName != "" {
+				pod = r.Metadata.PodNamespace + "/" + r.Metadata.PodName
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.IP, id, r.IfName, allocated, pod)
+	}
+}
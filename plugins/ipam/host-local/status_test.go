@@ -0,0 +1,147 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host-local status", func() {
+	var tmpDir, conf string
+	allocatedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "host_local_status")
+		Expect(err).NotTo(HaveOccurred())
+
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		for _, r := range []struct {
+			id, ifname, ip, rangeID, pod string
+		}{
+			{"old", "eth0", "10.9.0.2", "0", ""},
+			{"c1", "eth0", "10.1.2.2", "0", "web-0"},
+			{"c2", "eth0", "10.1.2.3", "0", ""},
+			{"c1", "eth0", "2001:db8::2", "1", "web-0"},
+		} {
+			meta := backend.Metadata{AllocatedAt: allocatedAt, Network: "mynet"}
+			if r.pod != "" {
+				meta.PodNamespace, meta.PodName = "default", r.pod
+			}
+			reserved, err := store.ReserveWithMetadata(r.id, r.ifname, net.ParseIP(r.ip), r.rangeID, meta)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+		Expect(store.HoldIP("db-0", net.ParseIP("10.1.2.3"), time.Now().Add(time.Hour))).To(Succeed())
+
+		conf = fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{"subnet": "10.1.2.0/24", "exclude": ["10.1.2.128/25"]}],
+					[{"subnet": "2001:db8::/64"}]
+				]
+			}
+		}`, tmpDir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("reports the allocations of each range set as JSON", func() {
+		out := &bytes.Buffer{}
+		Expect(runStatus(strings.NewReader(conf), out, "", true)).To(Succeed())
+
+		report := &StatusReport{}
+		Expect(json.Unmarshal(out.Bytes(), report)).To(Succeed())
+		Expect(report.Network).To(Equal("mynet"))
+		Expect(report.RangeSets).To(HaveLen(2))
+
+		v4 := report.RangeSets[0]
+		Expect(v4.Ranges).To(Equal([]string{"10.1.2.1-10.1.2.254"}))
+		Expect(v4.LastReservedIP.String()).To(Equal("10.1.2.3"))
+		Expect(v4.Capacity.Int64()).To(Equal(int64(126)))
+		Expect(v4.Allocated).To(Equal(2))
+		Expect(v4.Free.Int64()).To(Equal(int64(124)))
+		Expect(v4.Utilization).To(BeNumerically("~", 2.0/126))
+		Expect(v4.Allocations[0].ContainerID).To(Equal("c1"))
+		Expect(v4.Allocations[0].IfName).To(Equal("eth0"))
+		Expect(v4.Allocations[0].Metadata.PodName).To(Equal("web-0"))
+		Expect(v4.Allocations[0].Metadata.AllocatedAt.Equal(allocatedAt)).To(BeTrue())
+		Expect(v4.Allocations[1].HeldFor).To(Equal("db-0"))
+
+		v6 := report.RangeSets[1]
+		Expect(v6.Capacity.String()).To(Equal("18446744073709551614"))
+		Expect(v6.Allocated).To(Equal(1))
+		Expect(v6.LastReservedIP.String()).To(Equal("2001:db8::2"))
+
+		Expect(report.Orphaned).To(HaveLen(1))
+		Expect(report.Orphaned[0].IP.String()).To(Equal("10.9.0.2"))
+	})
+
+	It("reads the configuration from a file and prints a table", func() {
+		confPath := filepath.Join(tmpDir, "mynet.conf")
+		Expect(ioutil.WriteFile(confPath, []byte(conf), 0644)).To(Succeed())
+
+		out := &bytes.Buffer{}
+		Expect(runStatus(strings.NewReader(""), out, confPath, false)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("allocated 2 of 126, 124 free (1.6% used)"))
+		Expect(out.String()).To(ContainSubstring("(held for db-0)"))
+		Expect(out.String()).To(MatchRegexp(`10\.1\.2\.2\s+c1\s+eth0\s+2021-06-01T12:00:00Z\s+default/web-0`))
+		Expect(out.String()).To(ContainSubstring("outside of all range sets"))
+	})
+
+	It("leaves the data directory untouched", func() {
+		// No index is built for the reservations status reads
+		Expect(os.RemoveAll(filepath.Join(tmpDir, "mynet", "by-id"))).To(Succeed())
+		out := &bytes.Buffer{}
+		Expect(runStatus(strings.NewReader(conf), out, "", true)).To(Succeed())
+		_, err := os.Stat(filepath.Join(tmpDir, "mynet", "by-id"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		// A network without a data directory has no allocations
+		out.Reset()
+		Expect(runStatus(strings.NewReader(strings.Replace(conf, `"mynet"`, `"othernet"`, 1)), out, "", true)).To(Succeed())
+		report := &StatusReport{}
+		Expect(json.Unmarshal(out.Bytes(), report)).To(Succeed())
+		Expect(report.RangeSets).To(HaveLen(2))
+		Expect(report.RangeSets[0].Allocated).To(BeZero())
+		Expect(report.RangeSets[0].Free.Int64()).To(Equal(int64(126)))
+		_, err = os.Stat(filepath.Join(tmpDir, "othernet"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,53 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/kvfile"
+)
+
+// The backends the "store" field selects
+const (
+	storeDisk   = "disk"   // A file per reserved IP, the default
+	storeKVFile = "kvfile" // All reservations in a single bbolt database
+)
+
+// newStore opens the backend that keeps the reservations of the network
+func newStore(ipamConf *allocator.IPAMConfig) (backend.Store, error) {
+	switch ipamConf.Store {
+	case "", storeDisk:
+		return disk.New(ipamConf.Name, ipamConf.DataDir)
+	case storeKVFile:
+		return kvfile.New(ipamConf.Name, ipamConf.DataDir)
+	}
+	return nil, fmt.Errorf("unknown store %q", ipamConf.Store)
+}
+
+// openStore is newStore for the commands that only read the store. The
+// error satisfies os.IsNotExist if the network has no data directory yet.
+func openStore(ipamConf *allocator.IPAMConfig) (backend.Store, error) {
+	switch ipamConf.Store {
+	case "", storeDisk:
+		return disk.Open(ipamConf.Name, ipamConf.DataDir)
+	case storeKVFile:
+		return kvfile.Open(ipamConf.Name, ipamConf.DataDir)
+	}
+	return nil, fmt.Errorf("unknown store %q", ipamConf.Store)
+}
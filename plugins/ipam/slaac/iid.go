@@ -0,0 +1,158 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"unsafe"
+)
+
+// SLAAC prefixes are /64s, leaving 64 bits to the interface identifier
+const iidLen = 8
+
+// idgenRetries is how many times the kernel increments the DAD counter of
+// a stable-privacy address whose identifier is reserved, the default of
+// the idgen_retries sysctl
+const idgenRetries = 3
+
+// maxAddrLen is the room the kernel leaves for hardware addresses, its
+// MAX_ADDR_LEN
+const maxAddrLen = 32
+
+// eui64Address returns the address of prefix with the modified EUI-64
+// interface identifier of mac, as in RFC 4291 appendix A. This is the
+// address the kernel autoconfigures with the default addr_gen_mode.
+func eui64Address(prefix *net.IPNet, mac net.HardwareAddr) (net.IP, error) {
+	iid := make([]byte, iidLen)
+	switch len(mac) {
+	case 6:
+		copy(iid[0:3], mac[0:3])
+		iid[3] = 0xff
+		iid[4] = 0xfe
+		copy(iid[5:8], mac[3:6])
+	case 8:
+		copy(iid, mac)
+	default:
+		return nil, fmt.Errorf("MAC address %s is neither an EUI-48 nor an EUI-64", mac)
+	}
+	// flip the universal/local bit
+	iid[0] ^= 0x02
+	return withIID(prefix, iid), nil
+}
+
+// stablePrivacyAddress returns the address of prefix with the RFC 7217
+// interface identifier the kernel generates with the stable_privacy
+// addr_gen_mode, for the stable_secret secret and the DAD counter
+// dadCounter. Like ipv6_generate_stable_address, it hashes a single SHA-1
+// block of the secret, the prefix, the permanent hardware address permAddr
+// of the interface (nil for virtual interfaces, which have none) and the
+// counter, and increments the counter while the identifier is reserved.
+func stablePrivacyAddress(prefix *net.IPNet, secret net.IP, permAddr net.HardwareAddr, dadCounter int) (net.IP, error) {
+	if len(permAddr) > maxAddrLen {
+		return nil, fmt.Errorf("hardware address %s is too long", permAddr)
+	}
+	for ; dadCounter <= idgenRetries; dadCounter++ {
+		var block [64]byte
+		copy(block[0:16], secret.To16())
+		copy(block[16:24], prefix.IP.To16()[:iidLen])
+		copy(block[24:24+maxAddrLen], permAddr)
+		block[24+maxAddrLen] = byte(dadCounter)
+
+		// The words of the digest are stored as they are in memory
+		digest := sha1Transform(&block)
+		iid := make([]byte, iidLen)
+		hostEndian.PutUint32(iid[0:4], digest[0])
+		hostEndian.PutUint32(iid[4:8], digest[1])
+		if !reservedIID(iid) {
+			return withIID(prefix, iid), nil
+		}
+	}
+	return nil, fmt.Errorf("no unreserved stable-privacy interface identifier on %s", prefix)
+}
+
+// reservedIID returns true if the kernel doesn't use iid for stable-privacy
+// addresses, as ipv6_reserved_interfaceid: the Subnet-Router anycast
+// identifier, those of the IANA Ethernet block and the reserved subnet
+// anycast identifiers (RFC 5453)
+func reservedIID(iid []byte) bool {
+	hi := binary.BigEndian.Uint32(iid[0:4])
+	lo := binary.BigEndian.Uint32(iid[4:8])
+	switch {
+	case hi == 0 && lo == 0:
+		return true
+	case hi == 0x02005eff && lo&0xfe000000 == 0xfe000000:
+		return true
+	case hi == 0xfdffffff && lo&0xffffff80 == 0xffffff80:
+		return true
+	}
+	return false
+}
+
+// sha1Transform returns the state of SHA-1 after processing block, without
+// the padding and length of a full digest, as the kernel's sha1_transform
+func sha1Transform(block *[64]byte) [5]uint32 {
+	h := [5]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0}
+
+	var w [80]uint32
+	for i := 0; i < 16; i++ {
+		w[i] = binary.BigEndian.Uint32(block[i*4:])
+	}
+	for i := 16; i < 80; i++ {
+		w[i] = bits.RotateLeft32(w[i-3]^w[i-8]^w[i-14]^w[i-16], 1)
+	}
+
+	a, b, c, d, e := h[0], h[1], h[2], h[3], h[4]
+	for i := 0; i < 80; i++ {
+		var f, k uint32
+		switch {
+		case i < 20:
+			f, k = b&c|^b&d, 0x5a827999
+		case i < 40:
+			f, k = b^c^d, 0x6ed9eba1
+		case i < 60:
+			f, k = b&c|b&d|c&d, 0x8f1bbcdc
+		default:
+			f, k = b^c^d, 0xca62c1d6
+		}
+		t := bits.RotateLeft32(a, 5) + f + e + k + w[i]
+		a, b, c, d, e = t, a, bits.RotateLeft32(b, 30), c, d
+	}
+
+	h[0] += a
+	h[1] += b
+	h[2] += c
+	h[3] += d
+	h[4] += e
+	return h
+}
+
+// hostEndian is the byte order of the host, and of its kernel
+var hostEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+func withIID(prefix *net.IPNet, iid []byte) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:iidLen])
+	copy(ip[iidLen:], iid)
+	return ip
+}
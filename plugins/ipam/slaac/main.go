@@ -0,0 +1,309 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The slaac IPAM plugin returns the IPv6 address an interface gets by
+// stateless autoconfiguration on a prefix a router advertises, so the
+// runtime knows it without waiting for router advertisements or running
+// DHCPv6. The address is derived from the MAC of the interface, which the
+// plugin takes from the prevResult or from the MAC the runtime sets, or is
+// the stable-privacy address the kernel derives from a secret.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/dns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	// modeEUI64 derives the interface identifier from the MAC, RFC 4291
+	modeEUI64 = "eui64"
+	// modeStablePrivacy derives an opaque interface identifier, RFC 7217
+	modeStablePrivacy = "stable-privacy"
+)
+
+// The top-level network config - IPAM plugins are passed the full configuration
+// of the calling plugin, not just the IPAM section.
+type Net struct {
+	Name          string      `json:"name"`
+	CNIVersion    string      `json:"cniVersion"`
+	IPAM          *IPAMConfig `json:"ipam"`
+	RawPrevResult interface{} `json:"prevResult,omitempty"`
+
+	RuntimeConfig struct {
+		Mac string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+	Args *struct {
+		A *IPAMArgs `json:"cni"`
+	} `json:"args"`
+}
+
+type IPAMConfig struct {
+	Name string
+	Type string `json:"type"`
+	// Prefix is the /64 the router advertises
+	Prefix  types.IPNet    `json:"prefix"`
+	Gateway net.IP         `json:"gateway,omitempty"`
+	Routes  []*types.Route `json:"routes"`
+	DNS     types.DNS      `json:"dns"`
+	// Mode is how the interface identifier is derived, "eui64" (the
+	// default) or "stable-privacy"
+	Mode string `json:"mode,omitempty"`
+	// StableSecret or StableSecretFile hold the stable_secret of the
+	// stable-privacy mode, in the IPv6 address format of the sysctl
+	StableSecret     string `json:"stableSecret,omitempty"`
+	StableSecretFile string `json:"stableSecretFile,omitempty"`
+	// DADCounter is the DAD counter of the stable-privacy address, which
+	// the kernel increments when duplicate address detection fails
+	DADCounter int `json:"dadCounter,omitempty"`
+	// PermanentMAC is set when the MAC of the interface is its permanent
+	// address, which the kernel then hashes into stable-privacy addresses
+	PermanentMAC bool `json:"permanentMAC,omitempty"`
+
+	stableSecret net.IP
+}
+
+type IPAMEnvArgs struct {
+	types.CommonArgs
+	MAC types.UnmarshallableString `json:"mac,omitempty"`
+}
+
+type IPAMArgs struct {
+	Mac string `json:"mac,omitempty"`
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("slaac"))
+}
+
+// LoadIPAMConfig creates IPAMConfig using json encoded configuration provided
+// as `data`
+func LoadIPAMConfig(data []byte) (*IPAMConfig, string, error) {
+	n := Net{}
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, "", err
+	}
+	if n.IPAM == nil {
+		return nil, "", fmt.Errorf("IPAM config missing 'ipam' key")
+	}
+
+	prefix := net.IPNet(n.IPAM.Prefix)
+	if prefix.IP == nil {
+		return nil, "", fmt.Errorf("slaac: missing prefix")
+	}
+	if prefix.IP.To4() != nil {
+		return nil, "", fmt.Errorf("slaac: prefix %s is not an IPv6 prefix", prefix.String())
+	}
+	if ones, _ := prefix.Mask.Size(); ones != 64 {
+		return nil, "", fmt.Errorf("slaac: prefix %s is not a /64", prefix.String())
+	}
+	prefix.IP = prefix.IP.Mask(prefix.Mask)
+	n.IPAM.Prefix = types.IPNet(prefix)
+	if n.IPAM.Gateway != nil && n.IPAM.Gateway.To4() != nil {
+		return nil, "", fmt.Errorf("slaac: gateway %s is not an IPv6 address", n.IPAM.Gateway)
+	}
+
+	switch n.IPAM.Mode {
+	case "":
+		n.IPAM.Mode = modeEUI64
+	case modeEUI64:
+	case modeStablePrivacy:
+		secret := n.IPAM.StableSecret
+		if n.IPAM.StableSecretFile != "" {
+			b, err := ioutil.ReadFile(n.IPAM.StableSecretFile)
+			if err != nil {
+				return nil, "", fmt.Errorf("slaac: failed to read stableSecretFile: %v", err)
+			}
+			secret = strings.TrimSpace(string(b))
+		}
+		if secret == "" {
+			return nil, "", fmt.Errorf("slaac: mode %q requires a stableSecret or stableSecretFile", modeStablePrivacy)
+		}
+		n.IPAM.stableSecret = net.ParseIP(secret)
+		if n.IPAM.stableSecret == nil || !strings.Contains(secret, ":") {
+			return nil, "", fmt.Errorf("slaac: stable secret is not in the format of an IPv6 address")
+		}
+		if n.IPAM.DADCounter < 0 || n.IPAM.DADCounter > idgenRetries {
+			return nil, "", fmt.Errorf("slaac: dadCounter %d is not between 0 and %d", n.IPAM.DADCounter, idgenRetries)
+		}
+	default:
+		return nil, "", fmt.Errorf("slaac: unknown mode %q", n.IPAM.Mode)
+	}
+
+	if err := dns.Validate(n.IPAM.DNS); err != nil {
+		return nil, "", err
+	}
+
+	// Copy net name into IPAM so not to drag Net struct around
+	n.IPAM.Name = n.Name
+
+	return n.IPAM, n.CNIVersion, nil
+}
+
+// containerMAC returns the MAC of the interface ifName. The MAC in the
+// prevResult is the one the interface has, and wins; otherwise the MAC the
+// runtime asks the main plugin to set is used, from CNI_ARGS, args or
+// runtimeConfig in increasing precedence, as bridge does.
+func containerMAC(stdinData []byte, envArgs string, ifName string) (net.HardwareAddr, error) {
+	n := Net{}
+	if err := json.Unmarshal(stdinData, &n); err != nil {
+		return nil, err
+	}
+
+	mac := ""
+	if envArgs != "" {
+		e := IPAMEnvArgs{}
+		if err := types.LoadArgs(envArgs, &e); err != nil {
+			return nil, err
+		}
+		mac = string(e.MAC)
+	}
+	if n.Args != nil && n.Args.A != nil && n.Args.A.Mac != "" {
+		mac = n.Args.A.Mac
+	}
+	if n.RuntimeConfig.Mac != "" {
+		mac = n.RuntimeConfig.Mac
+	}
+
+	if n.RawPrevResult != nil {
+		result, err := prevResult(stdinData)
+		if err != nil {
+			return nil, err
+		}
+		for _, intf := range result.Interfaces {
+			if intf.Name == ifName && intf.Sandbox != "" && intf.Mac != "" {
+				mac = intf.Mac
+				break
+			}
+		}
+	}
+
+	if mac == "" {
+		return nil, fmt.Errorf("slaac: no MAC address for interface %s, set one in runtimeConfig, args or CNI_ARGS", ifName)
+	}
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, fmt.Errorf("slaac: invalid MAC address %q: %v", mac, err)
+	}
+	return hwAddr, nil
+}
+
+// prevResult parses the prevResult of stdinData
+func prevResult(stdinData []byte) (*current.Result, error) {
+	n := &types.NetConf{}
+	if err := json.Unmarshal(stdinData, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if err := version.ParsePrevResult(n); err != nil {
+		return nil, err
+	}
+	return current.NewResultFromResult(n.PrevResult)
+}
+
+// address returns the address the interface of args gets on the prefix of
+// ipamConf. Stable-privacy addresses only depend on the MAC when it is
+// permanent; virtual interfaces have none, even when their MAC is set.
+func address(ipamConf *IPAMConfig, args *skel.CmdArgs) (*net.IPNet, error) {
+	prefix := net.IPNet(ipamConf.Prefix)
+
+	var mac net.HardwareAddr
+	if ipamConf.Mode == modeEUI64 || ipamConf.PermanentMAC {
+		var err error
+		mac, err = containerMAC(args.StdinData, args.Args, args.IfName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ip net.IP
+	var err error
+	if ipamConf.Mode == modeStablePrivacy {
+		ip, err = stablePrivacyAddress(&prefix, ipamConf.stableSecret, mac, ipamConf.DADCounter)
+	} else {
+		ip, err = eui64Address(&prefix, mac)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("slaac: %v", err)
+	}
+	return &net.IPNet{IP: ip, Mask: prefix.Mask}, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	ipamConf, confVersion, err := LoadIPAMConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	addr, err := address(ipamConf, args)
+	if err != nil {
+		return err
+	}
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		IPs: []*current.IPConfig{{
+			Address: *addr,
+			Gateway: ipamConf.Gateway,
+		}},
+		Routes: ipamConf.Routes,
+		DNS:    ipamConf.DNS,
+	}
+
+	return types.PrintResult(result, confVersion)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	ipamConf, _, err := LoadIPAMConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	n := Net{}
+	if err := json.Unmarshal(args.StdinData, &n); err != nil {
+		return err
+	}
+	if n.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+	result, err := prevResult(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	addr, err := address(ipamConf, args)
+	if err != nil {
+		return err
+	}
+
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.Equal(addr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("slaac: address %s of interface %s not found in prevResult", addr.IP, args.IfName)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	// Addresses are derived, not allocated, so there is nothing to release
+	return nil
+}
@@ -0,0 +1,335 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("slaac Operations", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "slaac_test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	add := func(conf string, cniArgs string) (*types100.Result, error) {
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/some/where",
+			IfName:      "eth0",
+			Args:        cniArgs,
+			StdinData:   []byte(conf),
+		}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return types100.GetResult(r)
+	}
+
+	for _, ver := range testutils.AllSpecVersions {
+		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+		ver := ver
+
+		It(fmt.Sprintf("[%s] returns the EUI-64 address of the runtime MAC with ADD/DEL", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "bridge",
+				"ipam": {
+					"type": "slaac",
+					"prefix": "2001:db8:1::/64",
+					"gateway": "fe80::1",
+					"routes": [{ "dst": "::/0" }],
+					"dns": { "nameservers": ["2001:db8::53"] }
+				},
+				"runtimeConfig": { "mac": "00:11:22:33:44:55" }
+			}`, ver)
+
+			result, err := add(conf, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("2001:db8:1:0:211:22ff:fe33:4455/64"))
+			Expect(result.IPs[0].Gateway).To(Equal(net.ParseIP("fe80::1")))
+			Expect(result.Routes).To(Equal([]*types.Route{{Dst: mustCIDR("::/0")}}))
+			Expect(result.DNS.Nameservers).To(Equal([]string{"2001:db8::53"}))
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       "/some/where",
+				IfName:      "eth0",
+				StdinData:   []byte(conf),
+			}
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] takes the MAC from CNI_ARGS and args", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "bridge",
+				"ipam": { "type": "slaac", "prefix": "2001:db8:1::/64" }
+			}`, ver)
+
+			result, err := add(conf, "IgnoreUnknown=1;MAC=02:00:00:00:00:01")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address.IP.String()).To(Equal("2001:db8:1::ff:fe00:1"))
+
+			conf = fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "bridge",
+				"ipam": { "type": "slaac", "prefix": "2001:db8:1::/64" },
+				"args": { "cni": { "mac": "02:00:00:00:00:02" } }
+			}`, ver)
+
+			result, err = add(conf, "IgnoreUnknown=1;MAC=02:00:00:00:00:01")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address.IP.String()).To(Equal("2001:db8:1::ff:fe00:2"))
+		})
+
+		It(fmt.Sprintf("[%s] derives stable-privacy addresses", ver), func() {
+			secretFile := filepath.Join(tmpDir, "stable_secret")
+			Expect(ioutil.WriteFile(secretFile, []byte("2001:db8::1234:5678\n"), 0600)).To(Succeed())
+
+			conf := func(prefix string, ipam string, mac string) string {
+				return fmt.Sprintf(`{
+					"cniVersion": "%s",
+					"name": "mynet",
+					"type": "bridge",
+					"ipam": {
+						"type": "slaac",
+						"prefix": "%s",
+						"mode": "stable-privacy",
+						%s
+					},
+					"runtimeConfig": { "mac": "%s" }
+				}`, ver, prefix, ipam, mac)
+			}
+
+			// No MAC needed, virtual interfaces have no permanent one
+			result, err := add(conf("2001:db8:1::/64", `"stableSecret": "2001:db8::1234:5678"`, ""), "")
+			Expect(err).NotTo(HaveOccurred())
+			addr := result.IPs[0].Address
+			Expect(addr.String()).To(HavePrefix("2001:db8:1:0:"))
+			Expect(addr.String()).To(HaveSuffix("/64"))
+
+			// stable for the same prefix and secret, whatever the MAC
+			result, err = add(conf("2001:db8:1::/64", fmt.Sprintf(`"stableSecretFile": "%s"`, secretFile), "00:11:22:33:44:55"), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address).To(Equal(addr))
+
+			// but not across prefixes, secrets, DAD counters or permanent MACs
+			result, err = add(conf("2001:db8:2::/64", `"stableSecret": "2001:db8::1234:5678"`, ""), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address.IP[8:]).NotTo(Equal(addr.IP[8:]))
+
+			result, err = add(conf("2001:db8:1::/64", `"stableSecret": "2001:db8::1"`, ""), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address.IP).NotTo(Equal(addr.IP))
+
+			result, err = add(conf("2001:db8:1::/64", `"stableSecret": "2001:db8::1234:5678", "dadCounter": 1`, ""), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address.IP).NotTo(Equal(addr.IP))
+
+			result, err = add(conf("2001:db8:1::/64", `"stableSecret": "2001:db8::1234:5678", "permanentMAC": true`, "00:11:22:33:44:55"), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address.IP).NotTo(Equal(addr.IP))
+
+			_, err = add(conf("2001:db8:1::/64", `"stableSecret": "2001:db8::1234:5678", "permanentMAC": true`, ""), "")
+			Expect(err).To(MatchError("slaac: no MAC address for interface eth0, set one in runtimeConfig, args or CNI_ARGS"))
+
+			_, err = add(conf("2001:db8:1::/64", `"stableSecret": ""`, ""), "")
+			Expect(err).To(MatchError(`slaac: mode "stable-privacy" requires a stableSecret or stableSecretFile`))
+			_, err = add(conf("2001:db8:1::/64", `"stableSecret": "s3cr3t"`, ""), "")
+			Expect(err).To(MatchError("slaac: stable secret is not in the format of an IPv6 address"))
+			_, err = add(conf("2001:db8:1::/64", `"stableSecret": "2001:db8::1", "dadCounter": 4`, ""), "")
+			Expect(err).To(MatchError("slaac: dadCounter 4 is not between 0 and 3"))
+		})
+
+		It(fmt.Sprintf("[%s] rejects invalid configurations", ver), func() {
+			conf := func(ipam string) string {
+				return fmt.Sprintf(`{
+					"cniVersion": "%s",
+					"name": "mynet",
+					"type": "bridge",
+					"ipam": %s,
+					"runtimeConfig": { "mac": "00:11:22:33:44:55" }
+				}`, ver, ipam)
+			}
+
+			_, err := add(conf(`{"type": "slaac"}`), "")
+			Expect(err).To(MatchError("slaac: missing prefix"))
+			_, err = add(conf(`{"type": "slaac", "prefix": "10.0.0.0/24"}`), "")
+			Expect(err).To(MatchError("slaac: prefix 10.0.0.0/24 is not an IPv6 prefix"))
+			_, err = add(conf(`{"type": "slaac", "prefix": "2001:db8::/48"}`), "")
+			Expect(err).To(MatchError("slaac: prefix 2001:db8::/48 is not a /64"))
+			_, err = add(conf(`{"type": "slaac", "prefix": "2001:db8::/64", "gateway": "10.0.0.1"}`), "")
+			Expect(err).To(MatchError("slaac: gateway 10.0.0.1 is not an IPv6 address"))
+			_, err = add(conf(`{"type": "slaac", "prefix": "2001:db8::/64", "mode": "random"}`), "")
+			Expect(err).To(MatchError(`slaac: unknown mode "random"`))
+		})
+
+		It(fmt.Sprintf("[%s] errors without a MAC", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "bridge",
+				"ipam": { "type": "slaac", "prefix": "2001:db8:1::/64" }
+			}`, ver)
+
+			_, err := add(conf, "")
+			Expect(err).To(MatchError("slaac: no MAC address for interface eth0, set one in runtimeConfig, args or CNI_ARGS"))
+		})
+	}
+
+	It("takes the MAC of the interface from the prevResult and checks the address", func() {
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "bridge",
+			"ipam": { "type": "slaac", "prefix": "2001:db8:1::/64" },
+			"runtimeConfig": { "mac": "00:11:22:33:44:55" },
+			"prevResult": {
+				"cniVersion": "1.0.0",
+				"interfaces": [
+					{ "name": "eth0", "mac": "02:00:00:00:00:01" },
+					{ "name": "eth0", "mac": "02:00:00:00:00:02", "sandbox": "/some/where" }
+				]
+			}
+		}`
+
+		result, err := add(conf, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs[0].Address.IP.String()).To(Equal("2001:db8:1::ff:fe00:2"))
+
+		check := func(addr string) error {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "bridge",
+				"ipam": { "type": "slaac", "prefix": "2001:db8:1::/64" },
+				"prevResult": {
+					"cniVersion": "1.0.0",
+					"interfaces": [{ "name": "eth0", "mac": "02:00:00:00:00:02", "sandbox": "/some/where" }],
+					"ips": [{ "address": "%s", "interface": 0 }]
+				}
+			}`, addr)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       "/some/where",
+				IfName:      "eth0",
+				StdinData:   []byte(conf),
+			}
+			return testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+		}
+		Expect(check("2001:db8:1::ff:fe00:2/64")).To(Succeed())
+		Expect(check("2001:db8:1::ff:fe00:3/64")).To(MatchError("slaac: address 2001:db8:1::ff:fe00:2 of interface eth0 not found in prevResult"))
+	})
+
+	It("derives EUI-64 interface identifiers", func() {
+		_, prefix, _ := net.ParseCIDR("2001:db8::/64")
+
+		ip, err := eui64Address(prefix, net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal("2001:db8::42:acff:fe11:2"))
+
+		ip, err = eui64Address(prefix, net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal("2001:db8::211:2233:4455:6677"))
+
+		_, err = eui64Address(prefix, make(net.HardwareAddr, 20))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("derives the stable-privacy addresses of the kernel", func() {
+		if hostEndian != binary.LittleEndian {
+			Skip("the addresses below come from a little-endian kernel")
+		}
+		_, prefix, _ := net.ParseCIDR("fe80::/64")
+		secret := net.ParseIP("2001:db8::1234:5678")
+
+		// The link-local addresses the kernel gave a veth with this
+		// stable_secret, and after a DAD failure
+		ip, err := stablePrivacyAddress(prefix, secret, nil, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal("fe80::71d8:1385:74ce:e11c"))
+
+		ip, err = stablePrivacyAddress(prefix, secret, nil, 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal("fe80::9b3a:4810:6ea1:f1b8"))
+	})
+
+	It("runs the SHA-1 block function", func() {
+		// A message shorter than 56 bytes takes a single padded block
+		msg := []byte("The quick brown fox jumps over the lazy dog")
+		var block [64]byte
+		copy(block[:], msg)
+		block[len(msg)] = 0x80
+		binary.BigEndian.PutUint64(block[56:], uint64(len(msg))*8)
+
+		sum := make([]byte, 0, sha1.Size)
+		for _, word := range sha1Transform(&block) {
+			sum = append(sum, byte(word>>24), byte(word>>16), byte(word>>8), byte(word))
+		}
+		expected := sha1.Sum(msg)
+		Expect(sum).To(Equal(expected[:]))
+	})
+
+	It("recognizes reserved interface identifiers", func() {
+		Expect(reservedIID([]byte{0, 0, 0, 0, 0, 0, 0, 0})).To(BeTrue())
+		Expect(reservedIID([]byte{0x02, 0x00, 0x5e, 0xff, 0xfe, 0x00, 0x52, 0x13})).To(BeTrue())
+		Expect(reservedIID([]byte{0x02, 0x00, 0x5e, 0xff, 0xff, 0xff, 0xff, 0xff})).To(BeTrue())
+		Expect(reservedIID([]byte{0xfd, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x80})).To(BeTrue())
+		Expect(reservedIID([]byte{0xfd, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f})).To(BeFalse())
+		Expect(reservedIID([]byte{0x02, 0x00, 0x5e, 0xff, 0xfd, 0xff, 0xff, 0xff})).To(BeFalse())
+		Expect(reservedIID([]byte{0x02, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55})).To(BeFalse())
+	})
+})
+
+func mustCIDR(s string) net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	Expect(err).NotTo(HaveOccurred())
+	return *n
+}
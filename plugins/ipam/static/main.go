@@ -24,6 +24,7 @@ import (
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/dns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
 
@@ -35,7 +36,9 @@ type Net struct {
 	IPAM       *IPAMConfig `json:"ipam"`
 
 	RuntimeConfig struct {
-		IPs []string `json:"ips,omitempty"`
+		IPs    []string           `json:"ips,omitempty"`
+		Routes []*types.Route     `json:"routes,omitempty"`
+		DNS    *dns.RuntimeConfig `json:"dns,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
 	Args *struct {
 		A *IPAMArgs `json:"cni"`
@@ -48,16 +51,27 @@ type IPAMConfig struct {
 	Routes    []*types.Route `json:"routes"`
 	Addresses []Address      `json:"addresses,omitempty"`
 	DNS       types.DNS      `json:"dns"`
+	// DataDir, if set, is where the addresses of the containers are
+	// recorded, so an address can't be used by two containers at once
+	DataDir string `json:"dataDir,omitempty"`
+	// MappingFile is a JSON or YAML file on the host giving the addresses,
+	// routes and DNS of containers, see Mapping
+	MappingFile string `json:"mappingFile,omitempty"`
 }
 
 type IPAMEnvArgs struct {
 	types.CommonArgs
 	IP      types.UnmarshallableString `json:"ip,omitempty"`
 	GATEWAY types.UnmarshallableString `json:"gateway,omitempty"`
+
+	K8S_POD_NAMESPACE types.UnmarshallableString `json:"k8sPodNamespace,omitempty"`
+	K8S_POD_NAME      types.UnmarshallableString `json:"k8sPodName,omitempty"`
 }
 
 type IPAMArgs struct {
-	IPs []string `json:"ips"`
+	IPs    []string       `json:"ips"`
+	Routes []*types.Route `json:"routes,omitempty"`
+	DNS    *types.DNS     `json:"dns,omitempty"`
 }
 
 type Address struct {
@@ -65,6 +79,9 @@ type Address struct {
 	Gateway    net.IP `json:"gateway,omitempty"`
 	Address    net.IPNet
 	Version    string
+	// Routes go through the gateway of the address unless they set their
+	// own, so each address of a multi-homed container can get its policy
+	Routes []*types.Route `json:"routes,omitempty"`
 }
 
 func main() {
@@ -80,7 +97,7 @@ func loadNetConf(bytes []byte) (*types.NetConf, string, error) {
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-	ipamConf, _, err := LoadIPAMConfig(args.StdinData, args.Args)
+	ipamConf, _, err := LoadIPAMConfig(args.StdinData, args.Args, args.ContainerID, args.IfName)
 	if err != nil {
 		return err
 	}
@@ -120,6 +137,15 @@ func cmdCheck(args *skel.CmdArgs) error {
 		}
 	}
 
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		defer store.Close()
+		return checkAddresses(store, args.ContainerID, args.IfName, ipamConf.Addresses)
+	}
+
 	return nil
 }
 
@@ -136,9 +162,10 @@ func canonicalizeIP(ip *net.IP) error {
 }
 
 // LoadIPAMConfig creates IPAMConfig using json encoded configuration provided
-// as `bytes`. At the moment values provided in envArgs are ignored so there
-// is no possibility to overload the json configuration using envArgs
-func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
+// as `bytes`. The entry of the mapping file matching the container, if any,
+// replaces the configured addresses, routes and DNS. Addresses given in
+// envArgs, args or runtimeConfig override both.
+func LoadIPAMConfig(bytes []byte, envArgs string, containerID string, ifName string) (*IPAMConfig, string, error) {
 	n := Net{}
 	if err := json.Unmarshal(bytes, &n); err != nil {
 		return nil, "", err
@@ -147,14 +174,40 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		return nil, "", fmt.Errorf("IPAM config missing 'ipam' key")
 	}
 
-	// load IP from CNI_ARGS
+	e := IPAMEnvArgs{}
 	if envArgs != "" {
-		e := IPAMEnvArgs{}
-		err := types.LoadArgs(envArgs, &e)
+		if err := types.LoadArgs(envArgs, &e); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// look the container up in the mapping file
+	if n.IPAM.MappingFile != "" {
+		m, err := loadMapping(n.IPAM.MappingFile)
 		if err != nil {
 			return nil, "", err
 		}
+		entry := m.lookup(mappingKeys{
+			podNamespace: string(e.K8S_POD_NAMESPACE),
+			podName:      string(e.K8S_POD_NAME),
+			containerID:  containerID,
+			ifName:       ifName,
+		})
+		if entry != nil {
+			if len(entry.Addresses) != 0 {
+				n.IPAM.Addresses = entry.Addresses
+			}
+			if entry.Routes != nil {
+				n.IPAM.Routes = entry.Routes
+			}
+			if entry.DNS != nil {
+				n.IPAM.DNS = *entry.DNS
+			}
+		}
+	}
 
+	// load IP from CNI_ARGS
+	if envArgs != "" {
 		if e.IP != "" {
 			for _, item := range strings.Split(string(e.IP), ",") {
 				ipstr := strings.TrimSpace(item)
@@ -216,6 +269,26 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		}
 	}
 
+	// routes and DNS from args and runtimeConfig overwrite the configured
+	// ones, in the same order as IPs
+	if n.Args != nil && n.Args.A != nil {
+		if len(n.Args.A.Routes) != 0 {
+			n.IPAM.Routes = n.Args.A.Routes
+		}
+		if n.Args.A.DNS != nil {
+			n.IPAM.DNS = *n.Args.A.DNS
+		}
+	}
+	if len(n.RuntimeConfig.Routes) != 0 {
+		n.IPAM.Routes = n.RuntimeConfig.Routes
+	}
+	if n.RuntimeConfig.DNS != nil {
+		n.IPAM.DNS = n.RuntimeConfig.DNS.DNS()
+		if err := dns.Validate(n.IPAM.DNS); err != nil {
+			return nil, "", err
+		}
+	}
+
 	// Validate all ranges
 	numV4 := 0
 	numV6 := 0
@@ -235,11 +308,18 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 			return nil, "", fmt.Errorf("invalid address %d: %s", i, err)
 		}
 
-		if n.IPAM.Addresses[i].Address.IP.To4() != nil {
+		isV4 := n.IPAM.Addresses[i].Address.IP.To4() != nil
+		if isV4 {
 			numV4++
 		} else {
 			numV6++
 		}
+
+		for _, route := range n.IPAM.Addresses[i].Routes {
+			if (route.Dst.IP.To4() != nil) != isV4 {
+				return nil, "", fmt.Errorf("route %s of address %s is not of the same IP family", route.Dst.String(), n.IPAM.Addresses[i].Address.String())
+			}
+		}
 	}
 
 	// CNI spec 0.2.0 and below supported only one v4 and v6 address
@@ -256,11 +336,22 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
-	ipamConf, confVersion, err := LoadIPAMConfig(args.StdinData, args.Args)
+	ipamConf, confVersion, err := LoadIPAMConfig(args.StdinData, args.Args, args.ContainerID, args.IfName)
 	if err != nil {
 		return err
 	}
 
+	store, err := openStore(ipamConf)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		defer store.Close()
+		if err := reserveAddresses(store, args.ContainerID, args.IfName, ipamConf.Addresses); err != nil {
+			return err
+		}
+	}
+
 	result := &current.Result{
 		CNIVersion: current.ImplementedSpecVersion,
 		DNS:        ipamConf.DNS,
@@ -271,12 +362,47 @@ func cmdAdd(args *skel.CmdArgs) error {
 			Address: v.Address,
 			Gateway: v.Gateway,
 		})
+		for _, route := range v.Routes {
+			r := *route
+			if r.GW == nil {
+				r.GW = v.Gateway
+			}
+			result.Routes = append(result.Routes, &r)
+		}
 	}
 
 	return types.PrintResult(result, confVersion)
 }
 
+// loadDelConfig returns the network name and data directory of the
+// configuration in bytes, all DEL needs. Unlike LoadIPAMConfig it ignores
+// the rest, so DEL still succeeds when the addresses, mapping file or args
+// of a container no longer are valid.
+func loadDelConfig(bytes []byte) (*IPAMConfig, error) {
+	n := struct {
+		Name string `json:"name"`
+		IPAM struct {
+			DataDir string `json:"dataDir"`
+		} `json:"ipam"`
+	}{}
+	if err := json.Unmarshal(bytes, &n); err != nil {
+		return nil, err
+	}
+	return &IPAMConfig{Name: n.Name, DataDir: n.IPAM.DataDir}, nil
+}
+
 func cmdDel(args *skel.CmdArgs) error {
-	// Nothing required because of no resource allocation in static plugin.
-	return nil
+	ipamConf, err := loadDelConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to release unless the addresses are recorded
+	store, err := openStore(ipamConf)
+	if err != nil || store == nil {
+		return err
+	}
+	defer store.Close()
+
+	return releaseAddresses(store, args.ContainerID, args.IfName)
 }
@@ -0,0 +1,123 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"gopkg.in/yaml.v2"
+)
+
+// Mapping is the content of a mapping file, which lets the addresses of
+// the containers be managed on the host rather than in the runtime
+// configuration
+type Mapping struct {
+	Entries []MappingEntry `json:"entries"`
+}
+
+// MappingEntry gives the configuration of the containers it matches. The
+// keys that are set must all match, and at least one must be set.
+type MappingEntry struct {
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	ContainerID  string `json:"containerID,omitempty"`
+	IfName       string `json:"ifName,omitempty"`
+
+	Addresses []Address      `json:"addresses,omitempty"`
+	Routes    []*types.Route `json:"routes,omitempty"`
+	DNS       *types.DNS     `json:"dns,omitempty"`
+}
+
+// mappingKeys identify the container being configured
+type mappingKeys struct {
+	podNamespace string
+	podName      string
+	containerID  string
+	ifName       string
+}
+
+func (e *MappingEntry) hasKeys() bool {
+	return e.PodNamespace != "" || e.PodName != "" || e.ContainerID != "" || e.IfName != ""
+}
+
+func (e *MappingEntry) matches(k mappingKeys) bool {
+	return (e.PodNamespace == "" || e.PodNamespace == k.podNamespace) &&
+		(e.PodName == "" || e.PodName == k.podName) &&
+		(e.ContainerID == "" || e.ContainerID == k.containerID) &&
+		(e.IfName == "" || e.IfName == k.ifName)
+}
+
+// loadMapping reads the mapping file at path. It is read again on every
+// call, so changes apply to the next containers without a restart.
+func loadMapping(path string) (*Mapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mappingFile: %v", err)
+	}
+
+	// JSON is YAML, so both are parsed as YAML. The result goes through
+	// JSON to reuse the json tags of the CNI types.
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse mappingFile %s: %v", path, err)
+	}
+	jsonData, err := json.Marshal(jsonCompatible(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mappingFile %s: %v", path, err)
+	}
+	m := &Mapping{}
+	if err := json.Unmarshal(jsonData, m); err != nil {
+		return nil, fmt.Errorf("failed to parse mappingFile %s: %v", path, err)
+	}
+
+	for i := range m.Entries {
+		if !m.Entries[i].hasKeys() {
+			return nil, fmt.Errorf("mappingFile %s: entry %d matches every container", path, i)
+		}
+	}
+	return m, nil
+}
+
+// lookup returns the first entry matching k, or nil
+func (m *Mapping) lookup(k mappingKeys) *MappingEntry {
+	for i := range m.Entries {
+		if m.Entries[i].matches(k) {
+			return &m.Entries[i]
+		}
+	}
+	return nil
+}
+
+// jsonCompatible converts the maps the YAML parser returns, which have
+// interface{} keys, to maps with string keys
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonCompatible(v[i])
+		}
+		return v
+	}
+	return v
+}
@@ -15,8 +15,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
@@ -495,6 +499,342 @@ var _ = Describe("static Operations", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 
+		It(fmt.Sprintf("[%s] rejects addresses used by another container when recording them", ver), func() {
+			const nspath string = "/some/where"
+
+			tmpDir, err := ioutil.TempDir("", "static_store")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "static",
+					"dataDir": "%s"
+				}
+			}`, ver, tmpDir)
+
+			mkArgs := func(id string, ips string) *skel.CmdArgs {
+				return &skel.CmdArgs{
+					ContainerID: id,
+					Netns:       nspath,
+					IfName:      "eth0",
+					StdinData:   []byte(conf),
+					Args:        "IP=" + ips,
+				}
+			}
+			add := func(args *skel.CmdArgs) (types.Result, error) {
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return r, err
+			}
+			check := func(args *skel.CmdArgs, r types.Result) error {
+				checkArgs := *args
+				checkArgs.StdinData = withPrevResult(conf, r)
+				return testutils.CmdCheckWithArgs(&checkArgs, func() error {
+					return cmdCheck(&checkArgs)
+				})
+			}
+
+			args1 := mkArgs("c1", "10.10.0.1/24")
+			r1, err := add(args1)
+			Expect(err).NotTo(HaveOccurred())
+			// Adding the same container again is fine
+			_, err = add(args1)
+			Expect(err).NotTo(HaveOccurred())
+
+			args2 := mkArgs("c2", "3ffe:ffff:0:1ff::2/64,10.10.0.1/24")
+			_, err = add(args2)
+			Expect(err).To(MatchError("static: address 10.10.0.1 is already used by container c1 interface eth0"))
+
+			// Nothing was left reserved by the failed ADD
+			args3 := mkArgs("c3", "3ffe:ffff:0:1ff::2/64")
+			_, err = add(args3)
+			Expect(err).NotTo(HaveOccurred())
+
+			if testutils.SpecVersionHasCHECK(ver) {
+				Expect(check(args1, r1)).To(Succeed())
+			}
+
+			err = testutils.CmdDelWithArgs(args1, func() error {
+				return cmdDel(args1)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			if testutils.SpecVersionHasCHECK(ver) {
+				Expect(check(args1, r1)).To(MatchError("static: address 10.10.0.1 is not reserved for container c1 interface eth0"))
+			}
+
+			args4 := mkArgs("c4", "10.10.0.1/24")
+			_, err = add(args4)
+			Expect(err).NotTo(HaveOccurred())
+
+			// DEL only needs the data directory
+			args4.Args = "IP=not-an-address"
+			err = testutils.CmdDelWithArgs(args4, func() error {
+				return cmdDel(args4)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = add(mkArgs("c5", "10.10.0.1/24"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] doesn't error on DEL when the configuration is invalid", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "static",
+					"addresses": [ { "address": "10.10.0.1/33" } ],
+					"mappingFile": "/does/not/exist"
+				}
+			}`, ver)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       "/some/where",
+				IfName:      "eth0",
+				StdinData:   []byte(conf),
+				Args:        "IP=10.10.0.1/24;GATEWAY=not-an-ip",
+			}
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It(fmt.Sprintf("[%s] takes the configuration of the container from the mapping file", ver), func() {
+			tmpDir, err := ioutil.TempDir("", "static_mapping")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			mappingFile := filepath.Join(tmpDir, "mapping.yaml")
+			Expect(ioutil.WriteFile(mappingFile, []byte(`
+entries:
+- podNamespace: prod
+  podName: db-0
+  addresses:
+  - address: 10.10.0.5/24
+    gateway: 10.10.0.254
+  routes:
+  - dst: 0.0.0.0/0
+  dns:
+    nameservers: [10.10.0.53]
+- containerID: c2
+  ifName: net1
+  addresses:
+  - address: 10.10.0.6/24
+`), 0644)).To(Succeed())
+
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "static",
+					"mappingFile": "%s",
+					"addresses": [{"address": "10.10.0.1/24"}],
+					"routes": [{"dst": "192.168.0.0/16"}]
+				}
+			}`, ver, mappingFile)
+
+			add := func(id, ifname, cniArgs string) *types100.Result {
+				args := &skel.CmdArgs{
+					ContainerID: id,
+					Netns:       "/some/where",
+					IfName:      ifname,
+					StdinData:   []byte(conf),
+					Args:        cniArgs,
+				}
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				return result
+			}
+
+			result := add("c1", "eth0", "IgnoreUnknown=1;K8S_POD_NAMESPACE=prod;K8S_POD_NAME=db-0")
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(*result.IPs[0]).To(Equal(types100.IPConfig{
+				Address: mustCIDR("10.10.0.5/24"),
+				Gateway: net.ParseIP("10.10.0.254"),
+			}))
+			Expect(result.Routes).To(Equal([]*types.Route{{Dst: mustCIDR("0.0.0.0/0")}}))
+			Expect(result.DNS.Nameservers).To(Equal([]string{"10.10.0.53"}))
+
+			// Only matching entries apply
+			result = add("c2", "net1", "")
+			Expect(result.IPs[0].Address).To(Equal(mustCIDR("10.10.0.6/24")))
+			Expect(result.Routes).To(Equal([]*types.Route{{Dst: mustCIDR("192.168.0.0/16")}}))
+			result = add("c2", "eth0", "")
+			Expect(result.IPs[0].Address).To(Equal(mustCIDR("10.10.0.1/24")))
+
+			// The file is read again on every call
+			Expect(ioutil.WriteFile(mappingFile, []byte(`{"entries": [{"podName": "db-0", "addresses": [{"address": "10.10.0.7/24"}]}]}`), 0644)).To(Succeed())
+			result = add("c1", "eth0", "IgnoreUnknown=1;K8S_POD_NAMESPACE=prod;K8S_POD_NAME=db-0")
+			Expect(result.IPs[0].Address).To(Equal(mustCIDR("10.10.0.7/24")))
+
+			// Addresses from CNI_ARGS are still added
+			result = add("c1", "eth0", "IgnoreUnknown=1;K8S_POD_NAMESPACE=prod;K8S_POD_NAME=db-0;IP=3ffe:ffff:0:1ff::2/64")
+			Expect(result.IPs).To(HaveLen(2))
+		})
+
+		It(fmt.Sprintf("[%s] errors on invalid mapping files", ver), func() {
+			tmpDir, err := ioutil.TempDir("", "static_mapping")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			mappingFile := filepath.Join(tmpDir, "mapping.yaml")
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "static",
+					"mappingFile": "%s"
+				}
+			}`, ver, mappingFile)
+			args := &skel.CmdArgs{
+				ContainerID: "c1",
+				Netns:       "/some/where",
+				IfName:      "eth0",
+				StdinData:   []byte(conf),
+			}
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("failed to read mappingFile"))
+
+			Expect(ioutil.WriteFile(mappingFile, []byte("entries:\n- addresses: [{address: 10.10.0.5/24}]\n"), 0644)).To(Succeed())
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError("mappingFile " + mappingFile + ": entry 0 matches every container"))
+		})
+
+		It(fmt.Sprintf("[%s] adds the routes of each address and takes routes and DNS from args and RuntimeConfig", ver), func() {
+			ipam := `{
+					"type": "static",
+					"addresses": [{
+						"address": "10.10.0.1/24",
+						"gateway": "10.10.0.254",
+						"routes": [{"dst": "192.168.0.0/16"}, {"dst": "172.16.0.0/12", "gw": "10.10.0.253"}]
+					}],
+					"routes": [{"dst": "0.0.0.0/0"}],
+					"dns": {"nameservers": ["8.8.8.8"], "domain": "example.com"}
+				}`
+			add := func(extra string) *types100.Result {
+				conf := fmt.Sprintf(`{
+					"cniVersion": "%s",
+					"name": "mynet",
+					"type": "ipvlan",
+					"master": "foo0",
+					%s
+					"ipam": %s
+				}`, ver, extra, ipam)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       "/some/where",
+					IfName:      "eth0",
+					StdinData:   []byte(conf),
+				}
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				return result
+			}
+
+			result := add("")
+			Expect(result.Routes).To(Equal([]*types.Route{
+				{Dst: mustCIDR("0.0.0.0/0")},
+				{Dst: mustCIDR("192.168.0.0/16"), GW: net.ParseIP("10.10.0.254")},
+				{Dst: mustCIDR("172.16.0.0/12"), GW: net.ParseIP("10.10.0.253")},
+			}))
+			Expect(result.DNS.Domain).To(Equal("example.com"))
+
+			result = add(`"args": {"cni": {"routes": [{"dst": "10.0.0.0/8"}], "dns": {"nameservers": ["9.9.9.9"]}}},`)
+			Expect(result.Routes[0]).To(Equal(&types.Route{Dst: mustCIDR("10.0.0.0/8")}))
+			Expect(result.Routes).To(HaveLen(3))
+			Expect(result.DNS).To(Equal(types.DNS{Nameservers: []string{"9.9.9.9"}}))
+
+			// RuntimeConfig wins over args
+			result = add(`"args": {"cni": {"routes": [{"dst": "10.0.0.0/8"}]}},
+				"runtimeConfig": {
+					"routes": [{"dst": "100.64.0.0/10"}],
+					"dns": {"servers": ["1.1.1.1"], "searches": ["svc.local"], "options": ["ndots:5"]}
+				},`)
+			Expect(result.Routes[0]).To(Equal(&types.Route{Dst: mustCIDR("100.64.0.0/10")}))
+			Expect(result.DNS).To(Equal(types.DNS{
+				Nameservers: []string{"1.1.1.1"},
+				Search:      []string{"svc.local"},
+				Options:     []string{"ndots:5"},
+			}))
+		})
+
+		It(fmt.Sprintf("[%s] errors when a route of an address is of another IP family", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "static",
+					"addresses": [{"address": "10.10.0.1/24", "routes": [{"dst": "::/0"}]}]
+				}
+			}`, ver)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       "/some/where",
+				IfName:      "eth0",
+				StdinData:   []byte(conf),
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError("route ::/0 of address 10.10.0.1/24 is not of the same IP family"))
+		})
+
+		It(fmt.Sprintf("[%s] errors on invalid DNS settings", ver), func() {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "static",
+					"addresses": [{"address": "10.10.0.1/24"}],
+					"dns": {"nameservers": ["8.8.8.8"]}
+				},
+				"runtimeConfig": {"dns": {"servers": ["8.8.8.8"], "searches": ["bad domain"]}}
+			}`, ver)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       "/some/where",
+				IfName:      "eth0",
+				StdinData:   []byte(conf),
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(`invalid search domain "bad domain"`))
+		})
+
 		It(fmt.Sprintf("[%s] is returning an error on missing ipam key when args are set", ver), func() {
 			const ifname string = "eth0"
 			const nspath string = "/some/where"
@@ -689,3 +1029,15 @@ func mustCIDR(s string) net.IPNet {
 
 	return *n
 }
+
+// withPrevResult adds result to the network configuration conf
+func withPrevResult(conf string, result types.Result) []byte {
+	netConf := map[string]interface{}{}
+	Expect(json.Unmarshal([]byte(conf), &netConf)).To(Succeed())
+	data, err := json.Marshal(result)
+	Expect(err).NotTo(HaveOccurred())
+	netConf["prevResult"] = json.RawMessage(data)
+	stdinData, err := json.Marshal(netConf)
+	Expect(err).NotTo(HaveOccurred())
+	return stdinData
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// The static addresses of a network are recorded in the same store as the
+// host-local reservations, so a lock serializes all the containers using it
+const storeRangeID = "0"
+
+// openStore opens the store of the network, or returns nil if the network
+// doesn't record its addresses
+func openStore(ipamConf *IPAMConfig) (backend.Store, error) {
+	if ipamConf.DataDir == "" {
+		return nil, nil
+	}
+	return disk.New(ipamConf.Name, ipamConf.DataDir)
+}
+
+// reserveAddresses records the addresses of the interface ifname of the
+// container id. It fails without reserving anything if another container
+// already uses one of them.
+func reserveAddresses(store backend.Store, id string, ifname string, addresses []Address) error {
+	store.Lock()
+	defer store.Unlock()
+
+	owned := store.GetByID(id, ifname)
+	var reserved []net.IP
+	for _, a := range addresses {
+		ip := a.Address.IP
+		if containsIP(owned, ip) {
+			continue
+		}
+
+		ok, err := store.Reserve(id, ifname, ip, storeRangeID)
+		if err == nil && !ok {
+			err = fmt.Errorf("static: address %s is already used by %s", ip, owner(store, ip))
+		}
+		if err != nil {
+			for _, ip := range reserved {
+				store.Release(ip)
+			}
+			return err
+		}
+		reserved = append(reserved, ip)
+	}
+	return nil
+}
+
+// releaseAddresses drops the addresses recorded for the interface ifname
+// of the container id
+func releaseAddresses(store backend.Store, id string, ifname string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	return store.ReleaseByID(id, ifname)
+}
+
+// checkAddresses verifies that the addresses are recorded for the interface
+// ifname of the container id
+func checkAddresses(store backend.Store, id string, ifname string, addresses []Address) error {
+	store.Lock()
+	defer store.Unlock()
+
+	owned := store.GetByID(id, ifname)
+	for _, a := range addresses {
+		if !containsIP(owned, a.Address.IP) {
+			return fmt.Errorf("static: address %s is not reserved for container %s interface %s", a.Address.IP, id, ifname)
+		}
+	}
+	return nil
+}
+
+// owner describes the container ip is reserved for
+func owner(store backend.Store, ip net.IP) string {
+	reservations, err := store.ListReservations()
+	if err != nil {
+		return "another container"
+	}
+	for _, r := range reservations {
+		if r.IP.Equal(ip) {
+			return fmt.Sprintf("container %s interface %s", r.ContainerID, r.IfName)
+		}
+	}
+	return "another container"
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,600 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/containernetworking/plugins/pkg/dns"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+// Link is an interface to enslave to the bond
+type Link struct {
+	Name string `json:"name"`
+}
+
+type NetConf struct {
+	types.NetConf
+	Mode           string `json:"mode"`
+	Miimon         int    `json:"miimon"`
+	XmitHashPolicy string `json:"xmitHashPolicy,omitempty"`
+	MTU            int    `json:"mtu,omitempty"`
+	// LinksInContainer is true when the links are already in the
+	// container namespace, for instance moved there by host-device.
+	// Otherwise they are moved in from the host namespace.
+	LinksInContainer bool   `json:"linksInContainer"`
+	Links            []Link `json:"links"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if len(n.Links) == 0 {
+		return nil, "", fmt.Errorf("\"links\" field is required. It specifies the interfaces to aggregate in the bond.")
+	}
+	seen := map[string]bool{}
+	for _, l := range n.Links {
+		if l.Name == "" {
+			return nil, "", fmt.Errorf("link name must not be empty")
+		}
+		if seen[l.Name] {
+			return nil, "", fmt.Errorf("duplicate link %q", l.Name)
+		}
+		seen[l.Name] = true
+	}
+	if _, err := modeFromString(n.Mode); err != nil {
+		return nil, "", err
+	}
+	if _, err := xmitHashPolicyFromString(n.XmitHashPolicy); err != nil {
+		return nil, "", err
+	}
+	if n.Miimon < 0 {
+		return nil, "", fmt.Errorf("invalid miimon %d", n.Miimon)
+	}
+	if n.MTU < 0 {
+		return nil, "", fmt.Errorf("invalid MTU %d", n.MTU)
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+func modeFromString(s string) (netlink.BondMode, error) {
+	if s == "" {
+		return netlink.BOND_MODE_BALANCE_RR, nil
+	}
+	mode := netlink.StringToBondMode(s)
+	if mode == netlink.BOND_MODE_UNKNOWN {
+		return 0, fmt.Errorf("unknown bond mode: %q", s)
+	}
+	return mode, nil
+}
+
+func xmitHashPolicyFromString(s string) (netlink.BondXmitHashPolicy, error) {
+	if s == "" {
+		return netlink.BOND_XMIT_HASH_POLICY_LAYER2, nil
+	}
+	policy := netlink.StringToBondXmitHashPolicy(s)
+	if policy == netlink.BOND_XMIT_HASH_POLICY_UNKNOWN {
+		return 0, fmt.Errorf("unknown bond xmit hash policy: %q", s)
+	}
+	return policy, nil
+}
+
+// usesXmitHashPolicy tells whether the bond mode balances the traffic with
+// the xmit hash policy
+func usesXmitHashPolicy(mode netlink.BondMode) bool {
+	return mode == netlink.BOND_MODE_BALANCE_XOR || mode == netlink.BOND_MODE_802_3AD || mode == netlink.BOND_MODE_BALANCE_TLB
+}
+
+// moveLinksIn moves the named host links into the container namespace.
+// On error the links already moved are moved back.
+func moveLinksIn(links []Link, netns ns.NetNS) error {
+	hostNS, err := ns.GetCurrentNS()
+	if err != nil {
+		return err
+	}
+	defer hostNS.Close()
+
+	for i, l := range links {
+		hostLink, err := netlink.LinkByName(l.Name)
+		if err != nil {
+			_ = moveLinksOut(links[:i], netns, hostNS)
+			return fmt.Errorf("failed to find link %q: %v", l.Name, err)
+		}
+		if err := netlink.LinkSetNsFd(hostLink, int(netns.Fd())); err != nil {
+			_ = moveLinksOut(links[:i], netns, hostNS)
+			return fmt.Errorf("failed to move link %q to container netns: %v", l.Name, err)
+		}
+	}
+	return nil
+}
+
+// moveLinksOut moves the named links from the container namespace back to
+// hostNS. Links that no longer exist in the container are skipped.
+func moveLinksOut(links []Link, netns ns.NetNS, hostNS ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		var errs []error
+		for _, l := range links {
+			link, err := netlink.LinkByName(l.Name)
+			if err != nil {
+				if _, ok := err.(netlink.LinkNotFoundError); ok {
+					continue
+				}
+				errs = append(errs, err)
+				continue
+			}
+			if err := netlink.LinkSetNsFd(link, int(hostNS.Fd())); err != nil {
+				errs = append(errs, fmt.Errorf("failed to move link %q to host netns: %v", l.Name, err))
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%v", errs)
+		}
+		return nil
+	})
+}
+
+// releaseSlaves detaches the named links from the bond bondName and brings
+// them back up. It must be called in the container namespace.
+func releaseSlaves(links []Link, bondName string) error {
+	bond, err := netlink.LinkByName(bondName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	for _, l := range links {
+		link, err := netlink.LinkByName(l.Name)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				continue
+			}
+			return err
+		}
+		if link.Attrs().MasterIndex != bond.Attrs().Index {
+			continue
+		}
+		if err := netlink.LinkSetNoMaster(link); err != nil {
+			return fmt.Errorf("failed to release %q from bond %q: %v", l.Name, bondName, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %q up: %v", l.Name, err)
+		}
+	}
+	return nil
+}
+
+func createBond(conf *NetConf, ifName string, netns ns.NetNS) ([]*current.Interface, error) {
+	mode, err := modeFromString(conf.Mode)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := xmitHashPolicyFromString(conf.XmitHashPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifaces []*current.Interface
+	err = netns.Do(func(_ ns.NetNS) error {
+		bond := netlink.NewLinkBond(netlink.LinkAttrs{
+			Name: ifName,
+			MTU:  conf.MTU,
+		})
+		bond.Mode = mode
+		bond.Miimon = conf.Miimon
+		if usesXmitHashPolicy(mode) {
+			bond.XmitHashPolicy = policy
+		}
+
+		if err := netlink.LinkAdd(bond); err != nil {
+			return fmt.Errorf("failed to create bond %q: %v", ifName, err)
+		}
+
+		err := enslaveLinks(conf.Links, bond)
+		if err != nil {
+			_ = releaseSlaves(conf.Links, ifName)
+			_ = netlink.LinkDel(bond)
+			return err
+		}
+
+		// Re-fetch the bond to get all properties/attributes
+		contBond, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to refetch bond %q: %v", ifName, err)
+		}
+		ifaces = append(ifaces, &current.Interface{
+			Name:    ifName,
+			Mac:     contBond.Attrs().HardwareAddr.String(),
+			Sandbox: netns.Path(),
+		})
+		for _, l := range conf.Links {
+			slave, err := netlink.LinkByName(l.Name)
+			if err != nil {
+				return fmt.Errorf("failed to refetch link %q: %v", l.Name, err)
+			}
+			ifaces = append(ifaces, &current.Interface{
+				Name:    l.Name,
+				Mac:     slave.Attrs().HardwareAddr.String(),
+				Sandbox: netns.Path(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ifaces, nil
+}
+
+func enslaveLinks(links []Link, bond *netlink.Bond) error {
+	for _, l := range links {
+		link, err := netlink.LinkByName(l.Name)
+		if err != nil {
+			return fmt.Errorf("failed to find link %q: %v", l.Name, err)
+		}
+		if link.Attrs().MasterIndex != 0 {
+			return fmt.Errorf("link %q already has a master", l.Name)
+		}
+		// Links must be down to be enslaved
+		if err := netlink.LinkSetDown(link); err != nil {
+			return fmt.Errorf("failed to set %q down: %v", l.Name, err)
+		}
+		if err := netlink.LinkSetBondSlave(link, bond); err != nil {
+			return fmt.Errorf("failed to add %q to bond %q: %v", l.Name, bond.Name, err)
+		}
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if !n.LinksInContainer {
+		if err = moveLinksIn(n.Links, netns); err != nil {
+			return err
+		}
+
+		// Move the links back to the host if err
+		defer func() {
+			if err != nil {
+				hostNS, nsErr := ns.GetCurrentNS()
+				if nsErr == nil {
+					_ = moveLinksOut(n.Links, netns, hostNS)
+					hostNS.Close()
+				}
+			}
+		}()
+	}
+
+	ifaces, err := createBond(n, args.IfName, netns)
+	if err != nil {
+		return err
+	}
+
+	// Delete the bond and restore its slaves if err
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				_ = releaseSlaves(n.Links, args.IfName)
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: ifaces,
+	}
+
+	if n.IPAM.Type != "" {
+		// run the IPAM plugin and get back the config to apply
+		var r types.Result
+		r, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		// Invoke ipam del if err to avoid ip leak
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		// Convert whatever the IPAM result was into the current Result type
+		var ipamResult *current.Result
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		for _, ipc := range result.IPs {
+			// All addresses apply to the bond interface
+			ipc.Interface = current.Int(0)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(args.IfName, result)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		// For L2 just change interface status to up
+		err = netns.Do(func(_ ns.NetNS) error {
+			bondLink, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to find interface name %q: %v", args.IfName, err)
+			}
+
+			if err := netlink.LinkSetUp(bondLink); err != nil {
+				return fmt.Errorf("failed to set %q UP: %v", args.IfName, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS, err = dns.ForResult(args.StdinData, n.DNS)
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		// The netns is already gone, and the links with it
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	// Delete can be called multiple times so don't return an error if the
+	// bond is already removed.
+	err = netns.Do(func(_ ns.NetNS) error {
+		if err := releaseSlaves(n.Links, args.IfName); err != nil {
+			return err
+		}
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !n.LinksInContainer {
+		hostNS, err := ns.GetCurrentNS()
+		if err != nil {
+			return err
+		}
+		defer hostNS.Close()
+
+		return moveLinksOut(n.Links, netns, hostNS)
+	}
+
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("bond"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	isLayer3 := n.IPAM.Type != ""
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if isLayer3 {
+		// run the IPAM plugin and get back the config to apply
+		err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var contMap current.Interface
+	// Find interfaces for names whe know, bond device name inside container
+	for _, intf := range result.Interfaces {
+		if args.IfName == intf.Name {
+			if args.Netns == intf.Sandbox {
+				contMap = *intf
+				continue
+			}
+		}
+	}
+
+	// The namespace must be the same as what was configured
+	if args.Netns != contMap.Sandbox {
+		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
+			contMap.Sandbox, args.Netns)
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	if err := netns.Do(func(_ ns.NetNS) error {
+
+		// Check interface against values found in the container
+		err := validateCniContainerInterface(contMap, n)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedRoute(result.Routes)
+		if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateCniContainerInterface(intf current.Interface, conf *NetConf) error {
+	if intf.Name == "" {
+		return fmt.Errorf("Container interface name missing in prevResult: %v", intf.Name)
+	}
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return fmt.Errorf("Container Interface name in prevResult: %s not found", intf.Name)
+	}
+	if intf.Sandbox == "" {
+		return fmt.Errorf("Error: Container interface %s should not be in host namespace", link.Attrs().Name)
+	}
+
+	bond, isBond := link.(*netlink.Bond)
+	if !isBond {
+		return fmt.Errorf("Error: Container interface %s not of type bond", link.Attrs().Name)
+	}
+
+	mode, err := modeFromString(conf.Mode)
+	if err != nil {
+		return err
+	}
+	if bond.Mode != mode {
+		return fmt.Errorf("Container bond mode %s does not match expected value: %s", bond.Mode, mode)
+	}
+
+	if bond.Miimon != conf.Miimon {
+		return fmt.Errorf("Container bond miimon %d does not match expected value: %d", bond.Miimon, conf.Miimon)
+	}
+
+	// The policy is only applied in the modes that balance with it
+	if conf.XmitHashPolicy != "" && usesXmitHashPolicy(mode) {
+		policy, err := xmitHashPolicyFromString(conf.XmitHashPolicy)
+		if err != nil {
+			return err
+		}
+		if bond.XmitHashPolicy != policy {
+			return fmt.Errorf("Container bond xmit hash policy %s does not match expected value: %s", bond.XmitHashPolicy, policy)
+		}
+	}
+
+	if intf.Mac != "" {
+		if intf.Mac != link.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("Interface %s Mac %s doesn't match container Mac: %s", intf.Name, intf.Mac, link.Attrs().HardwareAddr)
+		}
+	}
+
+	for _, l := range conf.Links {
+		slave, err := netlink.LinkByName(l.Name)
+		if err != nil {
+			return fmt.Errorf("bond slave %q not found: %v", l.Name, err)
+		}
+		if slave.Attrs().MasterIndex != bond.Attrs().Index {
+			return fmt.Errorf("link %q is not enslaved to bond %s", l.Name, intf.Name)
+		}
+	}
+
+	return nil
+}
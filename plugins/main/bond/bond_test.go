@@ -0,0 +1,445 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	SLAVE1 = "net1"
+	SLAVE2 = "net2"
+)
+
+type Net struct {
+	Name             string                 `json:"name"`
+	CNIVersion       string                 `json:"cniVersion"`
+	Type             string                 `json:"type,omitempty"`
+	Mode             string                 `json:"mode"`
+	Miimon           int                    `json:"miimon"`
+	XmitHashPolicy   string                 `json:"xmitHashPolicy,omitempty"`
+	LinksInContainer bool                   `json:"linksInContainer"`
+	Links            []Link                 `json:"links"`
+	IPAM             *allocator.IPAMConfig  `json:"ipam"`
+	RawPrevResult    map[string]interface{} `json:"prevResult,omitempty"`
+}
+
+func buildOneConfig(netName string, cniVersion string, orig *Net, prevResult types.Result) (*Net, error) {
+	var err error
+
+	inject := map[string]interface{}{
+		"name":       netName,
+		"cniVersion": cniVersion,
+	}
+	// Add previous plugin result
+	if prevResult != nil {
+		inject["prevResult"] = prevResult
+	}
+
+	// Ensure every config uses the same name and version
+	config := make(map[string]interface{})
+
+	confBytes, err := json.Marshal(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(confBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal existing network bytes: %s", err)
+	}
+
+	for key, value := range inject {
+		config[key] = value
+	}
+
+	newBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Net{}
+	if err := json.Unmarshal(newBytes, &conf); err != nil {
+		return nil, fmt.Errorf("error parsing configuration: %s", err)
+	}
+
+	return conf, nil
+}
+
+func addDummy(name string) {
+	err := netlink.LinkAdd(&netlink.Dummy{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+		},
+	})
+	Expect(err).NotTo(HaveOccurred())
+}
+
+var _ = Describe("bond configuration", func() {
+	It("validates the configuration", func() {
+		for _, tc := range []struct {
+			body string
+			err  string
+		}{
+			{`"mode": "active-backup"`, `"links" field is required. It specifies the interfaces to aggregate in the bond.`},
+			{`"links": [{"name": "net1"}, {"name": "net1"}]`, `duplicate link "net1"`},
+			{`"links": [{"name": ""}]`, `link name must not be empty`},
+			{`"links": [{"name": "net1"}], "mode": "foo"`, `unknown bond mode: "foo"`},
+			{`"links": [{"name": "net1"}], "xmitHashPolicy": "layer5"`, `unknown bond xmit hash policy: "layer5"`},
+			{`"links": [{"name": "net1"}], "miimon": -1`, `invalid miimon -1`},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "bondnet",
+				"type": "bond",
+				%s
+			}`, tc.body)
+			_, _, err := loadConf([]byte(conf))
+			Expect(err).To(MatchError(tc.err))
+		}
+	})
+})
+
+var _ = Describe("bond Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "bond_test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	for _, inContainer := range []bool{true, false} {
+		for _, ver := range testutils.AllSpecVersions {
+			// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+			// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+			ver := ver
+			inContainer := inContainer
+
+			It(fmt.Sprintf("[%s] configures and deconfigures a bond with ADD/CHECK/DEL (linksInContainer=%v)", ver, inContainer), func() {
+				const IFNAME = "bond0"
+
+				conf := fmt.Sprintf(`{
+				    "cniVersion": "%s",
+				    "name": "bondTest",
+				    "type": "bond",
+				    "mode": "802.3ad",
+				    "miimon": 100,
+				    "xmitHashPolicy": "layer3+4",
+				    "linksInContainer": %v,
+				    "links": [{"name": "%s"}, {"name": "%s"}],
+				    "ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": "%s"
+				    }
+				}`, ver, inContainer, SLAVE1, SLAVE2, dataDir)
+
+				linksNS := originalNS
+				if inContainer {
+					linksNS = targetNS
+				}
+				err := linksNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					addDummy(SLAVE1)
+					addDummy(SLAVE2)
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      IFNAME,
+					StdinData:   []byte(conf),
+				}
+
+				var result types.Result
+				err = originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					var err error
+					result, _, err = testutils.CmdAddWithArgs(args, func() error {
+						return cmdAdd(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				if ver == "1.0.0" {
+					r, err := types100.GetResult(result)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(r.Interfaces).To(HaveLen(3))
+					Expect(r.Interfaces[0].Name).To(Equal(IFNAME))
+					Expect(r.Interfaces[1].Name).To(Equal(SLAVE1))
+					Expect(r.Interfaces[2].Name).To(Equal(SLAVE2))
+					Expect(*r.IPs[0].Interface).To(Equal(0))
+				}
+
+				// Make sure the bond exists in the target namespace with its slaves
+				err = targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(IFNAME)
+					Expect(err).NotTo(HaveOccurred())
+					bond, ok := link.(*netlink.Bond)
+					Expect(ok).To(BeTrue())
+					Expect(bond.Mode).To(Equal(netlink.BOND_MODE_802_3AD))
+					Expect(bond.Miimon).To(Equal(100))
+					Expect(bond.XmitHashPolicy).To(Equal(netlink.BOND_XMIT_HASH_POLICY_LAYER3_4))
+
+					for _, name := range []string{SLAVE1, SLAVE2} {
+						slave, err := netlink.LinkByName(name)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(slave.Attrs().MasterIndex).To(Equal(bond.Attrs().Index))
+					}
+
+					addrs, err := netlink.AddrList(link, syscall.AF_INET)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(len(addrs)).To(Equal(1))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// CNI Check the bond in the target namespace
+				n := &Net{}
+				err = json.Unmarshal([]byte(conf), &n)
+				Expect(err).NotTo(HaveOccurred())
+
+				n.IPAM, _, err = allocator.LoadIPAMConfig([]byte(conf), "")
+				Expect(err).NotTo(HaveOccurred())
+
+				newConf, err := buildOneConfig("bondTest", ver, n, result)
+				Expect(err).NotTo(HaveOccurred())
+
+				confString, err := json.Marshal(newConf)
+				Expect(err).NotTo(HaveOccurred())
+
+				args.StdinData = confString
+				err = originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+				})
+				if testutils.SpecVersionHasCHECK(ver) {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError("config version does not allow CHECK"))
+				}
+
+				args.StdinData = []byte(conf)
+				err = originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err = testutils.CmdDelWithArgs(args, func() error {
+						return cmdDel(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// Make sure the bond has been deleted
+				err = targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(IFNAME)
+					Expect(err).To(HaveOccurred())
+					Expect(link).To(BeNil())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// Make sure the slaves were restored where they came from
+				err = linksNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					for _, name := range []string{SLAVE1, SLAVE2} {
+						slave, err := netlink.LinkByName(name)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(slave.Attrs().MasterIndex).To(Equal(0))
+					}
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// DEL can be called multiple times, make sure no error is returned
+				// if the device is already removed.
+				err = originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err = testutils.CmdDelWithArgs(args, func() error {
+						return cmdDel(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		}
+	}
+
+	It("fails if a link is already enslaved elsewhere", func() {
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			addDummy(SLAVE1)
+			Expect(netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}})).To(Succeed())
+			br, err := netlink.LinkByName("br0")
+			Expect(err).NotTo(HaveOccurred())
+			slave, err := netlink.LinkByName(SLAVE1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetMaster(slave, br)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "bondTest",
+		    "type": "bond",
+		    "linksInContainer": true,
+		    "links": [{"name": "%s"}]
+		}`, SLAVE1)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "bond0",
+			StdinData:   []byte(conf),
+		}
+		err = originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).To(MatchError(fmt.Sprintf("link %q already has a master", SLAVE1)))
+
+		// The slave is left with its original master and the bond is gone
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, err := netlink.LinkByName("bond0")
+			Expect(err).To(HaveOccurred())
+			br, err := netlink.LinkByName("br0")
+			Expect(err).NotTo(HaveOccurred())
+			slave, err := netlink.LinkByName(SLAVE1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(slave.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("ignores the xmitHashPolicy on CHECK in modes that don't use it", func() {
+		const IFNAME = "bond0"
+
+		conf := fmt.Sprintf(`{
+		    "cniVersion": "1.0.0",
+		    "name": "bondTest",
+		    "type": "bond",
+		    "mode": "active-backup",
+		    "xmitHashPolicy": "layer3+4",
+		    "linksInContainer": true,
+		    "links": [{"name": "%s"}],
+		    "ipam": {
+			"type": "host-local",
+			"subnet": "10.1.2.0/24",
+			"dataDir": "%s"
+		    }
+		}`, SLAVE1, dataDir)
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			addDummy(SLAVE1)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var result types.Result
+		err = originalNS.Do(func(ns.NetNS) error {
+			var err error
+			result, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		n := &Net{}
+		err = json.Unmarshal([]byte(conf), &n)
+		Expect(err).NotTo(HaveOccurred())
+
+		n.IPAM, _, err = allocator.LoadIPAMConfig([]byte(conf), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		newConf, err := buildOneConfig("bondTest", "1.0.0", n, result)
+		Expect(err).NotTo(HaveOccurred())
+
+		confString, err := json.Marshal(newConf)
+		Expect(err).NotTo(HaveOccurred())
+
+		args.StdinData = confString
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args.StdinData = []byte(conf)
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error { return cmdDel(args) })
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
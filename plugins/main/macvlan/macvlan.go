@@ -29,6 +29,7 @@ import (
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 
+	"github.com/containernetworking/plugins/pkg/dns"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -332,7 +333,10 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}
 
-	result.DNS = n.DNS
+	result.DNS, err = dns.ForResult(args.StdinData, n.DNS)
+	if err != nil {
+		return err
+	}
 
 	return types.PrintResult(result, cniVersion)
 }
@@ -0,0 +1,674 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/containernetworking/plugins/pkg/dns"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const defaultDataDir = "/var/run/cni/macvtap"
+
+type NetConf struct {
+	types.NetConf
+	Master string `json:"master"`
+	Mode   string `json:"mode"`
+	MTU    int    `json:"mtu"`
+	Mac    string `json:"mac,omitempty"`
+	// DataDir is where the tap device of each attachment is recorded
+	DataDir string `json:"dataDir,omitempty"`
+
+	RuntimeConfig struct {
+		Mac string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+// MacEnvArgs represents CNI_ARG
+type MacEnvArgs struct {
+	types.CommonArgs
+	MAC types.UnmarshallableString `json:"mac,omitempty"`
+}
+
+// TapDevice describes the character device backing a macvtap link. A VMM
+// opens Path to send and receive the frames of the link.
+type TapDevice struct {
+	Interface string `json:"interface"`
+	Sandbox   string `json:"sandbox"`
+	Path      string `json:"path"`
+	Major     uint32 `json:"major"`
+	Minor     uint32 `json:"minor"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func getDefaultRouteInterfaceName() (string, error) {
+	routeToDstIP, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range routeToDstIP {
+		if v.Dst == nil {
+			l, err := netlink.LinkByIndex(v.LinkIndex)
+			if err != nil {
+				return "", err
+			}
+			return l.Attrs().Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("no default route interface found")
+}
+
+func loadConf(bytes []byte, envArgs string) (*NetConf, string, error) {
+	n := &NetConf{
+		DataDir: defaultDataDir,
+	}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.Master == "" {
+		defaultRouteInterface, err := getDefaultRouteInterfaceName()
+		if err != nil {
+			return nil, "", err
+		}
+		n.Master = defaultRouteInterface
+	}
+
+	if _, err := modeFromString(n.Mode); err != nil {
+		return nil, "", err
+	}
+
+	// check existing and MTU of master interface
+	masterMTU, err := getMTUByName(n.Master)
+	if err != nil {
+		return nil, "", err
+	}
+	if n.MTU < 0 || n.MTU > masterMTU {
+		return nil, "", fmt.Errorf("invalid MTU %d, must be [0, master MTU(%d)]", n.MTU, masterMTU)
+	}
+
+	if envArgs != "" {
+		e := MacEnvArgs{}
+		err := types.LoadArgs(envArgs, &e)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if e.MAC != "" {
+			n.Mac = string(e.MAC)
+		}
+	}
+
+	if n.RuntimeConfig.Mac != "" {
+		n.Mac = n.RuntimeConfig.Mac
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+func getMTUByName(ifName string) (int, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
+
+func modeFromString(s string) (netlink.MacvlanMode, error) {
+	switch s {
+	case "", "bridge":
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	case "private":
+		return netlink.MACVLAN_MODE_PRIVATE, nil
+	case "vepa":
+		return netlink.MACVLAN_MODE_VEPA, nil
+	case "passthru":
+		return netlink.MACVLAN_MODE_PASSTHRU, nil
+	default:
+		return 0, fmt.Errorf("unknown macvtap mode: %q", s)
+	}
+}
+
+func modeToString(mode netlink.MacvlanMode) (string, error) {
+	switch mode {
+	case netlink.MACVLAN_MODE_BRIDGE:
+		return "bridge", nil
+	case netlink.MACVLAN_MODE_PRIVATE:
+		return "private", nil
+	case netlink.MACVLAN_MODE_VEPA:
+		return "vepa", nil
+	case netlink.MACVLAN_MODE_PASSTHRU:
+		return "passthru", nil
+	default:
+		return "", fmt.Errorf("unknown macvtap mode: %q", mode)
+	}
+}
+
+// deterministicMac derives a locally administered unicast MAC from the
+// network name, container ID and interface name so that re-creating an
+// attachment for the same VM yields the same address.
+func deterministicMac(netName, containerID, ifName string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(netName + "/" + containerID + "/" + ifName))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac
+}
+
+func createMacvtap(conf *NetConf, containerID, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	macvtap := &current.Interface{}
+
+	mode, err := modeFromString(conf.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := netlink.LinkByName(conf.Master)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+	}
+
+	// due to kernel bug we have to create with tmpName or it might
+	// collide with the name on the host and error out
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, err
+	}
+
+	linkAttrs := netlink.LinkAttrs{
+		MTU:         conf.MTU,
+		Name:        tmpName,
+		ParentIndex: m.Attrs().Index,
+		Namespace:   netlink.NsFd(int(netns.Fd())),
+	}
+
+	if conf.Mac != "" {
+		addr, err := net.ParseMAC(conf.Mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid args %v for MAC addr: %v", conf.Mac, err)
+		}
+		linkAttrs.HardwareAddr = addr
+	} else if mode != netlink.MACVLAN_MODE_PASSTHRU {
+		// passthru links take over the MAC of the master
+		linkAttrs.HardwareAddr = deterministicMac(conf.Name, containerID, ifName)
+	}
+
+	mv := &netlink.Macvtap{
+		Macvlan: netlink.Macvlan{
+			LinkAttrs: linkAttrs,
+			Mode:      mode,
+		},
+	}
+
+	if err := netlink.LinkAdd(mv); err != nil {
+		return nil, fmt.Errorf("failed to create macvtap: %v", err)
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		err := ip.RenameLink(tmpName, ifName)
+		if err != nil {
+			_ = netlink.LinkDel(mv)
+			return fmt.Errorf("failed to rename macvtap to %q: %v", ifName, err)
+		}
+		macvtap.Name = ifName
+
+		// Re-fetch macvtap to get all properties/attributes
+		contMacvtap, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to refetch macvtap %q: %v", ifName, err)
+		}
+		macvtap.Mac = contMacvtap.Attrs().HardwareAddr.String()
+		macvtap.Sandbox = netns.Path()
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return macvtap, nil
+}
+
+// getTapDevice looks up the character device of the macvtap link ifName
+// in netns. The kernel names it tap<ifindex> and only lists it in the sysfs
+// of the link's network namespace, so sysfs is mounted from within netns
+// in a private mount namespace.
+func getTapDevice(netns ns.NetNS, ifName string) (*TapDevice, error) {
+	var dev *TapDevice
+	errCh := make(chan error, 1)
+
+	go func() {
+		// The thread is never unlocked: it ends up in a private mount
+		// namespace and must exit together with this goroutine
+		runtime.LockOSThread()
+
+		var err error
+		dev, err = readTapDevice(netns, ifName)
+		errCh <- err
+	}()
+
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+func readTapDevice(netns ns.NetNS, ifName string) (*TapDevice, error) {
+	if err := netns.Set(); err != nil {
+		return nil, err
+	}
+
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find macvtap %q: %v", ifName, err)
+	}
+
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return nil, fmt.Errorf("failed to unshare mount namespace: %v", err)
+	}
+	if err := unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return nil, fmt.Errorf("failed to make / a slave mount: %v", err)
+	}
+
+	sysfs, err := ioutil.TempDir("", "macvtap-sysfs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(sysfs)
+
+	if err := unix.Mount("sysfs", sysfs, "sysfs", 0, ""); err != nil {
+		return nil, fmt.Errorf("failed to mount sysfs: %v", err)
+	}
+	defer unix.Unmount(sysfs, unix.MNT_DETACH)
+
+	name := fmt.Sprintf("tap%d", link.Attrs().Index)
+	data, err := ioutil.ReadFile(filepath.Join(sysfs, "class", "macvtap", name, "dev"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tap device of %q: %v", ifName, err)
+	}
+
+	dev := &TapDevice{
+		Interface: ifName,
+		Sandbox:   netns.Path(),
+		Path:      filepath.Join("/dev", name),
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d:%d", &dev.Major, &dev.Minor); err != nil {
+		return nil, fmt.Errorf("failed to parse tap device number %q: %v", data, err)
+	}
+	return dev, nil
+}
+
+func tapDeviceFile(dataDir, containerID, ifName string) string {
+	return filepath.Join(dataDir, containerID+"-"+ifName)
+}
+
+// saveTapDevice records dev in dataDir, where the runtime picks it up to
+// create the device node for the VMM
+func saveTapDevice(dataDir, containerID string, dev *TapDevice) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(dev)
+	if err != nil {
+		return err
+	}
+
+	path := tapDeviceFile(dataDir, containerID, dev.Interface)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write tap device file: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write tap device file: %v", err)
+	}
+	return nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	isLayer3 := n.IPAM.Type != ""
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	macvtapInterface, err := createMacvtap(n, args.ContainerID, args.IfName, netns)
+	if err != nil {
+		return err
+	}
+
+	// Delete link if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
+
+	var dev *TapDevice
+	dev, err = getTapDevice(netns, args.IfName)
+	if err != nil {
+		return err
+	}
+	if err = saveTapDevice(n.DataDir, args.ContainerID, dev); err != nil {
+		return err
+	}
+
+	// Remove the device file if err, the link is gone as well
+	defer func() {
+		if err != nil {
+			os.Remove(tapDeviceFile(n.DataDir, args.ContainerID, args.IfName))
+		}
+	}()
+
+	// Assume L2 interface only
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{macvtapInterface},
+	}
+
+	if isLayer3 {
+		// run the IPAM plugin and get back the config to apply
+		var r types.Result
+		r, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		// Invoke ipam del if err to avoid ip leak
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		// Convert whatever the IPAM result was into the current Result type
+		var ipamResult *current.Result
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		for _, ipc := range result.IPs {
+			// All addresses apply to the container macvtap interface
+			ipc.Interface = current.Int(0)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(args.IfName, result)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		// For L2 just change interface status to up
+		err = netns.Do(func(_ ns.NetNS) error {
+			macvtapInterfaceLink, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to find interface name %q: %v", macvtapInterface.Name, err)
+			}
+
+			if err := netlink.LinkSetUp(macvtapInterfaceLink); err != nil {
+				return fmt.Errorf("failed to set %q UP: %v", args.IfName, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS, err = dns.ForResult(args.StdinData, n.DNS)
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	isLayer3 := n.IPAM.Type != ""
+
+	if isLayer3 {
+		err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(tapDeviceFile(n.DataDir, args.ContainerID, args.IfName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("macvtap"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+
+	n, _, err := loadConf(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+	isLayer3 := n.IPAM.Type != ""
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if isLayer3 {
+		// run the IPAM plugin and get back the config to apply
+		err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var contMap current.Interface
+	// Find interfaces for names whe know, macvtap device name inside container
+	for _, intf := range result.Interfaces {
+		if args.IfName == intf.Name {
+			if args.Netns == intf.Sandbox {
+				contMap = *intf
+				continue
+			}
+		}
+	}
+
+	// The namespace must be the same as what was configured
+	if args.Netns != contMap.Sandbox {
+		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
+			contMap.Sandbox, args.Netns)
+	}
+
+	// The recorded tap device must still be the one backing the link
+	data, err := ioutil.ReadFile(tapDeviceFile(n.DataDir, args.ContainerID, args.IfName))
+	if err != nil {
+		return fmt.Errorf("failed to read tap device file: %v", err)
+	}
+	saved := TapDevice{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse tap device file: %v", err)
+	}
+	dev, err := getTapDevice(netns, args.IfName)
+	if err != nil {
+		return err
+	}
+	if *dev != saved {
+		return fmt.Errorf("tap device %s (%d:%d) of %s doesn't match recorded device %s (%d:%d)",
+			dev.Path, dev.Major, dev.Minor, args.IfName, saved.Path, saved.Major, saved.Minor)
+	}
+
+	m, err := netlink.LinkByName(n.Master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", n.Master, err)
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	if err := netns.Do(func(_ ns.NetNS) error {
+
+		// Check interface against values found in the container
+		err := validateCniContainerInterface(contMap, m.Attrs().Index, n.Mode)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedRoute(result.Routes)
+		if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateCniContainerInterface(intf current.Interface, parentIndex int, modeExpected string) error {
+
+	var link netlink.Link
+	var err error
+
+	if intf.Name == "" {
+		return fmt.Errorf("Container interface name missing in prevResult: %v", intf.Name)
+	}
+	link, err = netlink.LinkByName(intf.Name)
+	if err != nil {
+		return fmt.Errorf("Container Interface name in prevResult: %s not found", intf.Name)
+	}
+	if intf.Sandbox == "" {
+		return fmt.Errorf("Error: Container interface %s should not be in host namespace", link.Attrs().Name)
+	}
+
+	macv, isMacvtap := link.(*netlink.Macvtap)
+	if !isMacvtap {
+		return fmt.Errorf("Error: Container interface %s not of type macvtap", link.Attrs().Name)
+	}
+
+	mode, err := modeFromString(modeExpected)
+	if err != nil {
+		return err
+	}
+	if macv.Mode != mode {
+		currString, err := modeToString(macv.Mode)
+		if err != nil {
+			return err
+		}
+		confString, err := modeToString(mode)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Container macvtap mode %s does not match expected value: %s", currString, confString)
+	}
+
+	if intf.Mac != "" {
+		if intf.Mac != link.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("Interface %s Mac %s doesn't match container Mac: %s", intf.Name, intf.Mac, link.Attrs().HardwareAddr)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,320 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const MASTER_NAME = "eth0"
+
+type Net struct {
+	Name          string                 `json:"name"`
+	CNIVersion    string                 `json:"cniVersion"`
+	Type          string                 `json:"type,omitempty"`
+	Master        string                 `json:"master"`
+	Mode          string                 `json:"mode"`
+	DataDir       string                 `json:"dataDir"`
+	IPAM          *allocator.IPAMConfig  `json:"ipam"`
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+}
+
+func buildOneConfig(netName string, cniVersion string, orig *Net, prevResult types.Result) (*Net, error) {
+	var err error
+
+	inject := map[string]interface{}{
+		"name":       netName,
+		"cniVersion": cniVersion,
+	}
+	// Add previous plugin result
+	if prevResult != nil {
+		inject["prevResult"] = prevResult
+	}
+
+	// Ensure every config uses the same name and version
+	config := make(map[string]interface{})
+
+	confBytes, err := json.Marshal(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(confBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal existing network bytes: %s", err)
+	}
+
+	for key, value := range inject {
+		config[key] = value
+	}
+
+	newBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Net{}
+	if err := json.Unmarshal(newBytes, &conf); err != nil {
+		return nil, fmt.Errorf("error parsing configuration: %s", err)
+	}
+
+	return conf, nil
+}
+
+var _ = Describe("macvtap configuration", func() {
+	It("rejects unknown modes", func() {
+		_, _, err := loadConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "tapnet",
+			"type": "macvtap",
+			"master": "lo",
+			"mode": "foo"
+		}`), "")
+		Expect(err).To(MatchError(`unknown macvtap mode: "foo"`))
+	})
+
+	It("takes the MAC from CNI_ARGS and runtimeConfig", func() {
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "tapnet",
+			"type": "macvtap",
+			"master": "lo",
+			"mac": "0e:00:00:00:00:01"
+			%s
+		}`
+
+		n, _, err := loadConf([]byte(fmt.Sprintf(conf, "")), "IgnoreUnknown=true;MAC=0e:00:00:00:00:02")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Mac).To(Equal("0e:00:00:00:00:02"))
+		Expect(n.DataDir).To(Equal(defaultDataDir))
+
+		n, _, err = loadConf([]byte(fmt.Sprintf(conf, `, "runtimeConfig": {"mac": "0e:00:00:00:00:03"}`)), "IgnoreUnknown=true;MAC=0e:00:00:00:00:02")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Mac).To(Equal("0e:00:00:00:00:03"))
+	})
+
+	It("derives a stable locally administered unicast MAC", func() {
+		mac := deterministicMac("tapnet", "vm1", "tap0")
+		Expect(mac).To(HaveLen(6))
+		Expect(mac[0] & 0x02).To(Equal(byte(0x02)))
+		Expect(mac[0] & 0x01).To(Equal(byte(0)))
+		Expect(deterministicMac("tapnet", "vm1", "tap0")).To(Equal(mac))
+		Expect(deterministicMac("tapnet", "vm2", "tap0")).NotTo(Equal(mac))
+	})
+})
+
+var _ = Describe("macvtap Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "macvtap_test")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: MASTER_NAME,
+				},
+				PeerName: MASTER_NAME + "-peer",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName(MASTER_NAME)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	for _, ver := range testutils.AllSpecVersions {
+		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+		ver := ver
+
+		It(fmt.Sprintf("[%s] configures and deconfigures a macvtap link with ADD/CHECK/DEL", ver), func() {
+			const IFNAME = "tap0"
+
+			conf := fmt.Sprintf(`{
+			    "cniVersion": "%s",
+			    "name": "macvtapTest",
+			    "type": "macvtap",
+			    "master": "%s",
+			    "mode": "vepa",
+			    "dataDir": "%s",
+			    "ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": "%s"
+			    }
+			}`, ver, MASTER_NAME, dataDir, dataDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			var result types.Result
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				var err error
+				result, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			expectedMac := deterministicMac("macvtapTest", "dummy", IFNAME).String()
+			if ver == "1.0.0" {
+				r, err := types100.GetResult(result)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.Interfaces).To(HaveLen(1))
+				Expect(r.Interfaces[0].Name).To(Equal(IFNAME))
+				Expect(r.Interfaces[0].Mac).To(Equal(expectedMac))
+			}
+
+			// Make sure the macvtap exists in the target namespace and
+			// its tap device was recorded
+			var index int
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				macvtap, ok := link.(*netlink.Macvtap)
+				Expect(ok).To(BeTrue())
+				Expect(macvtap.Mode).To(Equal(netlink.MACVLAN_MODE_VEPA))
+				Expect(link.Attrs().HardwareAddr.String()).To(Equal(expectedMac))
+
+				addrs, err := netlink.AddrList(link, syscall.AF_INET)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(addrs)).To(Equal(1))
+				index = link.Attrs().Index
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := ioutil.ReadFile(filepath.Join(dataDir, "dummy-"+IFNAME))
+			Expect(err).NotTo(HaveOccurred())
+			dev := TapDevice{}
+			Expect(json.Unmarshal(data, &dev)).To(Succeed())
+			Expect(dev.Interface).To(Equal(IFNAME))
+			Expect(dev.Sandbox).To(Equal(targetNS.Path()))
+			Expect(dev.Path).To(Equal(fmt.Sprintf("/dev/tap%d", index)))
+			Expect(dev.Major).NotTo(BeZero())
+
+			// CNI Check the macvtap in the target namespace
+			n := &Net{}
+			err = json.Unmarshal([]byte(conf), &n)
+			Expect(err).NotTo(HaveOccurred())
+
+			n.IPAM, _, err = allocator.LoadIPAMConfig([]byte(conf), "")
+			Expect(err).NotTo(HaveOccurred())
+
+			newConf, err := buildOneConfig("macvtapTest", ver, n, result)
+			Expect(err).NotTo(HaveOccurred())
+
+			confString, err := json.Marshal(newConf)
+			Expect(err).NotTo(HaveOccurred())
+
+			args.StdinData = confString
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+			})
+			if testutils.SpecVersionHasCHECK(ver) {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError("config version does not allow CHECK"))
+			}
+
+			args.StdinData = []byte(conf)
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				err = testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Make sure the macvtap and its device file have been deleted
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).To(HaveOccurred())
+				Expect(link).To(BeNil())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = os.Stat(filepath.Join(dataDir, "dummy-"+IFNAME))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			// DEL can be called multiple times, make sure no error is returned
+			// if the device is already removed.
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				err = testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	}
+})
@@ -30,6 +30,7 @@ import (
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 
+	"github.com/containernetworking/plugins/pkg/dns"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -250,20 +251,17 @@ func cmdAdd(args *skel.CmdArgs) error {
 	// Only override the DNS settings in the previous result if any DNS fields
 	// were provided to the ptp plugin. This allows, for example, IPAM plugins
 	// to specify the DNS settings instead of the ptp plugin.
-	if dnsConfSet(conf.DNS) {
+	if dns.IsSet(conf.DNS) {
 		result.DNS = conf.DNS
 	}
+	result.DNS, err = dns.ForResult(args.StdinData, result.DNS)
+	if err != nil {
+		return err
+	}
 
 	return types.PrintResult(result, conf.CNIVersion)
 }
 
-func dnsConfSet(dnsConf types.DNS) bool {
-	return dnsConf.Nameservers != nil ||
-		dnsConf.Search != nil ||
-		dnsConf.Options != nil ||
-		dnsConf.Domain != ""
-}
-
 func cmdDel(args *skel.CmdArgs) error {
 	conf := NetConf{}
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
@@ -0,0 +1,497 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/containernetworking/plugins/pkg/dns"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	modeGRE    = "gre"
+	modeGRETap = "gretap"
+	modeIPIP   = "ipip"
+	modeSIT    = "sit"
+)
+
+type NetConf struct {
+	types.NetConf
+	Mode   string `json:"mode"`
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote"`
+	Key    uint32 `json:"key,omitempty"`
+	TTL    int    `json:"ttl,omitempty"`
+	MTU    int    `json:"mtu,omitempty"`
+
+	local  net.IP
+	remote net.IP
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	switch n.Mode {
+	case modeGRE, modeGRETap, modeIPIP, modeSIT:
+	case "":
+		return nil, "", fmt.Errorf("\"mode\" field is required. It must be one of %q, %q, %q or %q.", modeGRE, modeGRETap, modeIPIP, modeSIT)
+	default:
+		return nil, "", fmt.Errorf("unknown tunnel mode: %q", n.Mode)
+	}
+
+	if n.Remote == "" {
+		return nil, "", fmt.Errorf("\"remote\" field is required. It specifies the underlay address of the remote tunnel endpoint.")
+	}
+	n.remote = net.ParseIP(n.Remote)
+	if n.remote == nil {
+		return nil, "", fmt.Errorf("invalid remote address %q", n.Remote)
+	}
+	if n.Local != "" {
+		n.local = net.ParseIP(n.Local)
+		if n.local == nil {
+			return nil, "", fmt.Errorf("invalid local address %q", n.Local)
+		}
+		if (n.local.To4() == nil) != (n.remote.To4() == nil) {
+			return nil, "", fmt.Errorf("local address %s and remote address %s must be of the same IP family", n.Local, n.Remote)
+		}
+	}
+
+	switch n.Mode {
+	case modeIPIP, modeSIT:
+		if n.remote.To4() == nil {
+			return nil, "", fmt.Errorf("%s tunnels require an IPv4 underlay", n.Mode)
+		}
+		if n.Key != 0 {
+			return nil, "", fmt.Errorf("\"key\" is only supported by %s and %s tunnels", modeGRE, modeGRETap)
+		}
+	case modeGRE, modeGRETap:
+		// The local address selects between the IPv4 and IPv6 flavours
+		// of the GRE link types
+		if n.local == nil {
+			if n.remote.To4() != nil {
+				n.local = net.IPv4zero
+			} else {
+				n.local = net.IPv6zero
+			}
+		}
+	}
+
+	if n.TTL < 0 || n.TTL > 255 {
+		return nil, "", fmt.Errorf("invalid TTL %d, must be [0, 255]", n.TTL)
+	}
+	if n.MTU < 0 {
+		return nil, "", fmt.Errorf("invalid MTU %d", n.MTU)
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+// newTunnelLink returns the netlink representation of the configured tunnel
+func newTunnelLink(conf *NetConf, attrs netlink.LinkAttrs) netlink.Link {
+	switch conf.Mode {
+	case modeGRETap:
+		return &netlink.Gretap{
+			LinkAttrs: attrs,
+			Local:     conf.local,
+			Remote:    conf.remote,
+			IKey:      conf.Key,
+			OKey:      conf.Key,
+			Ttl:       uint8(conf.TTL),
+			PMtuDisc:  1,
+		}
+	case modeIPIP:
+		return &netlink.Iptun{
+			LinkAttrs: attrs,
+			Local:     conf.local,
+			Remote:    conf.remote,
+			Ttl:       uint8(conf.TTL),
+			PMtuDisc:  1,
+		}
+	case modeSIT:
+		return &netlink.Sittun{
+			LinkAttrs: attrs,
+			Local:     conf.local,
+			Remote:    conf.remote,
+			Ttl:       uint8(conf.TTL),
+			PMtuDisc:  1,
+			Proto:     unix.IPPROTO_IPV6,
+		}
+	default:
+		return &netlink.Gretun{
+			LinkAttrs: attrs,
+			Local:     conf.local,
+			Remote:    conf.remote,
+			IKey:      conf.Key,
+			OKey:      conf.Key,
+			Ttl:       uint8(conf.TTL),
+			PMtuDisc:  1,
+		}
+	}
+}
+
+func createTunnel(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	tunnel := &current.Interface{}
+
+	// due to kernel bug we have to create with tmpName or it might
+	// collide with the name on the host and error out
+	tmpName, err := ip.RandomVethName()
+	if err != nil {
+		return nil, err
+	}
+
+	// The tunnel is created in the host namespace and then moved to the
+	// container. The kernel binds the underlay of a tunnel to the namespace
+	// it is created in, so the encapsulated packets use the host underlay.
+	// Creating it in the container would route them there instead.
+	link := newTunnelLink(conf, netlink.LinkAttrs{
+		MTU:  conf.MTU,
+		Name: tmpName,
+	})
+
+	if err := netlink.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s tunnel: %v", conf.Mode, err)
+	}
+
+	if err := netlink.LinkSetNsFd(link, int(netns.Fd())); err != nil {
+		_ = netlink.LinkDel(link)
+		return nil, fmt.Errorf("failed to move tunnel %q to container netns: %v", tmpName, err)
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		err := ip.RenameLink(tmpName, ifName)
+		if err != nil {
+			_ = netlink.LinkDel(link)
+			return fmt.Errorf("failed to rename tunnel to %q: %v", ifName, err)
+		}
+		tunnel.Name = ifName
+
+		// Re-fetch tunnel to get all properties/attributes
+		contTunnel, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to refetch tunnel %q: %v", ifName, err)
+		}
+		if conf.Mode == modeGRETap {
+			tunnel.Mac = contTunnel.Attrs().HardwareAddr.String()
+		}
+		tunnel.Sandbox = netns.Path()
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tunnel, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	isLayer3 := n.IPAM.Type != ""
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	tunnelInterface, err := createTunnel(n, args.IfName, netns)
+	if err != nil {
+		return err
+	}
+
+	// Delete link if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{tunnelInterface},
+	}
+
+	if isLayer3 {
+		// run the IPAM plugin and get back the config to apply
+		var r types.Result
+		r, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		// Invoke ipam del if err to avoid ip leak
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		// Convert whatever the IPAM result was into the current Result type
+		var ipamResult *current.Result
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		for _, ipc := range result.IPs {
+			// All addresses apply to the container tunnel interface
+			ipc.Interface = current.Int(0)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(args.IfName, result)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		// For L2 just change interface status to up
+		err = netns.Do(func(_ ns.NetNS) error {
+			tunnelLink, err := netlink.LinkByName(args.IfName)
+			if err != nil {
+				return fmt.Errorf("failed to find interface name %q: %v", args.IfName, err)
+			}
+
+			if err := netlink.LinkSetUp(tunnelLink); err != nil {
+				return fmt.Errorf("failed to set %q UP: %v", args.IfName, err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS, err = dns.ForResult(args.StdinData, n.DNS)
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.IPAM.Type != "" {
+		err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("tunnel"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	isLayer3 := n.IPAM.Type != ""
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if isLayer3 {
+		// run the IPAM plugin and get back the config to apply
+		err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var contMap current.Interface
+	// Find interfaces for names whe know, tunnel device name inside container
+	for _, intf := range result.Interfaces {
+		if args.IfName == intf.Name {
+			if args.Netns == intf.Sandbox {
+				contMap = *intf
+				continue
+			}
+		}
+	}
+
+	// The namespace must be the same as what was configured
+	if args.Netns != contMap.Sandbox {
+		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
+			contMap.Sandbox, args.Netns)
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	if err := netns.Do(func(_ ns.NetNS) error {
+
+		// Check interface against values found in the container
+		err := validateCniContainerInterface(contMap, n)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedRoute(result.Routes)
+		if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateCniContainerInterface(intf current.Interface, conf *NetConf) error {
+	if intf.Name == "" {
+		return fmt.Errorf("Container interface name missing in prevResult: %v", intf.Name)
+	}
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return fmt.Errorf("Container Interface name in prevResult: %s not found", intf.Name)
+	}
+	if intf.Sandbox == "" {
+		return fmt.Errorf("Error: Container interface %s should not be in host namespace", link.Attrs().Name)
+	}
+
+	expected := newTunnelLink(conf, netlink.LinkAttrs{})
+	if link.Type() != expected.Type() {
+		return fmt.Errorf("Error: Container interface %s of type %s, expected %s", link.Attrs().Name, link.Type(), expected.Type())
+	}
+
+	var local, remote net.IP
+	var ttl uint8
+	var key uint32
+	switch l := link.(type) {
+	case *netlink.Gretun:
+		local, remote, ttl, key = l.Local, l.Remote, l.Ttl, l.OKey
+	case *netlink.Gretap:
+		// netlink reports the output key as IKey for gretap links
+		local, remote, ttl, key = l.Local, l.Remote, l.Ttl, l.IKey
+	case *netlink.Iptun:
+		local, remote, ttl = l.Local, l.Remote, l.Ttl
+	case *netlink.Sittun:
+		local, remote, ttl = l.Local, l.Remote, l.Ttl
+	default:
+		return fmt.Errorf("Error: Container interface %s is not a tunnel", link.Attrs().Name)
+	}
+
+	if !remote.Equal(conf.remote) {
+		return fmt.Errorf("Container tunnel remote %s does not match expected value: %s", remote, conf.remote)
+	}
+	if conf.Local != "" && !local.Equal(conf.local) {
+		return fmt.Errorf("Container tunnel local %s does not match expected value: %s", local, conf.local)
+	}
+	if int(ttl) != conf.TTL {
+		return fmt.Errorf("Container tunnel TTL %d does not match expected value: %d", ttl, conf.TTL)
+	}
+	if key != conf.Key {
+		return fmt.Errorf("Container tunnel key %d does not match expected value: %d", key, conf.Key)
+	}
+
+	if conf.MTU != 0 && conf.MTU != link.Attrs().MTU {
+		return fmt.Errorf("Container tunnel MTU %d does not match expected value: %d", link.Attrs().MTU, conf.MTU)
+	}
+
+	if intf.Mac != "" {
+		if intf.Mac != link.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("Interface %s Mac %s doesn't match container Mac: %s", intf.Name, intf.Mac, link.Attrs().HardwareAddr)
+		}
+	}
+
+	return nil
+}
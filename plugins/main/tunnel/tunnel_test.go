@@ -0,0 +1,300 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type Net struct {
+	Name          string                 `json:"name"`
+	CNIVersion    string                 `json:"cniVersion"`
+	Type          string                 `json:"type,omitempty"`
+	Mode          string                 `json:"mode"`
+	Local         string                 `json:"local,omitempty"`
+	Remote        string                 `json:"remote"`
+	Key           uint32                 `json:"key,omitempty"`
+	TTL           int                    `json:"ttl,omitempty"`
+	IPAM          *allocator.IPAMConfig  `json:"ipam"`
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+}
+
+func buildOneConfig(netName string, cniVersion string, orig *Net, prevResult types.Result) (*Net, error) {
+	var err error
+
+	inject := map[string]interface{}{
+		"name":       netName,
+		"cniVersion": cniVersion,
+	}
+	// Add previous plugin result
+	if prevResult != nil {
+		inject["prevResult"] = prevResult
+	}
+
+	// Ensure every config uses the same name and version
+	config := make(map[string]interface{})
+
+	confBytes, err := json.Marshal(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(confBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal existing network bytes: %s", err)
+	}
+
+	for key, value := range inject {
+		config[key] = value
+	}
+
+	newBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Net{}
+	if err := json.Unmarshal(newBytes, &conf); err != nil {
+		return nil, fmt.Errorf("error parsing configuration: %s", err)
+	}
+
+	return conf, nil
+}
+
+var _ = Describe("tunnel configuration", func() {
+	It("validates the configuration", func() {
+		for _, tc := range []struct {
+			body string
+			err  string
+		}{
+			{`"remote": "192.0.2.1"`, `"mode" field is required. It must be one of "gre", "gretap", "ipip" or "sit".`},
+			{`"mode": "vxlan", "remote": "192.0.2.1"`, `unknown tunnel mode: "vxlan"`},
+			{`"mode": "gre"`, `"remote" field is required. It specifies the underlay address of the remote tunnel endpoint.`},
+			{`"mode": "gre", "remote": "foo"`, `invalid remote address "foo"`},
+			{`"mode": "gre", "remote": "192.0.2.1", "local": "2001:db8::1"`, `local address 2001:db8::1 and remote address 192.0.2.1 must be of the same IP family`},
+			{`"mode": "ipip", "remote": "2001:db8::1"`, `ipip tunnels require an IPv4 underlay`},
+			{`"mode": "sit", "remote": "192.0.2.1", "key": 5`, `"key" is only supported by gre and gretap tunnels`},
+			{`"mode": "gre", "remote": "192.0.2.1", "ttl": 256`, `invalid TTL 256, must be [0, 255]`},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "tunnet",
+				"type": "tunnel",
+				%s
+			}`, tc.body)
+			_, _, err := loadConf([]byte(conf))
+			Expect(err).To(MatchError(tc.err))
+		}
+	})
+
+	It("selects the link type from the mode and underlay family", func() {
+		for _, tc := range []struct {
+			body     string
+			linkType string
+		}{
+			{`"mode": "gre", "remote": "192.0.2.1"`, "gre"},
+			{`"mode": "gre", "remote": "2001:db8::1"`, "ip6gre"},
+			{`"mode": "gretap", "remote": "192.0.2.1"`, "gretap"},
+			{`"mode": "gretap", "remote": "2001:db8::1"`, "ip6gretap"},
+			{`"mode": "ipip", "remote": "192.0.2.1"`, "ipip"},
+			{`"mode": "sit", "remote": "192.0.2.1"`, "sit"},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "tunnet",
+				"type": "tunnel",
+				%s
+			}`, tc.body)
+			n, _, err := loadConf([]byte(conf))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(newTunnelLink(n, netlink.LinkAttrs{}).Type()).To(Equal(tc.linkType))
+		}
+	})
+})
+
+var _ = Describe("tunnel Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "tunnel_test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	for _, mode := range []string{modeGRE, modeGRETap, modeIPIP, modeSIT} {
+		for _, ver := range testutils.AllSpecVersions {
+			// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+			// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+			ver := ver
+			mode := mode
+
+			It(fmt.Sprintf("[%s] configures and deconfigures a %s tunnel with ADD/CHECK/DEL", ver, mode), func() {
+				const IFNAME = "tun0"
+
+				key := ""
+				if mode == modeGRE || mode == modeGRETap {
+					key = `"key": 42,`
+				}
+
+				conf := fmt.Sprintf(`{
+				    "cniVersion": "%s",
+				    "name": "tunnelTest",
+				    "type": "tunnel",
+				    "mode": "%s",
+				    "local": "192.0.2.1",
+				    "remote": "192.0.2.2",
+				    %s
+				    "ttl": 64,
+				    "ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"dataDir": "%s"
+				    }
+				}`, ver, mode, key, dataDir)
+
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNS.Path(),
+					IfName:      IFNAME,
+					StdinData:   []byte(conf),
+				}
+
+				var result types.Result
+				err := originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					var err error
+					result, _, err = testutils.CmdAddWithArgs(args, func() error {
+						return cmdAdd(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// Make sure the tunnel exists in the target namespace
+				err = targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(IFNAME)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Type()).To(Equal(mode))
+
+					// The underlay of the tunnel is the host namespace
+					hostNsID, err := netlink.GetNetNsIdByFd(int(originalNS.Fd()))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Attrs().NetNsID).To(Equal(hostNsID))
+
+					addrs, err := netlink.AddrList(link, syscall.AF_INET)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(len(addrs)).To(Equal(1))
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// CNI Check the tunnel in the target namespace
+				n := &Net{}
+				err = json.Unmarshal([]byte(conf), &n)
+				Expect(err).NotTo(HaveOccurred())
+
+				n.IPAM, _, err = allocator.LoadIPAMConfig([]byte(conf), "")
+				Expect(err).NotTo(HaveOccurred())
+
+				newConf, err := buildOneConfig("tunnelTest", ver, n, result)
+				Expect(err).NotTo(HaveOccurred())
+
+				confString, err := json.Marshal(newConf)
+				Expect(err).NotTo(HaveOccurred())
+
+				args.StdinData = confString
+				err = originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+					return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+				})
+				if testutils.SpecVersionHasCHECK(ver) {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError("config version does not allow CHECK"))
+				}
+
+				args.StdinData = []byte(conf)
+				err = originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err = testutils.CmdDelWithArgs(args, func() error {
+						return cmdDel(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// Make sure the tunnel has been deleted
+				err = targetNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(IFNAME)
+					Expect(err).To(HaveOccurred())
+					Expect(link).To(BeNil())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				// DEL can be called multiple times, make sure no error is returned
+				// if the device is already removed.
+				err = originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err = testutils.CmdDelWithArgs(args, func() error {
+						return cmdDel(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			})
+		}
+	}
+})
@@ -0,0 +1,378 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/containernetworking/plugins/pkg/dns"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+type NetConf struct {
+	types.NetConf
+	// PeerNetns is the path of the namespace the other end of the veth
+	// is placed in, for instance a sidecar namespace
+	PeerNetns string `json:"peerNetns"`
+	// PeerIfName is the name of the veth in PeerNetns. A random name is
+	// used if it is empty.
+	PeerIfName string `json:"peerIfName,omitempty"`
+	MTU        int    `json:"mtu,omitempty"`
+	Mac        string `json:"mac,omitempty"`
+
+	RuntimeConfig struct {
+		PeerNetns string `json:"peerNetns,omitempty"`
+		Mac       string `json:"mac,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if n.RuntimeConfig.PeerNetns != "" {
+		n.PeerNetns = n.RuntimeConfig.PeerNetns
+	}
+	if n.RuntimeConfig.Mac != "" {
+		n.Mac = n.RuntimeConfig.Mac
+	}
+
+	if n.PeerNetns == "" {
+		return nil, "", fmt.Errorf("\"peerNetns\" field is required. It specifies the namespace of the other end of the veth.")
+	}
+	if n.MTU < 0 {
+		return nil, "", fmt.Errorf("invalid MTU %d", n.MTU)
+	}
+
+	return n, n.CNIVersion, nil
+}
+
+func setupVeth(conf *NetConf, ifName string, netns, peerNS ns.NetNS) (*current.Interface, *current.Interface, error) {
+	contInterface := &current.Interface{}
+	peerInterface := &current.Interface{}
+
+	err := netns.Do(func(_ ns.NetNS) error {
+		peerVeth, contVeth, err := ip.SetupVethWithName(ifName, conf.PeerIfName, conf.MTU, conf.Mac, peerNS)
+		if err != nil {
+			return err
+		}
+		contInterface.Name = contVeth.Name
+		contInterface.Mac = contVeth.HardwareAddr.String()
+		contInterface.Sandbox = netns.Path()
+		peerInterface.Name = peerVeth.Name
+		peerInterface.Mac = peerVeth.HardwareAddr.String()
+		peerInterface.Sandbox = peerNS.Path()
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return contInterface, peerInterface, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	isLayer3 := n.IPAM.Type != ""
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	peerNS, err := ns.GetNS(n.PeerNetns)
+	if err != nil {
+		return fmt.Errorf("failed to open peer netns %q: %v", n.PeerNetns, err)
+	}
+	defer peerNS.Close()
+
+	contInterface, peerInterface, err := setupVeth(n, args.IfName, netns, peerNS)
+	if err != nil {
+		return err
+	}
+
+	// Delete link if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{contInterface, peerInterface},
+	}
+
+	if isLayer3 {
+		// run the IPAM plugin and get back the config to apply
+		var r types.Result
+		r, err = ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+
+		// Invoke ipam del if err to avoid ip leak
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+			}
+		}()
+
+		// Convert whatever the IPAM result was into the current Result type
+		var ipamResult *current.Result
+		ipamResult, err = current.NewResultFromResult(r)
+		if err != nil {
+			return err
+		}
+
+		if len(ipamResult.IPs) == 0 {
+			err = errors.New("IPAM plugin returned missing IP config")
+			return err
+		}
+
+		result.IPs = ipamResult.IPs
+		result.Routes = ipamResult.Routes
+
+		for _, ipc := range result.IPs {
+			// All addresses apply to the container end of the veth
+			ipc.Interface = current.Int(0)
+		}
+
+		err = netns.Do(func(_ ns.NetNS) error {
+			return ipam.ConfigureIface(args.IfName, result)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	result.DNS, err = dns.ForResult(args.StdinData, n.DNS)
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n := &NetConf{}
+	if err := json.Unmarshal(args.StdinData, n); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed. Deleting
+	// the container end removes the peer end as well.
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		//  if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
+		// so don't return an error if the device is already removed.
+		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
+		_, ok := err.(ns.NSPathNotExistErr)
+		if ok {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("veth"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	isLayer3 := n.IPAM.Type != ""
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	peerNS, err := ns.GetNS(n.PeerNetns)
+	if err != nil {
+		return fmt.Errorf("failed to open peer netns %q: %v", n.PeerNetns, err)
+	}
+	defer peerNS.Close()
+
+	if isLayer3 {
+		// run the IPAM plugin and get back the config to apply
+		err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var contMap, peerMap current.Interface
+	// Find interfaces for names we know, the veth ends in both namespaces
+	for _, intf := range result.Interfaces {
+		if args.IfName == intf.Name && args.Netns == intf.Sandbox {
+			contMap = *intf
+			continue
+		}
+		if n.PeerNetns == intf.Sandbox {
+			peerMap = *intf
+		}
+	}
+
+	// The namespaces must be the same as what was configured
+	if args.Netns != contMap.Sandbox {
+		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
+			contMap.Sandbox, args.Netns)
+	}
+	if n.PeerNetns != peerMap.Sandbox {
+		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured peer netns: %s",
+			peerMap.Sandbox, n.PeerNetns)
+	}
+
+	// Check the peer end and find its index
+	var peerIndex, peerPeerIndex int
+	if err := peerNS.Do(func(_ ns.NetNS) error {
+		if err := validateInterface(peerMap); err != nil {
+			return err
+		}
+		link, index, err := ip.GetVethPeerIfindex(peerMap.Name)
+		if err != nil {
+			return err
+		}
+		peerIndex = link.Attrs().Index
+		peerPeerIndex = index
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	if err := netns.Do(func(_ ns.NetNS) error {
+
+		// Check interface against values found in the container
+		err := validateInterface(contMap)
+		if err != nil {
+			return err
+		}
+
+		link, index, err := ip.GetVethPeerIfindex(contMap.Name)
+		if err != nil {
+			return err
+		}
+		if index != peerIndex || link.Attrs().Index != peerPeerIndex {
+			return fmt.Errorf("Container interface %s is not the peer of %s in %s",
+				contMap.Name, peerMap.Name, n.PeerNetns)
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedRoute(result.Routes)
+		if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateInterface(intf current.Interface) error {
+	if intf.Name == "" {
+		return fmt.Errorf("Interface name missing in prevResult: %v", intf.Name)
+	}
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return fmt.Errorf("Interface name in prevResult: %s not found", intf.Name)
+	}
+
+	if _, isVeth := link.(*netlink.Veth); !isVeth {
+		return fmt.Errorf("Error: Interface %s not of type veth", link.Attrs().Name)
+	}
+
+	if intf.Mac != "" {
+		if intf.Mac != link.Attrs().HardwareAddr.String() {
+			return fmt.Errorf("Interface %s Mac %s doesn't match found Mac: %s", intf.Name, intf.Mac, link.Attrs().HardwareAddr)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type Net struct {
+	Name          string                `json:"name"`
+	CNIVersion    string                `json:"cniVersion"`
+	Type          string                `json:"type,omitempty"`
+	PeerIfName    string                `json:"peerIfName"`
+	MTU           int                   `json:"mtu"`
+	IPAM          *allocator.IPAMConfig `json:"ipam"`
+	RuntimeConfig struct {
+		PeerNetns string `json:"peerNetns"`
+	} `json:"runtimeConfig"`
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+}
+
+func buildOneConfig(netName string, cniVersion string, orig *Net, prevResult types.Result) (*Net, error) {
+	var err error
+
+	inject := map[string]interface{}{
+		"name":       netName,
+		"cniVersion": cniVersion,
+	}
+	// Add previous plugin result
+	if prevResult != nil {
+		inject["prevResult"] = prevResult
+	}
+
+	// Ensure every config uses the same name and version
+	config := make(map[string]interface{})
+
+	confBytes, err := json.Marshal(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(confBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal existing network bytes: %s", err)
+	}
+
+	for key, value := range inject {
+		config[key] = value
+	}
+
+	newBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Net{}
+	if err := json.Unmarshal(newBytes, &conf); err != nil {
+		return nil, fmt.Errorf("error parsing configuration: %s", err)
+	}
+
+	return conf, nil
+}
+
+var _ = Describe("veth configuration", func() {
+	It("requires a peer namespace", func() {
+		_, _, err := loadConf([]byte(`{"cniVersion": "1.0.0", "name": "vethnet", "type": "veth"}`))
+		Expect(err).To(MatchError("\"peerNetns\" field is required. It specifies the namespace of the other end of the veth."))
+	})
+
+	It("takes the peer namespace from runtimeConfig", func() {
+		n, _, err := loadConf([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "vethnet",
+			"type": "veth",
+			"peerNetns": "/var/run/netns/a",
+			"runtimeConfig": {"peerNetns": "/var/run/netns/b"}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.PeerNetns).To(Equal("/var/run/netns/b"))
+	})
+})
+
+var _ = Describe("veth Operations", func() {
+	var originalNS, targetNS, peerNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		peerNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "veth_test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+		Expect(peerNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(peerNS)).To(Succeed())
+	})
+
+	for _, ver := range testutils.AllSpecVersions {
+		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+		ver := ver
+
+		It(fmt.Sprintf("[%s] connects two namespaces with ADD/CHECK/DEL", ver), func() {
+			const IFNAME = "eth1"
+			const PEERIFNAME = "svc0"
+
+			conf := fmt.Sprintf(`{
+			    "cniVersion": "%s",
+			    "name": "vethTest",
+			    "type": "veth",
+			    "peerIfName": "%s",
+			    "mtu": 1400,
+			    "runtimeConfig": {
+				"peerNetns": "%s"
+			    },
+			    "ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": "%s"
+			    }
+			}`, ver, PEERIFNAME, peerNS.Path(), dataDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			var result types.Result
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				var err error
+				result, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			if ver == "1.0.0" {
+				r, err := types100.GetResult(result)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(r.Interfaces).To(HaveLen(2))
+				Expect(r.Interfaces[0].Name).To(Equal(IFNAME))
+				Expect(r.Interfaces[0].Sandbox).To(Equal(targetNS.Path()))
+				Expect(r.Interfaces[1].Name).To(Equal(PEERIFNAME))
+				Expect(r.Interfaces[1].Sandbox).To(Equal(peerNS.Path()))
+			}
+
+			// Make sure both ends exist and are peers of each other
+			var peerIndex int
+			err = peerNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, _, err := ip.GetVethPeerIfindex(PEERIFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().MTU).To(Equal(1400))
+				peerIndex = link.Attrs().Index
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, index, err := ip.GetVethPeerIfindex(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(index).To(Equal(peerIndex))
+
+				addrs, err := netlink.AddrList(link, syscall.AF_INET)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(addrs)).To(Equal(1))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// CNI Check both ends
+			n := &Net{}
+			err = json.Unmarshal([]byte(conf), &n)
+			Expect(err).NotTo(HaveOccurred())
+
+			n.IPAM, _, err = allocator.LoadIPAMConfig([]byte(conf), "")
+			Expect(err).NotTo(HaveOccurred())
+
+			newConf, err := buildOneConfig("vethTest", ver, n, result)
+			Expect(err).NotTo(HaveOccurred())
+
+			confString, err := json.Marshal(newConf)
+			Expect(err).NotTo(HaveOccurred())
+
+			args.StdinData = confString
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+			})
+			if testutils.SpecVersionHasCHECK(ver) {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError("config version does not allow CHECK"))
+			}
+
+			args.StdinData = []byte(conf)
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				err = testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Make sure both ends have been deleted
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, err := netlink.LinkByName(IFNAME)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = peerNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, err := netlink.LinkByName(PEERIFNAME)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// DEL can be called multiple times, make sure no error is returned
+			// if the device is already removed.
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				err = testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	}
+})
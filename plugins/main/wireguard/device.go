@@ -0,0 +1,338 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Generic netlink constants from include/uapi/linux/wireguard.h
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfname     = 2
+	wgDeviceAPrivateKey = 3
+	wgDeviceAFlags      = 5
+	wgDeviceAListenPort = 6
+	wgDeviceAPeers      = 8
+
+	wgDeviceFReplacePeers = 1 << 0
+
+	wgPeerAPublicKey                   = 1
+	wgPeerAPresharedKey                = 2
+	wgPeerAFlags                       = 3
+	wgPeerAEndpoint                    = 4
+	wgPeerAPersistentKeepaliveInterval = 5
+	wgPeerAAllowedIPs                  = 9
+
+	wgPeerFReplaceAllowedIPs = 1 << 1
+
+	wgAllowedIPAFamily   = 1
+	wgAllowedIPAIPAddr   = 2
+	wgAllowedIPACidrMask = 3
+
+	wgKeyLen = 32
+
+	nlaTypeMask = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+)
+
+type wgKey [wgKeyLen]byte
+
+func (k wgKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// parseKey decodes a base64 key. Its errors leave the key out, since they
+// end up in the logs of the runtime.
+func parseKey(s string) (wgKey, error) {
+	var k wgKey
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return k, err
+	}
+	if len(b) != wgKeyLen {
+		return k, fmt.Errorf("must be %d bytes, got %d", wgKeyLen, len(b))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+type wgPeer struct {
+	PublicKey           wgKey
+	PresharedKey        *wgKey
+	Endpoint            *net.UDPAddr
+	AllowedIPs          []net.IPNet
+	PersistentKeepalive int
+}
+
+type wgDevice struct {
+	PrivateKey wgKey
+	ListenPort int
+	Peers      []wgPeer
+}
+
+// wgSetDevice replaces the configuration of the wireguard link ifName in
+// the current network namespace with dev.
+func wgSetDevice(ifName string, dev *wgDevice) error {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return fmt.Errorf("failed to find %q generic netlink family: %v", wgGenlName, err)
+	}
+
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{
+		Command: wgCmdSetDevice,
+		Version: wgGenlVersion,
+	})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfname, nl.ZeroTerminated(ifName)))
+	req.AddData(nl.NewRtAttr(wgDeviceAPrivateKey, dev.PrivateKey[:]))
+	req.AddData(nl.NewRtAttr(wgDeviceAListenPort, nl.Uint16Attr(uint16(dev.ListenPort))))
+	req.AddData(nl.NewRtAttr(wgDeviceAFlags, nl.Uint32Attr(wgDeviceFReplacePeers)))
+
+	if len(dev.Peers) > 0 {
+		peers := nl.NewRtAttr(unix.NLA_F_NESTED|wgDeviceAPeers, nil)
+		for i, p := range dev.Peers {
+			peer := peers.AddRtAttr(unix.NLA_F_NESTED|i, nil)
+			peer.AddRtAttr(wgPeerAPublicKey, p.PublicKey[:])
+			peer.AddRtAttr(wgPeerAFlags, nl.Uint32Attr(wgPeerFReplaceAllowedIPs))
+			if p.PresharedKey != nil {
+				peer.AddRtAttr(wgPeerAPresharedKey, p.PresharedKey[:])
+			}
+			if p.Endpoint != nil {
+				peer.AddRtAttr(wgPeerAEndpoint, encodeSockaddr(p.Endpoint))
+			}
+			peer.AddRtAttr(wgPeerAPersistentKeepaliveInterval, nl.Uint16Attr(uint16(p.PersistentKeepalive)))
+
+			allowed := peer.AddRtAttr(unix.NLA_F_NESTED|wgPeerAAllowedIPs, nil)
+			for j, ipn := range p.AllowedIPs {
+				a := allowed.AddRtAttr(unix.NLA_F_NESTED|j, nil)
+				ones, _ := ipn.Mask.Size()
+				if ip4 := ipn.IP.To4(); ip4 != nil {
+					a.AddRtAttr(wgAllowedIPAFamily, nl.Uint16Attr(unix.AF_INET))
+					a.AddRtAttr(wgAllowedIPAIPAddr, []byte(ip4))
+				} else {
+					a.AddRtAttr(wgAllowedIPAFamily, nl.Uint16Attr(unix.AF_INET6))
+					a.AddRtAttr(wgAllowedIPAIPAddr, []byte(ipn.IP.To16()))
+				}
+				a.AddRtAttr(wgAllowedIPACidrMask, nl.Uint8Attr(uint8(ones)))
+			}
+		}
+		req.AddData(peers)
+	}
+
+	if _, err := req.Execute(unix.NETLINK_GENERIC, 0); err != nil {
+		return fmt.Errorf("failed to configure wireguard device %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// wgGetDevice returns the configuration of the wireguard link ifName in
+// the current network namespace.
+func wgGetDevice(ifName string) (*wgDevice, error) {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %q generic netlink family: %v", wgGenlName, err)
+	}
+
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_DUMP)
+	req.AddData(&nl.Genlmsg{
+		Command: wgCmdGetDevice,
+		Version: wgGenlVersion,
+	})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfname, nl.ZeroTerminated(ifName)))
+
+	msgs, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query wireguard device %q: %v", ifName, err)
+	}
+
+	dev := &wgDevice{}
+	for _, m := range msgs {
+		if err := parseDeviceMsg(m[nl.SizeofGenlmsg:], dev); err != nil {
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+
+// parseDeviceMsg merges one message of a WG_CMD_GET_DEVICE dump into dev.
+// Large peers may be split across messages, in which case the first peer
+// of a message continues the last peer of the previous one.
+func parseDeviceMsg(b []byte, dev *wgDevice) error {
+	native := nl.NativeEndian()
+
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type & nlaTypeMask {
+		case wgDeviceAPrivateKey:
+			copy(dev.PrivateKey[:], a.Value)
+		case wgDeviceAListenPort:
+			dev.ListenPort = int(native.Uint16(a.Value))
+		case wgDeviceAPeers:
+			peerAttrs, err := nl.ParseRouteAttr(a.Value)
+			if err != nil {
+				return err
+			}
+			for _, pa := range peerAttrs {
+				p, err := parsePeer(pa.Value)
+				if err != nil {
+					return err
+				}
+				if n := len(dev.Peers); n > 0 && dev.Peers[n-1].PublicKey == p.PublicKey {
+					dev.Peers[n-1].AllowedIPs = append(dev.Peers[n-1].AllowedIPs, p.AllowedIPs...)
+					continue
+				}
+				dev.Peers = append(dev.Peers, *p)
+			}
+		}
+	}
+	return nil
+}
+
+func parsePeer(b []byte) (*wgPeer, error) {
+	native := nl.NativeEndian()
+
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+	p := &wgPeer{}
+	for _, a := range attrs {
+		switch a.Attr.Type & nlaTypeMask {
+		case wgPeerAPublicKey:
+			copy(p.PublicKey[:], a.Value)
+		case wgPeerAPresharedKey:
+			var k wgKey
+			copy(k[:], a.Value)
+			if k != (wgKey{}) {
+				p.PresharedKey = &k
+			}
+		case wgPeerAEndpoint:
+			p.Endpoint = decodeSockaddr(a.Value)
+		case wgPeerAPersistentKeepaliveInterval:
+			p.PersistentKeepalive = int(native.Uint16(a.Value))
+		case wgPeerAAllowedIPs:
+			ipAttrs, err := nl.ParseRouteAttr(a.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, ia := range ipAttrs {
+				ipn, err := parseAllowedIP(ia.Value)
+				if err != nil {
+					return nil, err
+				}
+				p.AllowedIPs = append(p.AllowedIPs, *ipn)
+			}
+		}
+	}
+	return p, nil
+}
+
+func parseAllowedIP(b []byte) (*net.IPNet, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+	var addr net.IP
+	var ones int
+	for _, a := range attrs {
+		switch a.Attr.Type & nlaTypeMask {
+		case wgAllowedIPAIPAddr:
+			addr = net.IP(append([]byte(nil), a.Value...))
+		case wgAllowedIPACidrMask:
+			ones = int(a.Value[0])
+		}
+	}
+	if addr == nil {
+		return nil, fmt.Errorf("allowed IP without address")
+	}
+	return &net.IPNet{IP: addr, Mask: net.CIDRMask(ones, len(addr)*8)}, nil
+}
+
+// encodeSockaddr serializes addr as a struct sockaddr_in or sockaddr_in6.
+func encodeSockaddr(addr *net.UDPAddr) []byte {
+	native := nl.NativeEndian()
+
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		native.PutUint16(b[0:2], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+		copy(b[4:8], ip4)
+		return b
+	}
+
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	native.PutUint16(b[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[8:24], addr.IP.To16())
+	return b
+}
+
+func decodeSockaddr(b []byte) *net.UDPAddr {
+	if len(b) < 2 {
+		return nil
+	}
+	switch nl.NativeEndian().Uint16(b[0:2]) {
+	case unix.AF_INET:
+		if len(b) < 8 {
+			return nil
+		}
+		return &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), b[4:8]...)),
+			Port: int(binary.BigEndian.Uint16(b[2:4])),
+		}
+	case unix.AF_INET6:
+		if len(b) < 24 {
+			return nil
+		}
+		return &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), b[8:24]...)),
+			Port: int(binary.BigEndian.Uint16(b[2:4])),
+		}
+	}
+	return nil
+}
+
+// equalIPNets returns true if a and b contain the same prefixes, in any order
+func equalIPNets(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, n := range a {
+		seen[n.String()]++
+	}
+	for _, n := range b {
+		if seen[n.String()] == 0 {
+			return false
+		}
+		seen[n.String()]--
+	}
+	return true
+}
@@ -0,0 +1,469 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/containernetworking/plugins/pkg/dns"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/pkg/ns"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+// PeerConf describes a wireguard peer
+type PeerConf struct {
+	PublicKey           string   `json:"publicKey"`
+	PresharedKey        string   `json:"presharedKey,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowedIPs,omitempty"`
+	PersistentKeepalive int      `json:"persistentKeepalive,omitempty"`
+}
+
+// WireguardConf is the wireguard device configuration. It may be given
+// in the netconf or through the "wireguard" runtimeConfig capability.
+type WireguardConf struct {
+	PrivateKey string     `json:"privateKey,omitempty"`
+	ListenPort int        `json:"listenPort,omitempty"`
+	Peers      []PeerConf `json:"peers,omitempty"`
+}
+
+type NetConf struct {
+	types.NetConf
+	WireguardConf
+	MTU int `json:"mtu,omitempty"`
+
+	RuntimeConfig struct {
+		Wireguard *WireguardConf `json:"wireguard,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	device *wgDevice
+}
+
+func init() {
+	// this ensures that main runs only on main thread (thread group leader).
+	// since namespace ops (unshare, setns) are done for a single thread, we
+	// must ensure that the goroutine does not jump from OS thread to thread
+	runtime.LockOSThread()
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.IPAM.Type == "" {
+		return nil, "", fmt.Errorf("\"ipam\" is required for the wireguard plugin")
+	}
+	if n.MTU < 0 {
+		return nil, "", fmt.Errorf("invalid MTU %d", n.MTU)
+	}
+
+	// runtimeConfig values override the ones from the netconf
+	if rc := n.RuntimeConfig.Wireguard; rc != nil {
+		if rc.PrivateKey != "" {
+			n.PrivateKey = rc.PrivateKey
+		}
+		if rc.ListenPort != 0 {
+			n.ListenPort = rc.ListenPort
+		}
+		if len(rc.Peers) > 0 {
+			n.Peers = rc.Peers
+		}
+	}
+
+	dev, err := parseDevice(&n.WireguardConf)
+	if err != nil {
+		return nil, "", err
+	}
+	n.device = dev
+
+	return n, n.CNIVersion, nil
+}
+
+func parseDevice(conf *WireguardConf) (*wgDevice, error) {
+	if conf.PrivateKey == "" {
+		return nil, fmt.Errorf("\"privateKey\" is required")
+	}
+	key, err := parseKey(conf.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid privateKey: %v", err)
+	}
+	if conf.ListenPort < 0 || conf.ListenPort > 65535 {
+		return nil, fmt.Errorf("invalid listenPort %d", conf.ListenPort)
+	}
+
+	dev := &wgDevice{
+		PrivateKey: key,
+		ListenPort: conf.ListenPort,
+	}
+
+	seen := map[wgKey]bool{}
+	for i, pc := range conf.Peers {
+		p, err := parsePeerConf(&pc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %d: %v", i, err)
+		}
+		if seen[p.PublicKey] {
+			return nil, fmt.Errorf("invalid peer %d: duplicate publicKey %s", i, pc.PublicKey)
+		}
+		seen[p.PublicKey] = true
+		dev.Peers = append(dev.Peers, *p)
+	}
+
+	return dev, nil
+}
+
+func parsePeerConf(pc *PeerConf) (*wgPeer, error) {
+	p := &wgPeer{}
+
+	if pc.PublicKey == "" {
+		return nil, fmt.Errorf("\"publicKey\" is required")
+	}
+	key, err := parseKey(pc.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publicKey: %v", err)
+	}
+	p.PublicKey = key
+
+	if pc.PresharedKey != "" {
+		psk, err := parseKey(pc.PresharedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid presharedKey: %v", err)
+		}
+		p.PresharedKey = &psk
+	}
+
+	if pc.Endpoint != "" {
+		addr, err := net.ResolveUDPAddr("udp", pc.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %v", pc.Endpoint, err)
+		}
+		p.Endpoint = addr
+	}
+
+	for _, s := range pc.AllowedIPs {
+		_, ipn, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowedIPs entry %q: %v", s, err)
+		}
+		p.AllowedIPs = append(p.AllowedIPs, *ipn)
+	}
+
+	if pc.PersistentKeepalive < 0 || pc.PersistentKeepalive > 65535 {
+		return nil, fmt.Errorf("invalid persistentKeepalive %d", pc.PersistentKeepalive)
+	}
+	p.PersistentKeepalive = pc.PersistentKeepalive
+
+	return p, nil
+}
+
+func createWireguard(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	wg := &current.Interface{}
+
+	err := netns.Do(func(_ ns.NetNS) error {
+		// The link is created directly in the container namespace so that
+		// its UDP socket lives there as well
+		link := &netlink.Wireguard{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: ifName,
+				MTU:  conf.MTU,
+			},
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return fmt.Errorf("failed to create wireguard link %q: %v", ifName, err)
+		}
+
+		if err := wgSetDevice(ifName, conf.device); err != nil {
+			_ = netlink.LinkDel(link)
+			return err
+		}
+
+		wg.Name = ifName
+		wg.Sandbox = netns.Path()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return wg, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	n, cniVersion, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	wgInterface, err := createWireguard(n, args.IfName, netns)
+	if err != nil {
+		return err
+	}
+
+	// Delete link if err to avoid link leak in this ns
+	defer func() {
+		if err != nil {
+			netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(args.IfName)
+			})
+		}
+	}()
+
+	// run the IPAM plugin and get back the config to apply
+	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return fmt.Errorf("failed to execute IPAM delegate: %v", err)
+	}
+
+	// Invoke ipam del if err to avoid ip leak
+	defer func() {
+		if err != nil {
+			ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		}
+	}()
+
+	// Convert whatever the IPAM result was into the current Result type
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return err
+	}
+
+	if len(result.IPs) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
+	}
+	for _, ipc := range result.IPs {
+		// All addresses belong to the wireguard interface
+		ipc.Interface = current.Int(0)
+	}
+
+	result.Interfaces = []*current.Interface{wgInterface}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIface(args.IfName, result)
+	})
+	if err != nil {
+		return err
+	}
+
+	result.DNS, err = dns.ForResult(args.StdinData, n.DNS)
+	if err != nil {
+		return err
+	}
+
+	return types.PrintResult(result, cniVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n := &NetConf{}
+	if err := json.Unmarshal(args.StdinData, n); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	if n.IPAM.Type != "" {
+		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	if args.Netns == "" {
+		return nil
+	}
+
+	// There is a netns so try to clean up. Delete can be called multiple times
+	// so don't return an error if the device is already removed.
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil {
+			if err != ip.ErrLinkNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("wireguard"))
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	// run the IPAM plugin and get back the config to apply
+	err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// Parse previous result.
+	if n.NetConf.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return err
+	}
+
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	var contMap current.Interface
+	// Find interfaces for names whe know, wireguard device name inside container
+	for _, intf := range result.Interfaces {
+		if args.IfName == intf.Name {
+			if args.Netns == intf.Sandbox {
+				contMap = *intf
+				continue
+			}
+		}
+	}
+
+	// The namespace must be the same as what was configured
+	if args.Netns != contMap.Sandbox {
+		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
+			contMap.Sandbox, args.Netns)
+	}
+
+	// Check prevResults for ips, routes and dns against values found in the container
+	if err := netns.Do(func(_ ns.NetNS) error {
+
+		// Check interface against values found in the container
+		err := validateCniContainerInterface(contMap, n)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs)
+		if err != nil {
+			return err
+		}
+
+		err = ip.ValidateExpectedRoute(result.Routes)
+		if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateCniContainerInterface(intf current.Interface, conf *NetConf) error {
+	if intf.Name == "" {
+		return fmt.Errorf("Container interface name missing in prevResult: %v", intf.Name)
+	}
+	link, err := netlink.LinkByName(intf.Name)
+	if err != nil {
+		return fmt.Errorf("Container Interface name in prevResult: %s not found", intf.Name)
+	}
+	if intf.Sandbox == "" {
+		return fmt.Errorf("Error: Container interface %s should not be in host namespace", link.Attrs().Name)
+	}
+
+	if _, isWireguard := link.(*netlink.Wireguard); !isWireguard {
+		return fmt.Errorf("Error: Container interface %s not of type wireguard", link.Attrs().Name)
+	}
+
+	if conf.MTU != 0 && conf.MTU != link.Attrs().MTU {
+		return fmt.Errorf("Error: Container interface %s MTU is %d, expected %d",
+			intf.Name, link.Attrs().MTU, conf.MTU)
+	}
+
+	dev, err := wgGetDevice(intf.Name)
+	if err != nil {
+		return err
+	}
+
+	if dev.PrivateKey != conf.device.PrivateKey {
+		return fmt.Errorf("wireguard interface %s private key doesn't match configured key", intf.Name)
+	}
+	if conf.device.ListenPort != 0 && dev.ListenPort != conf.device.ListenPort {
+		return fmt.Errorf("wireguard interface %s listen port is %d, expected %d",
+			intf.Name, dev.ListenPort, conf.device.ListenPort)
+	}
+
+	return validatePeers(dev.Peers, conf.device.Peers)
+}
+
+// validatePeers checks that the peers found on the device are exactly the
+// configured ones
+func validatePeers(found, expected []wgPeer) error {
+	if len(found) != len(expected) {
+		return fmt.Errorf("wireguard interface has %d peers, expected %d", len(found), len(expected))
+	}
+
+	byKey := make(map[wgKey]*wgPeer, len(found))
+	for i := range found {
+		byKey[found[i].PublicKey] = &found[i]
+	}
+
+	for _, exp := range expected {
+		p, ok := byKey[exp.PublicKey]
+		if !ok {
+			return fmt.Errorf("wireguard peer %s not found", exp.PublicKey)
+		}
+		if exp.Endpoint != nil {
+			if p.Endpoint == nil || !p.Endpoint.IP.Equal(exp.Endpoint.IP) || p.Endpoint.Port != exp.Endpoint.Port {
+				return fmt.Errorf("wireguard peer %s endpoint is %v, expected %v", exp.PublicKey, p.Endpoint, exp.Endpoint)
+			}
+		}
+		if (exp.PresharedKey == nil) != (p.PresharedKey == nil) ||
+			(exp.PresharedKey != nil && *exp.PresharedKey != *p.PresharedKey) {
+			return fmt.Errorf("wireguard peer %s preshared key doesn't match configured key", exp.PublicKey)
+		}
+		if !equalIPNets(p.AllowedIPs, exp.AllowedIPs) {
+			return fmt.Errorf("wireguard peer %s allowed IPs are %v, expected %v", exp.PublicKey, p.AllowedIPs, exp.AllowedIPs)
+		}
+		if p.PersistentKeepalive != exp.PersistentKeepalive {
+			return fmt.Errorf("wireguard peer %s persistent keepalive is %d, expected %d",
+				exp.PublicKey, p.PersistentKeepalive, exp.PersistentKeepalive)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,379 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	privateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	peerKey    = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	otherKey   = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+)
+
+type Net struct {
+	Name          string                 `json:"name"`
+	CNIVersion    string                 `json:"cniVersion"`
+	Type          string                 `json:"type,omitempty"`
+	PrivateKey    string                 `json:"privateKey"`
+	ListenPort    int                    `json:"listenPort,omitempty"`
+	Peers         []PeerConf             `json:"peers"`
+	IPAM          *allocator.IPAMConfig  `json:"ipam"`
+	RawPrevResult map[string]interface{} `json:"prevResult,omitempty"`
+}
+
+func buildOneConfig(netName string, cniVersion string, orig *Net, prevResult types.Result) (*Net, error) {
+	var err error
+
+	inject := map[string]interface{}{
+		"name":       netName,
+		"cniVersion": cniVersion,
+	}
+	// Add previous plugin result
+	if prevResult != nil {
+		inject["prevResult"] = prevResult
+	}
+
+	// Ensure every config uses the same name and version
+	config := make(map[string]interface{})
+
+	confBytes, err := json.Marshal(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(confBytes, &config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal existing network bytes: %s", err)
+	}
+
+	for key, value := range inject {
+		config[key] = value
+	}
+
+	newBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Net{}
+	if err := json.Unmarshal(newBytes, &conf); err != nil {
+		return nil, fmt.Errorf("error parsing configuration: %s", err)
+	}
+
+	return conf, nil
+}
+
+var _ = Describe("wireguard configuration", func() {
+	It("parses keys, peers and runtimeConfig overrides", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "wgnet",
+			"type": "wireguard",
+			"privateKey": "%s",
+			"listenPort": 51820,
+			"peers": [{
+				"publicKey": "%s",
+				"endpoint": "192.0.2.1:51820",
+				"allowedIPs": ["10.0.0.0/24", "fd00::/64"],
+				"persistentKeepalive": 25
+			}],
+			"runtimeConfig": {
+				"wireguard": {
+					"listenPort": 4242
+				}
+			},
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, privateKey, peerKey)
+
+		n, _, err := loadConf([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.device.PrivateKey.String()).To(Equal(privateKey))
+		Expect(n.device.ListenPort).To(Equal(4242))
+		Expect(n.device.Peers).To(HaveLen(1))
+
+		p := n.device.Peers[0]
+		Expect(p.PublicKey.String()).To(Equal(peerKey))
+		Expect(p.Endpoint.String()).To(Equal("192.0.2.1:51820"))
+		Expect(p.AllowedIPs).To(HaveLen(2))
+		Expect(p.AllowedIPs[1].String()).To(Equal("fd00::/64"))
+		Expect(p.PersistentKeepalive).To(Equal(25))
+	})
+
+	It("takes the private key and peers from runtimeConfig", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "wgnet",
+			"type": "wireguard",
+			"peers": [{"publicKey": "%s"}],
+			"runtimeConfig": {
+				"wireguard": {
+					"privateKey": "%s",
+					"peers": [{"publicKey": "%s", "allowedIPs": ["0.0.0.0/0"]}]
+				}
+			},
+			"ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}
+		}`, otherKey, privateKey, peerKey)
+
+		n, _, err := loadConf([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.device.PrivateKey.String()).To(Equal(privateKey))
+		Expect(n.device.Peers).To(HaveLen(1))
+		Expect(n.device.Peers[0].PublicKey.String()).To(Equal(peerKey))
+	})
+
+	It("rejects invalid configurations", func() {
+		for _, tc := range []struct {
+			body string
+			err  string
+		}{
+			{`"peers": []`, `"privateKey" is required`},
+			{`"privateKey": "Zm9v"`, `invalid privateKey: must be 32 bytes, got 3`},
+			{`"privateKey": "Zm9v!"`, `invalid privateKey: illegal base64 data at input byte 4`},
+			{fmt.Sprintf(`"privateKey": "%s", "peers": [{"publicKey": "%s", "presharedKey": "Zm9vYmFy"}]`, privateKey, peerKey), `invalid peer 0: invalid presharedKey: must be 32 bytes, got 6`},
+			{fmt.Sprintf(`"privateKey": "%s", "peers": [{"endpoint": "192.0.2.1:1"}]`, privateKey), `invalid peer 0: "publicKey" is required`},
+			{fmt.Sprintf(`"privateKey": "%s", "peers": [{"publicKey": "%s"}, {"publicKey": "%s"}]`, privateKey, peerKey, peerKey), "invalid peer 1: duplicate publicKey " + peerKey},
+			{fmt.Sprintf(`"privateKey": "%s", "peers": [{"publicKey": "%s", "allowedIPs": ["10.0.0.1"]}]`, privateKey, peerKey), `invalid peer 0: invalid allowedIPs entry "10.0.0.1": invalid CIDR address: 10.0.0.1`},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "wgnet",
+				"type": "wireguard",
+				%s,
+				"ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}
+			}`, tc.body)
+			_, _, err := loadConf([]byte(conf))
+			Expect(err).To(MatchError(tc.err))
+		}
+	})
+
+	It("round-trips socket addresses", func() {
+		for _, s := range []string{"192.0.2.1:51820", "[2001:db8::1]:4242"} {
+			addr, err := net.ResolveUDPAddr("udp", s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decodeSockaddr(encodeSockaddr(addr)).String()).To(Equal(s))
+		}
+	})
+
+	It("detects peer mismatches", func() {
+		pk, err := parseKey(peerKey)
+		Expect(err).NotTo(HaveOccurred())
+		_, ipn, err := net.ParseCIDR("10.0.0.0/24")
+		Expect(err).NotTo(HaveOccurred())
+
+		expected := []wgPeer{{PublicKey: pk, AllowedIPs: []net.IPNet{*ipn}}}
+		Expect(validatePeers(expected, expected)).To(Succeed())
+		Expect(validatePeers(nil, expected)).To(MatchError("wireguard interface has 0 peers, expected 1"))
+
+		found := []wgPeer{{PublicKey: pk, AllowedIPs: []net.IPNet{*ipn}, PersistentKeepalive: 10}}
+		Expect(validatePeers(found, expected)).To(MatchError(
+			fmt.Sprintf("wireguard peer %s persistent keepalive is 10, expected 0", peerKey)))
+	})
+})
+
+var _ = Describe("wireguard Operations", func() {
+	var originalNS, targetNS ns.NetNS
+	var dataDir string
+
+	BeforeEach(func() {
+		// Create a new NetNS so we don't modify the host
+		var err error
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		dataDir, err = ioutil.TempDir("", "wireguard_test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(originalNS)).To(Succeed())
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+	})
+
+	for _, ver := range testutils.AllSpecVersions {
+		// Redefine ver inside for scope so real value is picked up by each dynamically defined It()
+		// See Gingkgo's "Patterns for dynamically generating tests" documentation.
+		ver := ver
+
+		It(fmt.Sprintf("[%s] configures and deconfigures a wireguard link with ADD/CHECK/DEL", ver), func() {
+			const IFNAME = "wg0"
+
+			conf := fmt.Sprintf(`{
+			    "cniVersion": "%s",
+			    "name": "wgTest",
+			    "type": "wireguard",
+			    "privateKey": "%s",
+			    "listenPort": 51820,
+			    "peers": [{
+				"publicKey": "%s",
+				"endpoint": "192.0.2.1:51820",
+				"allowedIPs": ["10.1.2.0/24"],
+				"persistentKeepalive": 25
+			    }],
+			    "ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"dataDir": "%s"
+			    }
+			}`, ver, privateKey, peerKey, dataDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			var result types.Result
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				var err error
+				result, _, err = testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Make sure the wireguard link exists and is configured in the target namespace
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Type()).To(Equal("wireguard"))
+
+				addrs, err := netlink.AddrList(link, syscall.AF_INET)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(addrs)).To(Equal(1))
+
+				dev, err := wgGetDevice(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dev.PrivateKey.String()).To(Equal(privateKey))
+				Expect(dev.ListenPort).To(Equal(51820))
+				Expect(dev.Peers).To(HaveLen(1))
+				Expect(dev.Peers[0].PublicKey.String()).To(Equal(peerKey))
+				Expect(dev.Peers[0].Endpoint.String()).To(Equal("192.0.2.1:51820"))
+				Expect(dev.Peers[0].PersistentKeepalive).To(Equal(25))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// CNI Check the wireguard link in the target namespace
+			n := &Net{}
+			err = json.Unmarshal([]byte(conf), &n)
+			Expect(err).NotTo(HaveOccurred())
+
+			n.IPAM, _, err = allocator.LoadIPAMConfig([]byte(conf), "")
+			Expect(err).NotTo(HaveOccurred())
+
+			newConf, err := buildOneConfig("wgTest", ver, n, result)
+			Expect(err).NotTo(HaveOccurred())
+
+			confString, err := json.Marshal(newConf)
+			Expect(err).NotTo(HaveOccurred())
+
+			args.StdinData = confString
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+			})
+			if testutils.SpecVersionHasCHECK(ver) {
+				Expect(err).NotTo(HaveOccurred())
+
+				// Removing the peer must make CHECK fail
+				err = targetNS.Do(func(ns.NetNS) error {
+					dev, err := wgGetDevice(IFNAME)
+					if err != nil {
+						return err
+					}
+					dev.Peers = nil
+					return wgSetDevice(IFNAME, dev)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				err = originalNS.Do(func(ns.NetNS) error {
+					return testutils.CmdCheckWithArgs(args, func() error { return cmdCheck(args) })
+				})
+				Expect(err).To(MatchError("wireguard interface has 0 peers, expected 1"))
+			} else {
+				Expect(err).To(MatchError("config version does not allow CHECK"))
+			}
+
+			args.StdinData = []byte(conf)
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				err = testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Make sure the wireguard link has been deleted
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).To(HaveOccurred())
+				Expect(link).To(BeNil())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// DEL can be called multiple times, make sure no error is returned
+			// if the device is already removed.
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				err = testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	}
+})